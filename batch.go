@@ -0,0 +1,126 @@
+package trustedproxies
+
+import (
+	"net"
+)
+
+// ChainInput is a single request for DeduceBatch
+type ChainInput struct {
+	RemoteAddr net.IP
+	Header     string
+}
+
+// DeduceBatch deduces the client IP of each of reqs, like DeduceClientIP
+// would, e.g. to replay recorded requests against a new configuration.
+// The result holds the client IP of reqs[i] at index i, nil if none can
+// be determined. The same buffers are reused for every request, and the
+// configuration is locked once for the whole batch, so changes made
+// meanwhile apply to the next batch. Unlike DeduceClientIP, it doesn't
+// record history or observed hops.
+func (t *TrustedProxies) DeduceBatch(reqs []ChainInput) []*net.IP {
+	rv := make([]*net.IP, len(reqs))
+	ips := make([]net.IP, len(reqs))
+	backing := make([]byte, 0, net.IPv6len*len(reqs))
+	buf := getChainBuf()
+	defer putChainBuf(buf)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for idx, req := range reqs {
+		walked := t.walkInto(buf, req.RemoteAddr, req.Header)
+		if len(walked) == 0 || *walked[len(walked)-1] == nil {
+			continue
+		}
+		start := len(backing)
+		backing = append(backing, normalizeIP(*walked[len(walked)-1])...)
+		ips[idx] = backing[start:len(backing):len(backing)]
+		rv[idx] = &ips[idx]
+	}
+	return rv
+}
+
+// DeduceMany works like DeduceBatch, returning the client IPs rather
+// than pointers to them, nil where none can be determined. It is meant
+// for processing large logs: rather than caching parsed headers, it
+// reuses the same buffers for every input and stores the results in a
+// single allocation, so apart from parsing the header entries, it
+// doesn't allocate per input.
+func (t *TrustedProxies) DeduceMany(inputs []struct {
+	Remote net.IP
+	Header string
+}) []net.IP {
+	rv := make([]net.IP, len(inputs))
+	backing := make([]byte, 0, net.IPv6len*len(inputs))
+	buf := getChainBuf()
+	defer putChainBuf(buf)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for idx, input := range inputs {
+		walked := t.walkInto(buf, input.Remote, input.Header)
+		if len(walked) == 0 {
+			continue
+		}
+		start := len(backing)
+		backing = append(backing, normalizeIP(*walked[len(walked)-1])...)
+		rv[idx] = backing[start:len(backing):len(backing)]
+	}
+	return rv
+}
+
+// MinimizeFor returns a copy of t with only the trusted entries needed to
+// deduce the same client IPs as t for samples, see DeduceBatch, e.g. to
+// trim a list grown over time using recorded requests. Entries are
+// dropped greedily: one at a time, in the order they are matched, each
+// drop is kept if all samples still deduce the same client IP. Entries
+// no sample depends on are dropped, so samples must cover all expected
+// traffic. The deny list and the options are kept, and t is left
+// untouched.
+func (t *TrustedProxies) MinimizeFor(samples []ChainInput) *TrustedProxies {
+	n := t.clone()
+	want := t.DeduceBatch(samples)
+
+	n.mu.Lock()
+	entries := n.trustedCIDRs
+	n.mu.Unlock()
+	kept := make([]*net.IPNet, 0, len(entries))
+	for idx, ipnet := range entries {
+		// Try the kept entries, and those yet to be tried, without ipnet
+		candidate := append(append([]*net.IPNet{}, kept...), entries[idx+1:]...)
+		n.mu.Lock()
+		n.trustedCIDRs = candidate
+		n.invalidateIndex()
+		n.mu.Unlock()
+		if !sameClients(n.DeduceBatch(samples), want) {
+			kept = append(kept, ipnet)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer n.canonicalize()
+	n.trustedCIDRs = kept
+	keep := make(map[*net.IPNet]bool, len(kept))
+	for _, ipnet := range kept {
+		keep[ipnet] = true
+	}
+	for ipnet := range n.meta {
+		if !keep[ipnet] {
+			delete(n.meta, ipnet)
+		}
+	}
+	return n
+}
+
+// sameClients reports whether a and b hold the same client IPs
+func sameClients(a, b []*net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if (a[idx] == nil) != (b[idx] == nil) || (a[idx] != nil && !a[idx].Equal(*b[idx])) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTrustedProxies_DeduceBatch(t *testing.T) {
+	reqs := []ChainInput{
+		{net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("40.40.40.40"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("20.20.20.20"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("10.10.10.10"), ""},
+		{net.ParseIP("10.10.10.10"), "192.168.1.1, 30.30.30.30"},
+		{net.ParseIP("10.10.10.10"), "horse"},
+		{nil, "30.30.30.30"},
+	}
+	for _, opts := range [][]Option{nil, {SkipBogonsInHeader()}, {MaxHops(1)}, {LeftmostWhenTrusted()}} {
+		tr := New(opts...)
+		tr.AddFromString("10.10.10.10")
+		tr.AddFromString("20.20.20.20")
+		got := tr.DeduceBatch(reqs)
+		if len(got) != len(reqs) {
+			t.Fatalf("TrustedProxies.DeduceBatch() returned %v results, want %v", len(got), len(reqs))
+		}
+		for idx, req := range reqs {
+			want := tr.DeduceClientIP(req.RemoteAddr, req.Header)
+			if fmt.Sprint(got[idx]) != fmt.Sprint(want) {
+				t.Errorf("TrustedProxies.DeduceBatch()[%v] = %v, want %v", idx, got[idx], want)
+			}
+		}
+	}
+}
+
+func TestTrustedProxies_DeduceMany(t *testing.T) {
+	inputs := []struct {
+		Remote net.IP
+		Header string
+	}{
+		{net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("40.40.40.40"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("20.20.20.20"), "30.30.30.30, 20.20.20.20"},
+		{net.ParseIP("10.10.10.10"), ""},
+		{net.ParseIP("10.10.10.10"), "192.168.1.1, 30.30.30.30"},
+		{net.ParseIP("10.10.10.10"), "2001:db8::1, 20.20.20.20"},
+		{net.ParseIP("10.10.10.10"), "horse"},
+		{net.ParseIP("10.10.10.10"), "30.30.30.30 20.20.20.20"},
+		{nil, "30.30.30.30"},
+	}
+	for _, opts := range [][]Option{nil, {SkipBogonsInHeader()}, {MaxHops(1)}, {LeftmostWhenTrusted()}, {QuoteAwareHeader()}} {
+		tr := New(opts...)
+		tr.AddFromString("10.10.10.10")
+		tr.AddFromString("20.20.20.20")
+		got := tr.DeduceMany(inputs)
+		if len(got) != len(inputs) {
+			t.Fatalf("TrustedProxies.DeduceMany() returned %v results, want %v", len(got), len(inputs))
+		}
+		for idx, input := range inputs {
+			want := tr.DeduceClientIP(input.Remote, input.Header)
+			if (want == nil) != (got[idx] == nil) || (want != nil && !want.Equal(got[idx])) {
+				t.Errorf("TrustedProxies.DeduceMany()[%v] = %v, want %v", idx, got[idx], want)
+			}
+		}
+	}
+}
+
+func TestTrustedProxies_MinimizeFor(t *testing.T) {
+	tr := New(MaxHops(3))
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("10.1.0.0/16")
+	tr.AddFromString("20.20.20.20")
+	tr.AddFromString("30.30.30.30")
+	tr.AddFromString("192.168.0.0/16")
+	samples := []ChainInput{
+		{net.ParseIP("10.2.0.1"), "8.8.8.8"},
+		{net.ParseIP("10.1.0.1"), "8.8.4.4, 20.20.20.20"},
+		{net.ParseIP("192.168.1.1"), "1.1.1.1"},
+		{net.ParseIP("10.6.6.6"), "1.1.1.1"},
+		{net.ParseIP("8.8.8.8"), "1.1.1.1"},
+		{nil, "1.1.1.1"},
+	}
+
+	minimal := tr.MinimizeFor(samples)
+	want := []string{"10.0.0.0/8", "20.20.20.20/32", "192.168.0.0/16"}
+	if got := trustedStrings(minimal); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.MinimizeFor() = %v, want %v", got, want)
+	}
+	if got := tr.DeduceBatch(samples); !sameClients(minimal.DeduceBatch(samples), got) {
+		t.Errorf("TrustedProxies.MinimizeFor() deduces %v, want %v", minimal.DeduceBatch(samples), got)
+	}
+	if got := trustedStrings(tr); len(got) != 5 {
+		t.Errorf("TrustedProxies.MinimizeFor() changed the original to %v", got)
+	}
+
+	// The deny list and the options are kept
+	ip := net.ParseIP("10.6.6.6")
+	if minimal.IsIPTrusted(&ip) != nil {
+		t.Errorf("TrustedProxies.MinimizeFor() lost the deny list")
+	}
+	chain := "1.1.1.1, 10.0.0.4, 10.0.0.3, 10.0.0.2"
+	if got, want := minimal.DeduceClientIP(net.ParseIP("10.0.0.1"), chain), tr.DeduceClientIP(net.ParseIP("10.0.0.1"), chain); !got.Equal(*want) {
+		t.Errorf("TrustedProxies.MinimizeFor().DeduceClientIP() = %v, want %v", got, want)
+	}
+
+	// Without samples, nothing is needed
+	if got := trustedStrings(tr.MinimizeFor(nil)); len(got) != 0 {
+		t.Errorf("TrustedProxies.MinimizeFor(nil) = %v, want none", got)
+	}
+}
+
+func BenchmarkDeduceBatch(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	reqs := make([]ChainInput, 1000)
+	for idx := range reqs {
+		reqs[idx] = ChainInput{
+			RemoteAddr: net.ParseIP("10.0.0.1"),
+			Header:     fmt.Sprintf("203.0.113.%d, 192.168.1.1, 10.0.0.2", idx%10),
+		}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.DeduceBatch(reqs)
+	}
+}
+
+func BenchmarkDeduceClientIPLoop(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	reqs := make([]ChainInput, 1000)
+	for idx := range reqs {
+		reqs[idx] = ChainInput{
+			RemoteAddr: net.ParseIP("10.0.0.1"),
+			Header:     fmt.Sprintf("203.0.113.%d, 192.168.1.1, 10.0.0.2", idx%10),
+		}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, req := range reqs {
+			tr.DeduceClientIP(req.RemoteAddr, req.Header)
+		}
+	}
+}
+
+func BenchmarkDeduceMany(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	inputs := make([]struct {
+		Remote net.IP
+		Header string
+	}, 1000)
+	for idx := range inputs {
+		inputs[idx].Remote = net.ParseIP("10.0.0.1")
+		inputs[idx].Header = fmt.Sprintf("203.0.113.%d, 192.168.1.1, 10.0.0.2", idx%10)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.DeduceMany(inputs)
+	}
+}
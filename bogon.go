@@ -0,0 +1,119 @@
+package trustedproxies
+
+import (
+	"net"
+)
+
+// bogonNets are the ranges considered by IsBogon
+var bogonNets = mustParseCIDRs(
+	// IPv4
+	"0.0.0.0/8",       // "This" network
+	"10.0.0.0/8",      // Private-use (RFC 1918)
+	"100.64.0.0/10",   // Shared address space / CGNAT (RFC 6598)
+	"127.0.0.0/8",     // Loopback
+	"169.254.0.0/16",  // Link-local
+	"172.16.0.0/12",   // Private-use (RFC 1918)
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation (TEST-NET-1)
+	"192.168.0.0/16",  // Private-use (RFC 1918)
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation (TEST-NET-2)
+	"203.0.113.0/24",  // Documentation (TEST-NET-3)
+	"224.0.0.0/4",     // Multicast
+	"240.0.0.0/4",     // Reserved, including limited broadcast
+
+	// IPv6
+	"::/128",        // Unspecified
+	"::1/128",       // Loopback
+	"100::/64",      // Discard-only
+	"2001:db8::/32", // Documentation
+	"fc00::/7",      // Unique local
+	"fe80::/10",     // Link-local
+	"ff00::/8",      // Multicast
+)
+
+// IsBogon reports whether ip is a private or otherwise non-public
+// address: RFC 1918 private ranges, loopback, link-local, carrier-grade
+// NAT (100.64.0.0/10), documentation, multicast and reserved ranges, and
+// their IPv6 equivalents (e.g. unique local and link-local addresses).
+// IPv4-mapped IPv6 addresses are classified by their IPv4 address.
+func IsBogon(ip net.IP) bool {
+	for _, ipnet := range bogonNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNets are the ranges considered by IsPrivateNet
+var privateNets = mustParseCIDRs(
+	"10.0.0.0/8",     // RFC 1918
+	"172.16.0.0/12",  // RFC 1918
+	"192.168.0.0/16", // RFC 1918
+	"fc00::/7",       // Unique local
+)
+
+// linkLocalNets are the ranges considered by IsLinkLocalNet
+var linkLocalNets = mustParseCIDRs(
+	"169.254.0.0/16",
+	"fe80::/10",
+)
+
+// IsIPv4Net reports whether ipnet is an IPv4 network, including
+// IPv4-mapped IPv6 networks. It can be used with TrustedCIDRsFiltered.
+func IsIPv4Net(ipnet *net.IPNet) bool {
+	_, bits := canonicalNet(ipnet).Mask.Size()
+	return bits == 8*net.IPv4len
+}
+
+// IsIPv6Net reports whether ipnet is an IPv6 network other than an
+// IPv4-mapped one. It can be used with TrustedCIDRsFiltered.
+func IsIPv6Net(ipnet *net.IPNet) bool {
+	_, bits := canonicalNet(ipnet).Mask.Size()
+	return bits == 8*net.IPv6len
+}
+
+// IsPrivateNet reports whether ipnet lies entirely within the RFC 1918
+// private ranges or the IPv6 unique local range (fc00::/7). It can be
+// used with TrustedCIDRsFiltered.
+func IsPrivateNet(ipnet *net.IPNet) bool {
+	return withinNets(privateNets, canonicalNet(ipnet))
+}
+
+// IsLinkLocalNet reports whether ipnet lies entirely within the
+// link-local ranges (169.254.0.0/16 and fe80::/10). It can be used with
+// TrustedCIDRsFiltered.
+func IsLinkLocalNet(ipnet *net.IPNet) bool {
+	return withinNets(linkLocalNets, canonicalNet(ipnet))
+}
+
+// IsGlobalNet reports whether ipnet holds only public addresses, i.e.
+// none of it is a bogon (see IsBogon). It can be used with
+// TrustedCIDRsFiltered.
+func IsGlobalNet(ipnet *net.IPNet) bool {
+	c := canonicalNet(ipnet)
+	if _, bits := c.Mask.Size(); bits == 0 {
+		return false
+	}
+	for _, bogon := range bogonNets {
+		if containsNet(bogon, c) || containsNet(c, bogon) {
+			return false
+		}
+	}
+	return true
+}
+
+// mustParseCIDRs parses a list of CIDRs, panicking on failure. Only
+// meant for static lists.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	rv := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		rv = append(rv, ipnet)
+	}
+	return rv
+}
@@ -0,0 +1,85 @@
+package trustedproxies
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsBogon(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.1.1", true},
+		{"100.63.255.255", false},
+		{"100.64.0.0", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"100.128.0.1", false},
+		{"0.0.0.0", true},
+		{"255.255.255.255", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+		{"2001:db8::1", true},
+		{"2606:4700:4700::1111", false},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsBogon(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsBogon(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_SkipBogonsInHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		remoteAddr   string
+		header       string
+		want         string
+		wantSkipping string
+	}{
+		{"Bogon as client", []string{"30.30.30.30"}, "30.30.30.30", "8.8.8.8, 192.168.1.1", "192.168.1.1", "8.8.8.8"},
+		{"Only bogons", []string{"30.30.30.30"}, "30.30.30.30", "192.168.1.1", "192.168.1.1", "30.30.30.30"},
+		{"Bogon remote is kept", []string{}, "10.10.10.10", "8.8.8.8", "10.10.10.10", "10.10.10.10"},
+		{"Bogon between trusted hops", []string{"30.30.30.30", "40.40.40.40"}, "30.30.30.30", "8.8.8.8, 40.40.40.40, 10.0.0.1", "10.0.0.1", "8.8.8.8"},
+		{"Several interleaved bogons", []string{"30.30.30.30", "40.40.40.40"}, "30.30.30.30", "8.8.8.8, 127.0.0.1, 40.40.40.40, fe80::1, 100.64.0.1", "100.64.0.1", "8.8.8.8"},
+		{"Bogon beyond untrusted hop", []string{"30.30.30.30"}, "30.30.30.30", "192.168.1.1, 8.8.8.8, 10.0.0.1", "10.0.0.1", "8.8.8.8"},
+		{"No bogons", []string{"30.30.30.30"}, "30.30.30.30", "8.8.8.8, 9.9.9.9", "9.9.9.9", "9.9.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, skipping := range []bool{false, true} {
+				opts := []Option{}
+				want := tt.want
+				if skipping {
+					opts = append(opts, SkipBogonsInHeader())
+					want = tt.wantSkipping
+				}
+				tr := New(opts...)
+				for _, t := range tt.trustedCIDRs {
+					tr.AddFromString(t)
+				}
+				if got := tr.DeduceClientIP(net.ParseIP(tt.remoteAddr), tt.header); got.String() != want {
+					t.Errorf("TrustedProxies.DeduceClientIP() with skipping = %v: %v, want %v", skipping, got, want)
+				}
+			}
+		})
+	}
+}
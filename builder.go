@@ -0,0 +1,81 @@
+package trustedproxies
+
+// Builder assembles a TrustedProxies through chained calls, e.g.
+//
+//	tp, err := trustedproxies.Build().PrivateRanges().Cloudflare().Add("203.0.113.0/24").MaxHops(3).Done()
+//
+// The first error encountered is returned by Done. Calls after an error
+// have no effect.
+type Builder struct {
+	tp  *TrustedProxies
+	err error
+}
+
+// Build starts building a TrustedProxies
+func Build(opts ...Option) *Builder {
+	return &Builder{tp: New(opts...)}
+}
+
+// With applies opts
+func (b *Builder) With(opts ...Option) *Builder {
+	if b.err == nil {
+		for _, opt := range opts {
+			opt(b.tp)
+		}
+	}
+	return b
+}
+
+// PrivateRanges trusts the private ranges, see AddPrivateRanges
+func (b *Builder) PrivateRanges() *Builder {
+	if b.err == nil {
+		b.tp.AddPrivateRanges()
+	}
+	return b
+}
+
+// CGNAT trusts the carrier-grade NAT range, see AddCGNAT
+func (b *Builder) CGNAT() *Builder {
+	if b.err == nil {
+		b.tp.AddCGNAT()
+	}
+	return b
+}
+
+// DocumentationRanges trusts the ranges reserved for documentation, see
+// AddDocumentationRanges
+func (b *Builder) DocumentationRanges() *Builder {
+	if b.err == nil {
+		b.tp.AddDocumentationRanges()
+	}
+	return b
+}
+
+// Cloudflare trusts Cloudflare's ranges, see AddCloudflare
+func (b *Builder) Cloudflare() *Builder {
+	if b.err == nil {
+		b.tp.AddCloudflare()
+	}
+	return b
+}
+
+// Add trusts spec, see AddFromString
+func (b *Builder) Add(spec string) *Builder {
+	if b.err == nil {
+		b.err = b.tp.AddFromString(spec)
+	}
+	return b
+}
+
+// MaxHops limits the number of trusted hops, see the MaxHops option
+func (b *Builder) MaxHops(n int) *Builder {
+	return b.With(MaxHops(n))
+}
+
+// Done returns the built TrustedProxies, or the first error encountered
+func (b *Builder) Done() (*TrustedProxies, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.tp, nil
+}
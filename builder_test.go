@@ -0,0 +1,69 @@
+package trustedproxies
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tp, err := Build().PrivateRanges().Cloudflare().Add("203.0.113.0/24").MaxHops(3).Done()
+	if err != nil {
+		t.Fatalf("Build().Done() error = %v", err)
+	}
+
+	for _, s := range []string{"10.1.1.1", "192.168.1.1", "fd00::1", "173.245.48.1", "2606:4700::1", "203.0.113.5"} {
+		ip := net.ParseIP(s)
+		if tp.IsIPTrusted(&ip) == nil {
+			t.Errorf("%v should be trusted", s)
+		}
+	}
+	ip := net.ParseIP("8.8.8.8")
+	if tp.IsIPTrusted(&ip) != nil {
+		t.Errorf("8.8.8.8 should not be trusted")
+	}
+	if label, _ := tp.Label(net.ParseIP("173.245.48.1")); label != "cloudflare" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "cloudflare")
+	}
+	if label, _ := tp.Label(net.ParseIP("10.1.1.1")); label != "private" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "private")
+	}
+
+	got := tp.DeduceClientIP(net.ParseIP("10.0.0.1"), "8.8.8.8, 10.0.0.4, 10.0.0.3, 10.0.0.2")
+	if got.String() != "10.0.0.4" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.0.0.4")
+	}
+}
+
+func TestBuildError(t *testing.T) {
+	tp, err := Build().PrivateRanges().Add("horse").Add("203.0.113.0/24").Done()
+	if !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("Build().Done() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	if tp != nil {
+		t.Errorf("Build().Done() = %v, want nil", tp)
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxHops int
+		want    string
+	}{
+		{"No limit", 0, "40.40.40.40"},
+		{"Negative means no limit", -1, "40.40.40.40"},
+		{"One hop", 1, "10.0.0.2"},
+		{"Two hops", 2, "10.0.0.3"},
+		{"Limit beyond chain", 10, "40.40.40.40"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(MaxHops(tt.maxHops))
+			tr.AddFromString("10.0.0.0/8")
+			if got := tr.DeduceClientIP(net.ParseIP("10.0.0.1"), "40.40.40.40, 10.0.0.3, 10.0.0.2"); got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
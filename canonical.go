@@ -0,0 +1,180 @@
+package trustedproxies
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Fingerprint returns a SHA-256 hash, hex encoded, of the normalized
+// configuration: trusted ranges (including port restrictions) and the
+// deny list. It does not depend on the order in which entries were
+// added, nor on duplicates or the notation used (e.g. "10.0.0.1" vs.
+// "10.0.0.1/32" or IPv4-mapped IPv6), which makes it suitable for cache
+// invalidation and detecting configuration drift.
+func (t *TrustedProxies) Fingerprint() string {
+	t.mu.RLock()
+	lines := t.canonicalLines()
+	t.mu.RUnlock()
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// summaryVersion is the first byte of Summary, changed whenever its
+// encoding changes
+const summaryVersion = 1
+
+// Summary returns a compact binary encoding of the same normalized
+// configuration Fingerprint hashes, for comparing configurations, e.g.
+// across a cluster. Equal configurations have byte-identical summaries;
+// compare them with bytes.Equal. Labels, TTLs and options are not
+// included.
+//
+// The encoding is a version byte followed by the sorted entries. Each
+// entry is a kind (0 for trusted, 1 for denied), the address length (4
+// or 16), the prefix length, the significant bytes of the address, the
+// number of ports and the ports, the last two as uvarints.
+func (t *TrustedProxies) Summary() []byte {
+	t.mu.RLock()
+	seen := map[string]bool{}
+	for _, ipnet := range t.trustedCIDRs {
+		seen[string(summaryEntry(0, canonicalNet(ipnet), t.portsOf(ipnet)))] = true
+	}
+	for _, ipnet := range t.deniedNets() {
+		seen[string(summaryEntry(1, ipnet, nil))] = true
+	}
+	t.mu.RUnlock()
+
+	entries := make([]string, 0, len(seen))
+	for entry := range seen {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+
+	rv := []byte{summaryVersion}
+	for _, entry := range entries {
+		rv = append(rv, entry...)
+	}
+	return rv
+}
+
+// summaryEntry encodes a single entry of Summary
+func summaryEntry(kind byte, ipnet *net.IPNet, ports []int) []byte {
+	ones, bits := ipnet.Mask.Size()
+	ip := ipnet.IP.To16()
+	if bits == 8*net.IPv4len {
+		ip = ipnet.IP.To4()
+	}
+	rv := []byte{kind, byte(bits / 8), byte(ones)}
+	rv = append(rv, ip.Mask(ipnet.Mask)[:(ones+7)/8]...)
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	rv = append(rv, buf[:binary.PutUvarint(buf, uint64(len(ports)))]...)
+	for _, port := range ports {
+		rv = append(rv, buf[:binary.PutUvarint(buf, uint64(port))]...)
+	}
+	return rv
+}
+
+// canonicalLines returns the sorted, deduplicated configuration, one
+// entry per line
+func (t *TrustedProxies) canonicalLines() []string {
+	seen := map[string]bool{}
+	for _, ipnet := range t.trustedCIDRs {
+		line := canonicalNet(ipnet).String()
+		if ports := t.portsOf(ipnet); len(ports) > 0 {
+			line += " ports=" + joinPorts(ports, ",")
+		}
+		seen[line] = true
+	}
+	for _, ipnet := range t.deniedNets() {
+		seen["!"+ipnet.String()] = true
+	}
+
+	lines := make([]string, 0, len(seen))
+	for line := range seen {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// WriteTo writes the configuration to w, one entry per line: the trusted
+// ranges, normalized, sorted and without duplicates, including their
+// port restrictions, and the deny list, prefixed with "!". The output can
+// be read back with AddFromReader; labels are not included.
+func (t *TrustedProxies) WriteTo(w io.Writer) (int64, error) {
+	t.mu.RLock()
+	lines := t.canonicalLines()
+	t.mu.RUnlock()
+
+	var total int64
+	for _, line := range lines {
+		n, err := io.WriteString(w, line+"\n")
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// deniedNets returns the deny list, both single addresses and networks,
+// in canonical form. Single addresses come last, in no particular order.
+func (t *TrustedProxies) deniedNets() []*net.IPNet {
+	rv := make([]*net.IPNet, 0, len(t.deniedCIDRs)+len(t.deniedIPs))
+	for _, ipnet := range t.deniedCIDRs {
+		rv = append(rv, canonicalNet(ipnet))
+	}
+	for key := range t.deniedIPs {
+		ip := net.IP(key)
+		rv = append(rv, canonicalNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}))
+	}
+	return rv
+}
+
+// NormalizeSpec parses a specification as accepted by AddFromString and
+// returns it the way it is stored, e.g. "10.0.0.0/24" for "10.0.0.5/24".
+// changed reports whether that differs from s other than in whitespace,
+// which lets linters point out specifications that don't mean what they
+// seem to. Ports are dropped, like AddFromString does.
+func NormalizeSpec(s string) (normalized string, changed bool, err error) {
+	spec, _ := withoutPorts(s)
+	if _, _, err := parseSpec(spec); err != nil {
+		return "", false, err
+	}
+
+	fields := strings.Fields(spec)
+	parts := make([]string, len(fields))
+	for idx, field := range fields {
+		prefix := ""
+		if idx > 0 {
+			prefix, field = "!", field[1:]
+		}
+		parts[idx] = prefix + normalizeField(field)
+	}
+	normalized = strings.Join(parts, " ")
+	return normalized, normalized != strings.Join(strings.Fields(s), " "), nil
+}
+
+// normalizeField normalizes a single, valid IP, CIDR or range. A bare IP
+// stays a bare IP, and a range stays a range unless it is exactly one
+// network.
+func normalizeField(field string) string {
+	nets, _ := netsFromString(field)
+	if len(nets) == 1 {
+		ipnet := nets[0]
+		if ones, bits := ipnet.Mask.Size(); ones == bits && !strings.ContainsAny(field, "/-") {
+			return ipnet.IP.String()
+		}
+		return ipnet.String()
+	}
+	first, _ := Bounds(nets[0])
+	_, last := Bounds(nets[len(nets)-1])
+	return first.String() + "-" + last.String()
+}
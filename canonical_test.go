@@ -0,0 +1,220 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func fingerprintOf(specs ...string) string {
+	tr := New()
+	for _, spec := range specs {
+		tr.AddFromString(spec)
+	}
+	return tr.Fingerprint()
+}
+
+func TestTrustedProxies_FingerprintIsOrderIndependent(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+	}{
+		{"Empty", []string{}, []string{}},
+		{"Order", []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}, []string{"2001:db8::/32", "192.168.0.0/16", "10.0.0.0/8"}},
+		{"Duplicates", []string{"10.0.0.0/8", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"Notation", []string{"10.0.0.1", "10.0.0.5/24", "2001:0db8::/32"}, []string{"10.0.0.1/32", "10.0.0.0/24", "2001:db8::/32"}},
+		{"IPv4-mapped", []string{"::ffff:192.0.2.0/120"}, []string{"192.0.2.0/24"}},
+		{"Exclusions", []string{"10.0.0.0/8 !10.6.6.0/24 !10.1.1.1"}, []string{"10.0.0.0/8 !10.1.1.1 !10.6.6.0/24"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := fingerprintOf(tt.a...), fingerprintOf(tt.b...); a != b {
+				t.Errorf("TrustedProxies.Fingerprint() = %v and %v, want equal", a, b)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_FingerprintIsChangeSensitive(t *testing.T) {
+	base := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	tests := []struct {
+		name    string
+		changed []string
+	}{
+		{"Entry added", []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12"}},
+		{"Entry removed", []string{"10.0.0.0/8"}},
+		{"Prefix changed", []string{"10.0.0.0/9", "192.168.0.0/16"}},
+		{"Address changed", []string{"11.0.0.0/8", "192.168.0.0/16"}},
+		{"Exclusion added", []string{"10.0.0.0/8 !10.6.6.0/24", "192.168.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := fingerprintOf(base...), fingerprintOf(tt.changed...); a == b {
+				t.Errorf("TrustedProxies.Fingerprint() = %v for both, want different", a)
+			}
+		})
+	}
+
+	unrestricted := New()
+	unrestricted.AddFromString("10.0.0.0/8")
+	restricted := New()
+	restricted.AddForPorts("10.0.0.0/8", 443)
+	if unrestricted.Fingerprint() == restricted.Fingerprint() {
+		t.Errorf("TrustedProxies.Fingerprint() does not reflect port restrictions")
+	}
+}
+
+func summaryOf(specs ...string) []byte {
+	tr := New()
+	for _, spec := range specs {
+		tr.AddFromString(spec)
+	}
+	return tr.Summary()
+}
+
+func TestTrustedProxies_SummaryIsOrderIndependent(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+	}{
+		{"Empty", []string{}, []string{}},
+		{"Order", []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}, []string{"2001:db8::/32", "192.168.0.0/16", "10.0.0.0/8"}},
+		{"Duplicates", []string{"10.0.0.0/8", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"Notation", []string{"10.0.0.1", "10.0.0.5/24", "2001:0db8::/32"}, []string{"10.0.0.1/32", "10.0.0.0/24", "2001:db8::/32"}},
+		{"IPv4-mapped", []string{"::ffff:192.0.2.0/120"}, []string{"192.0.2.0/24"}},
+		{"Exclusions", []string{"10.0.0.0/8 !10.6.6.0/24 !10.1.1.1"}, []string{"10.0.0.0/8 !10.1.1.1 !10.6.6.0/24"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := summaryOf(tt.a...), summaryOf(tt.b...); !bytes.Equal(a, b) {
+				t.Errorf("TrustedProxies.Summary() = %x and %x, want equal", a, b)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_SummaryIsChangeSensitive(t *testing.T) {
+	base := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	tests := []struct {
+		name    string
+		changed []string
+	}{
+		{"Entry added", []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12"}},
+		{"Entry removed", []string{"10.0.0.0/8"}},
+		{"Prefix changed", []string{"10.0.0.0/9", "192.168.0.0/16"}},
+		{"Address changed", []string{"11.0.0.0/8", "192.168.0.0/16"}},
+		{"Exclusion added", []string{"10.0.0.0/8 !10.6.6.0/24", "192.168.0.0/16"}},
+		{"Trusted becomes denied", []string{"10.0.0.0/8", "0.0.0.0/0 !192.168.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := summaryOf(base...), summaryOf(tt.changed...); bytes.Equal(a, b) {
+				t.Errorf("TrustedProxies.Summary() = %x for both, want different", a)
+			}
+		})
+	}
+
+	unrestricted := New()
+	unrestricted.AddFromString("10.0.0.0/8")
+	restricted := New()
+	restricted.AddForPorts("10.0.0.0/8", 443)
+	if bytes.Equal(unrestricted.Summary(), restricted.Summary()) {
+		t.Errorf("TrustedProxies.Summary() does not reflect port restrictions")
+	}
+}
+
+func TestTrustedProxies_SummaryIsCompact(t *testing.T) {
+	// Version, then kind, length, prefix length, one address byte and no
+	// ports
+	want := []byte{summaryVersion, 0, 4, 8, 10, 0}
+	if got := summaryOf("10.0.0.0/8"); !bytes.Equal(got, want) {
+		t.Errorf("TrustedProxies.Summary() = %x, want %x", got, want)
+	}
+}
+
+func TestNormalizeSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		want        string
+		wantChanged bool
+		wantErr     error
+	}{
+		{"IP", "10.0.0.5", "10.0.0.5", false, nil},
+		{"CIDR", "10.0.0.0/24", "10.0.0.0/24", false, nil},
+		{"Host bits set", "10.0.0.5/24", "10.0.0.0/24", true, nil},
+		{"Host CIDR", "10.0.0.5/32", "10.0.0.5/32", false, nil},
+		{"IPv6", "2001:db8::/32", "2001:db8::/32", false, nil},
+		{"IPv6 long form", "2001:0DB8:0000::1", "2001:db8::1", true, nil},
+		{"IPv6 host bits set", "2001:db8::1/32", "2001:db8::/32", true, nil},
+		{"IPv4-mapped", "::ffff:10.0.0.5", "10.0.0.5", true, nil},
+		{"Whitespace", "  10.0.0.0/8   !10.6.6.6 ", "10.0.0.0/8 !10.6.6.6", false, nil},
+		{"Exclusion with host bits set", "10.0.0.0/8 !10.6.6.6/24", "10.0.0.0/8 !10.6.6.0/24", true, nil},
+		{"Range", "192.0.2.10-192.0.2.20", "192.0.2.10-192.0.2.20", false, nil},
+		{"Range of one network", "192.0.2.0-192.0.2.255", "192.0.2.0/24", true, nil},
+		{"Last octet range", "192.0.2.10-20", "192.0.2.10-192.0.2.20", true, nil},
+		{"Port", "10.0.0.5:8080", "10.0.0.5", true, nil},
+		{"IPv6 port", "[2001:db8::1]:443", "2001:db8::1", true, nil},
+		{"Invalid", "horse", "", false, ErrInvalidIPSpecification},
+		{"Empty", "", "", false, ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := NormalizeSpec(tt.spec)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || changed != tt.wantChanged {
+				t.Errorf("NormalizeSpec() = %q, %v, want %q, %v", got, changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_WriteTo(t *testing.T) {
+	tr := New()
+	tr.AddFromString("192.168.0.0/16")
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6 !10.7.0.0/16")
+	tr.AddFromString("::ffff:192.0.2.0/120")
+	tr.AddFromString("2001:db8::/32")
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddForPorts("172.16.0.1", 8443, 443)
+
+	buf := &bytes.Buffer{}
+	n, err := tr.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("TrustedProxies.WriteTo() error = %v", err)
+	}
+	want := "!10.6.6.6/32\n!10.7.0.0/16\n10.0.0.0/8\n172.16.0.1/32 ports=443,8443\n192.0.2.0/24\n192.168.0.0/16\n2001:db8::/32\n"
+	if got := buf.String(); got != want {
+		t.Errorf("TrustedProxies.WriteTo() wrote %q, want %q", got, want)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("TrustedProxies.WriteTo() = %v, want %v", n, len(want))
+	}
+
+	restored := New()
+	if err := restored.AddFromReader(buf); err != nil {
+		t.Fatalf("TrustedProxies.AddFromReader() error = %v", err)
+	}
+	if got, want := restored.Fingerprint(), tr.Fingerprint(); got != want {
+		t.Errorf("Round-tripped Fingerprint() = %v, want %v", got, want)
+	}
+	ip := net.ParseIP("10.6.6.6")
+	if got := restored.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+	if got := restored.DeduceClientIPForPort(net.ParseIP("172.16.0.1"), "8.8.8.8", 443); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIPForPort() = %v, want %v", got, "8.8.8.8")
+	}
+}
+
+func TestTrustedProxies_WriteToEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if n, err := New().WriteTo(buf); n != 0 || err != nil || buf.Len() != 0 {
+		t.Errorf("TrustedProxies.WriteTo() = %v, %v, wrote %q", n, err, buf.String())
+	}
+}
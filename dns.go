@@ -0,0 +1,260 @@
+package trustedproxies
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver performs the DNS lookups needed for FCrDNSPolicy. It is
+// implemented by *net.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// fcrdnsTimeout limits the lookups done for a single hop
+const fcrdnsTimeout = 2 * time.Second
+
+// FCrDNSPolicy is a TrustPolicy that, in addition to the configured
+// ranges, trusts hops based on forward-confirmed reverse DNS: a hop is
+// trusted if one of its PTR names ends with one of the configured
+// suffixes and that name resolves back to the hop's IP.
+//
+// Decisions are cached per IP, up to a configured number of IPs, with
+// the least recently used ones evicted first. Failed lookups are not
+// cached. As the policy is consulted while the TrustedProxies is locked,
+// uncached lookups delay changes to it.
+type FCrDNSPolicy struct {
+	resolver Resolver
+	suffixes []string
+
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	cache map[string]*list.Element
+}
+
+type fcrdnsEntry struct {
+	ip      string
+	trusted bool
+}
+
+// NewFCrDNSPolicy returns an FCrDNSPolicy using resolver (e.g.
+// net.DefaultResolver) that trusts names ending with one of suffixes,
+// e.g. "googlebot.com", and caches the decisions for up to cacheSize
+// IPs
+func NewFCrDNSPolicy(resolver Resolver, cacheSize int, suffixes ...string) *FCrDNSPolicy {
+	p := &FCrDNSPolicy{
+		resolver: resolver,
+		size:     cacheSize,
+		order:    list.New(),
+		cache:    map[string]*list.Element{},
+	}
+	for _, suffix := range suffixes {
+		p.suffixes = append(p.suffixes, normalizeName(suffix))
+	}
+	return p
+}
+
+// Trusted implements TrustPolicy
+func (p *FCrDNSPolicy) Trusted(hop HopInfo) bool {
+	if hop.InTrustedRange {
+		return true
+	}
+	if hop.IP == nil {
+		return false
+	}
+
+	key := hop.IP.String()
+	if trusted, ok := p.cached(key); ok {
+		return trusted
+	}
+	trusted, err := p.confirm(hop.IP)
+	if err != nil {
+		return false
+	}
+	p.store(key, trusted)
+	return trusted
+}
+
+// confirm does the forward-confirmed reverse DNS check for ip
+func (p *FCrDNSPolicy) confirm(ip net.IP) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fcrdnsTimeout)
+	defer cancel()
+
+	names, err := p.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if !p.matchesSuffix(normalizeName(name)) {
+			continue
+		}
+		addrs, err := p.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchesSuffix reports whether name equals one of the suffixes or is
+// a subdomain of one
+func (p *FCrDNSPolicy) matchesSuffix(name string) bool {
+	for _, suffix := range p.suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *FCrDNSPolicy) cached(key string) (trusted, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.cache[key]
+	if !ok {
+		return false, false
+	}
+	p.order.MoveToFront(elem)
+	return elem.Value.(*fcrdnsEntry).trusted, true
+}
+
+func (p *FCrDNSPolicy) store(key string, trusted bool) {
+	if p.size <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.cache[key]; ok {
+		elem.Value.(*fcrdnsEntry).trusted = trusted
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.cache[key] = p.order.PushFront(&fcrdnsEntry{key, trusted})
+	if p.order.Len() > p.size {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.cache, oldest.Value.(*fcrdnsEntry).ip)
+	}
+}
+
+// normalizeName lowercases a DNS name and strips leading and trailing
+// dots
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+// DNSRefresher keeps the entries of a TrustedProxies in sync with the A
+// and AAAA records of a host name, e.g. for service meshes publishing
+// their proxies in DNS. Each address is trusted as a single IP entry
+// whose source (see EntriesBySource) is "dns:" followed by the name.
+type DNSRefresher struct {
+	t        *TrustedProxies
+	resolver Resolver
+	host     string
+	interval time.Duration
+	// newTicker returns the channel Run waits on between refreshes and a
+	// function stopping it. Tests replace it to tick deterministically.
+	newTicker func(d time.Duration) (<-chan time.Time, func())
+}
+
+// newTimeTicker is the default DNSRefresher.newTicker, a time.Ticker
+func newTimeTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// dnsRefreshTimeout limits the lookup done by a single refresh
+const dnsRefreshTimeout = 5 * time.Second
+
+// NewDNSRefresher returns a DNSRefresher updating t with the addresses
+// of host, looked up with resolver (e.g. net.DefaultResolver), every
+// interval when running
+func NewDNSRefresher(t *TrustedProxies, resolver Resolver, host string, interval time.Duration) *DNSRefresher {
+	return &DNSRefresher{t: t, resolver: resolver, host: host, interval: interval, newTicker: newTimeTicker}
+}
+
+// Refresh looks up the addresses of the host once. New addresses are
+// added, and the entries of addresses no longer published are removed,
+// in a single change. Entries of addresses still published are kept as
+// they are. If the lookup fails, t is left untouched.
+func (r *DNSRefresher) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+	defer cancel()
+	addrs, err := r.resolver.LookupIPAddr(ctx, r.host)
+	if err != nil {
+		return err
+	}
+
+	// Keyed by the entry's CIDR, keys holds them in the order returned
+	current := map[string]*net.IPNet{}
+	keys := []string{}
+	for _, addr := range addrs {
+		ipnet, err := netFromIPOrCIDR(addr.IP.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := current[ipnet.String()]; !ok {
+			current[ipnet.String()] = ipnet
+			keys = append(keys, ipnet.String())
+		}
+	}
+
+	source := "dns:" + r.host
+	t := r.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	kept := t.trustedCIDRs[:0]
+	for _, ipnet := range t.trustedCIDRs {
+		if t.sourceOf(ipnet) == source {
+			if _, ok := current[ipnet.String()]; !ok {
+				delete(t.meta, ipnet)
+				continue
+			}
+			delete(current, ipnet.String())
+		}
+		kept = append(kept, ipnet)
+	}
+	for idx := len(kept); idx < len(t.trustedCIDRs); idx++ {
+		t.trustedCIDRs[idx] = nil
+	}
+	t.trustedCIDRs = kept
+	for _, key := range keys {
+		if ipnet, ok := current[key]; ok {
+			t.trustedCIDRs = append(t.trustedCIDRs, ipnet)
+			m := t.metaFor(ipnet)
+			m.spec = ipnet.IP.String()
+			m.source = source
+		}
+	}
+	return nil
+}
+
+// Run refreshes right away and then every interval until ctx is done.
+// Failed refreshes keep the previous addresses and are passed to
+// onError, if not nil.
+func (r *DNSRefresher) Run(ctx context.Context, onError func(error)) {
+	ticks, stop := r.newTicker(r.interval)
+	defer stop()
+	for {
+		if err := r.Refresh(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+	}
+}
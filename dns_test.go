@@ -0,0 +1,265 @@
+package trustedproxies
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// net.Resolver can be used with FCrDNSPolicy
+var _ Resolver = &net.Resolver{}
+
+// fakeResolver answers from static maps and counts reverse lookups
+type fakeResolver struct {
+	mu      sync.Mutex
+	ptr     map[string][]string
+	forward map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	names, ok := r.ptr[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return names, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.forward[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	rv := []net.IPAddr{}
+	for _, addr := range addrs {
+		rv = append(rv, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return rv, nil
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		ptr: map[string][]string{
+			"20.20.20.1": {"proxy1.edge.example.com."},
+			"20.20.20.2": {"proxy2.edge.example.com."},
+			"20.20.20.3": {"proxy3.evil.example.net."},
+			"20.20.20.4": {"unrelated.example.org.", "Proxy4.Edge.Example.Com."},
+		},
+		forward: map[string][]string{
+			"proxy1.edge.example.com.": {"20.20.20.1"},
+			"proxy2.edge.example.com.": {"30.30.30.30"},
+			"proxy3.evil.example.net.": {"20.20.20.3"},
+			"Proxy4.Edge.Example.Com.": {"20.20.20.9", "20.20.20.4"},
+			"unrelated.example.org.":   {"20.20.20.4"},
+		},
+	}
+}
+
+func TestFCrDNSPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"Confirmed", "20.20.20.1", true},
+		{"Unconfirmed", "20.20.20.2", false},
+		{"Suffix mismatch", "20.20.20.3", false},
+		{"One of several names, case insensitive", "20.20.20.4", true},
+		{"No PTR", "20.20.20.6", false},
+	}
+	p := NewFCrDNSPolicy(newFakeResolver(), 16, ".edge.example.com")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Trusted(HopInfo{IP: net.ParseIP(tt.ip)}); got != tt.want {
+				t.Errorf("FCrDNSPolicy.Trusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := p.Trusted(HopInfo{IP: net.ParseIP("10.0.0.1"), InTrustedRange: true}); !got {
+		t.Errorf("FCrDNSPolicy.Trusted() = %v for a hop in a trusted range", got)
+	}
+}
+
+func TestFCrDNSPolicyCache(t *testing.T) {
+	resolver := newFakeResolver()
+	p := NewFCrDNSPolicy(resolver, 2, "edge.example.com")
+
+	for _, ip := range []string{"20.20.20.1", "20.20.20.2", "20.20.20.1", "20.20.20.2"} {
+		p.Trusted(HopInfo{IP: net.ParseIP(ip)})
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("Expected 2 lookups, got %v", resolver.lookups)
+	}
+
+	// 20.20.20.1 was used most recently, so 20.20.20.2 is evicted
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.1")})
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.3")})
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.1")})
+	if resolver.lookups != 3 {
+		t.Errorf("Expected 3 lookups, got %v", resolver.lookups)
+	}
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.2")})
+	if resolver.lookups != 4 {
+		t.Errorf("Expected 4 lookups, got %v", resolver.lookups)
+	}
+
+	// Failures aren't cached
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.6")})
+	p.Trusted(HopInfo{IP: net.ParseIP("20.20.20.6")})
+	if resolver.lookups != 6 {
+		t.Errorf("Expected 6 lookups, got %v", resolver.lookups)
+	}
+}
+
+func TestFCrDNSPolicyDeduceClientIP(t *testing.T) {
+	tr := New(Policy(NewFCrDNSPolicy(newFakeResolver(), 16, "edge.example.com")))
+	tr.AddFromString("10.0.0.0/8")
+	if got := tr.DeduceClientIP(net.ParseIP("10.0.0.1"), "8.8.8.8, 20.20.20.1"); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "8.8.8.8")
+	}
+	if got := tr.DeduceClientIP(net.ParseIP("10.0.0.1"), "8.8.8.8, 20.20.20.2"); got.String() != "20.20.20.2" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "20.20.20.2")
+	}
+}
+
+func TestDNSRefresher_Refresh(t *testing.T) {
+	resolver := &fakeResolver{forward: map[string][]string{
+		"proxies.mesh.example.com": {"10.0.0.1", "10.0.0.2", "2001:db8::1"},
+	}}
+	tr := New()
+	tr.AddFromString("10.0.0.2")
+	r := NewDNSRefresher(tr, resolver, "proxies.mesh.example.com", time.Minute)
+
+	if err := r.Refresh(); err != nil {
+		t.Fatalf("DNSRefresher.Refresh() error = %v", err)
+	}
+	want := []string{"10.0.0.2/32", "10.0.0.1/32", "10.0.0.2/32", "2001:db8::1/128"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Fatalf("DNSRefresher.Refresh() entries = %v, want %v", got, want)
+	}
+	kept := tr.trustedCIDRs[1]
+
+	// The records change between ticks
+	resolver.mu.Lock()
+	resolver.forward["proxies.mesh.example.com"] = []string{"10.0.0.3", "10.0.0.1"}
+	resolver.mu.Unlock()
+	if err := r.Refresh(); err != nil {
+		t.Fatalf("DNSRefresher.Refresh() error = %v", err)
+	}
+	want = []string{"10.0.0.2/32", "10.0.0.1/32", "10.0.0.3/32"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSRefresher.Refresh() entries = %v, want %v", got, want)
+	}
+	if tr.trustedCIDRs[1] != kept {
+		t.Errorf("DNSRefresher.Refresh() replaced an entry that is still published")
+	}
+	if got := stringsOf(tr.EntriesBySource("dns:proxies.mesh.example.com")); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("TrustedProxies.EntriesBySource() = %v, want %v", got, want[1:])
+	}
+	ip := net.ParseIP("2001:db8::1")
+	if got := tr.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v for a stale address, want nil", got)
+	}
+
+	// A failed lookup keeps the entries
+	resolver.mu.Lock()
+	delete(resolver.forward, "proxies.mesh.example.com")
+	resolver.mu.Unlock()
+	if err := r.Refresh(); err == nil {
+		t.Errorf("DNSRefresher.Refresh() error = nil, want an error")
+	}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSRefresher.Refresh() entries = %v after a failure, want %v", got, want)
+	}
+}
+
+// scriptedResolver answers the i-th forward lookup with the i-th
+// answer, or the last one once they run out. A nil answer is an error.
+type scriptedResolver struct {
+	fakeResolver
+	answers [][]string
+	calls   int
+}
+
+func (r *scriptedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answer := r.answers[len(r.answers)-1]
+	if r.calls < len(r.answers) {
+		answer = r.answers[r.calls]
+	}
+	r.calls++
+	if answer == nil {
+		return nil, errors.New("no such host")
+	}
+	rv := []net.IPAddr{}
+	for _, addr := range answer {
+		rv = append(rv, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return rv, nil
+}
+
+func TestDNSRefresher_Run(t *testing.T) {
+	first, second := []string{"10.0.0.1"}, []string{"10.0.0.2", "10.0.0.3"}
+	resolver := &scriptedResolver{answers: [][]string{first, first, second, second, nil, nil}}
+	tr := New()
+	r := NewDNSRefresher(tr, resolver, "proxies.mesh.example.com", time.Minute)
+	ticks := make(chan time.Time)
+	stopped := false
+	r.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		if d != time.Minute {
+			t.Errorf("DNSRefresher.Run() ticks every %v, want %v", d, time.Minute)
+		}
+		return ticks, func() { stopped = true }
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	errs := 0
+	go func() {
+		defer close(done)
+		r.Run(ctx, func(error) { errs++ })
+	}()
+
+	// Run only receives a tick once it is done refreshing, so after the
+	// n-th tick, the n-th refresh (counting the initial one as the first)
+	// is done and the next one is running. Entries are only checked while
+	// that one gets the same answer.
+	tick := func() { ticks <- time.Time{} }
+	tick()
+	if got := stringsOf(tr.TrustedCIDRs()); !reflect.DeepEqual(got, []string{"10.0.0.1/32"}) {
+		t.Errorf("DNSRefresher.Run() entries = %v, want %v", got, []string{"10.0.0.1/32"})
+	}
+	tick()
+	tick()
+	if got := stringsOf(tr.TrustedCIDRs()); !reflect.DeepEqual(got, []string{"10.0.0.2/32", "10.0.0.3/32"}) {
+		t.Errorf("DNSRefresher.Run() entries = %v, want %v", got, []string{"10.0.0.2/32", "10.0.0.3/32"})
+	}
+	tick()
+	tick()
+	cancel()
+	<-done
+
+	if resolver.calls != 6 {
+		t.Errorf("DNSRefresher.Run() refreshed %d times, want %d", resolver.calls, 6)
+	}
+	if got := stringsOf(tr.TrustedCIDRs()); !reflect.DeepEqual(got, []string{"10.0.0.2/32", "10.0.0.3/32"}) {
+		t.Errorf("DNSRefresher.Run() entries = %v after failed refreshes, want %v", got, []string{"10.0.0.2/32", "10.0.0.3/32"})
+	}
+	if errs != 2 {
+		t.Errorf("DNSRefresher.Run() reported %d errors, want %d", errs, 2)
+	}
+	if !stopped {
+		t.Errorf("DNSRefresher.Run() didn't stop the ticker")
+	}
+}
@@ -0,0 +1,99 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ToIPTablesRules returns rules, in iptables-restore syntax, that accept
+// traffic from the trusted IPv4 ranges in chain, e.g.
+// "-A proxies -s 10.0.0.0/8 -j ACCEPT". Entries on the deny list come
+// first and RETURN from chain, and entries restricted to certain ports
+// (see AddForPorts) only accept TCP traffic to those ports. IPv6 ranges
+// are left out, see ToIP6TablesRules.
+func (t *TrustedProxies) ToIPTablesRules(chain string) []string {
+	return t.iptablesRules(chain, false)
+}
+
+// ToIP6TablesRules works like ToIPTablesRules, but returns the rules for
+// the trusted IPv6 ranges, in ip6tables-restore syntax
+func (t *TrustedProxies) ToIP6TablesRules(chain string) []string {
+	return t.iptablesRules(chain, true)
+}
+
+func (t *TrustedProxies) iptablesRules(chain string, ipv6 bool) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	rv := []string{}
+	for _, ipnet := range t.deniedNets() {
+		if isIPv6Net(ipnet) == ipv6 {
+			rv = append(rv, fmt.Sprintf("-A %s -s %s -j RETURN", chain, ipnet))
+		}
+	}
+	sort.Strings(rv)
+
+	for _, entry := range t.trustedCIDRs {
+		ipnet := canonicalNet(entry)
+		if isIPv6Net(ipnet) != ipv6 {
+			continue
+		}
+		rule := fmt.Sprintf("-A %s -s %s", chain, ipnet)
+		if ports := t.portsOf(entry); len(ports) > 0 {
+			rule += fmt.Sprintf(" -p tcp -m multiport --dports %s", joinPorts(ports, ","))
+		}
+		rv = append(rv, rule+" -j ACCEPT")
+	}
+	return rv
+}
+
+// ToNFTablesRules returns nft commands that accept traffic from the
+// trusted ranges, both IPv4 and IPv6, in chain of the inet table table,
+// e.g. "add rule inet filter proxies ip saddr 10.0.0.0/8 accept". As with
+// ToIPTablesRules, entries on the deny list come first and return from
+// chain, and port restricted entries only accept TCP traffic to their
+// ports.
+func (t *TrustedProxies) ToNFTablesRules(table, chain string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	prefix := fmt.Sprintf("add rule inet %s %s", table, chain)
+	rv := []string{}
+	for _, ipnet := range t.deniedNets() {
+		rv = append(rv, fmt.Sprintf("%s %s saddr %s return", prefix, nftFamily(ipnet), ipnet))
+	}
+	sort.Strings(rv)
+
+	for _, entry := range t.trustedCIDRs {
+		ipnet := canonicalNet(entry)
+		rule := fmt.Sprintf("%s %s saddr %s", prefix, nftFamily(ipnet), ipnet)
+		if ports := t.portsOf(entry); len(ports) > 0 {
+			rule += fmt.Sprintf(" tcp dport { %s }", joinPorts(ports, ", "))
+		}
+		rv = append(rv, rule+" accept")
+	}
+	return rv
+}
+
+// isIPv6Net reports whether ipnet, in canonical form, is an IPv6 network
+func isIPv6Net(ipnet *net.IPNet) bool {
+	return len(ipnet.Mask) == net.IPv6len
+}
+
+// nftFamily returns the nftables address family keyword for ipnet
+func nftFamily(ipnet *net.IPNet) string {
+	if isIPv6Net(ipnet) {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func joinPorts(ports []int, sep string) string {
+	s := make([]string, len(ports))
+	for idx, port := range ports {
+		s[idx] = fmt.Sprint(port)
+	}
+	return strings.Join(s, sep)
+}
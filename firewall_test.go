@@ -0,0 +1,57 @@
+package trustedproxies
+
+import (
+	"reflect"
+	"testing"
+)
+
+func firewallTestList(t *testing.T) *TrustedProxies {
+	tr := New()
+	for _, spec := range []string{"10.0.0.0/8 !10.6.6.6", "2001:db8::/32", "::ffff:192.0.2.0/120"} {
+		if err := tr.AddFromString(spec); err != nil {
+			t.Fatalf("TrustedProxies.AddFromString() error = %v", err)
+		}
+	}
+	if err := tr.AddForPorts("172.16.0.1", 8443, 443); err != nil {
+		t.Fatalf("TrustedProxies.AddForPorts() error = %v", err)
+	}
+	return tr
+}
+
+func TestTrustedProxies_ToIPTablesRules(t *testing.T) {
+	tr := firewallTestList(t)
+
+	want := []string{
+		"-A proxies -s 10.6.6.6/32 -j RETURN",
+		"-A proxies -s 10.0.0.0/8 -j ACCEPT",
+		"-A proxies -s 192.0.2.0/24 -j ACCEPT",
+		"-A proxies -s 172.16.0.1/32 -p tcp -m multiport --dports 443,8443 -j ACCEPT",
+	}
+	if got := tr.ToIPTablesRules("proxies"); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.ToIPTablesRules() = %q, want %q", got, want)
+	}
+
+	want = []string{"-A proxies -s 2001:db8::/32 -j ACCEPT"}
+	if got := tr.ToIP6TablesRules("proxies"); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.ToIP6TablesRules() = %q, want %q", got, want)
+	}
+
+	if got := New().ToIPTablesRules("proxies"); len(got) != 0 {
+		t.Errorf("TrustedProxies.ToIPTablesRules() = %q, want none", got)
+	}
+}
+
+func TestTrustedProxies_ToNFTablesRules(t *testing.T) {
+	tr := firewallTestList(t)
+
+	want := []string{
+		"add rule inet filter proxies ip saddr 10.6.6.6/32 return",
+		"add rule inet filter proxies ip saddr 10.0.0.0/8 accept",
+		"add rule inet filter proxies ip6 saddr 2001:db8::/32 accept",
+		"add rule inet filter proxies ip saddr 192.0.2.0/24 accept",
+		"add rule inet filter proxies ip saddr 172.16.0.1/32 tcp dport { 443, 8443 } accept",
+	}
+	if got := tr.ToNFTablesRules("filter", "proxies"); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.ToNFTablesRules() = %q, want %q", got, want)
+	}
+}
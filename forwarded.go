@@ -0,0 +1,317 @@
+package trustedproxies
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrMalformedForwarded indicates a Forwarded header doesn't conform to
+// RFC 7239, see ValidateForwarded
+var ErrMalformedForwarded = errors.New("malformed Forwarded header")
+
+// ValidateForwarded checks that header, the combined value of the
+// Forwarded headers of a request, conforms to the grammar of RFC 7239:
+// a comma separated list of elements, each a semicolon separated list of
+// parameter=value pairs with token or quoted-string values. The values
+// of the for and by parameters must be node identifiers (an IPv4
+// address, a bracketed IPv6 address, "unknown" or an obfuscated
+// identifier such as "_hidden", optionally with a port), those of proto
+// URI schemes and those of host hosts as in a Host header. Parameters
+// may not occur twice in an element. Extension parameters are accepted
+// with any value.
+//
+// The returned error, which wraps ErrMalformedForwarded, describes the
+// first problem found. As a malformed header may have been tampered
+// with, requests failing this check can be rejected before deducing the
+// client IP.
+func ValidateForwarded(header string) error {
+	if strings.TrimSpace(header) == "" {
+		return fmt.Errorf("%w: empty header", ErrMalformedForwarded)
+	}
+	s := &forwardedScanner{s: header}
+	for elemNo := 1; ; elemNo++ {
+		s.skipOWS()
+		if err := s.element(); err != nil {
+			return fmt.Errorf("%w: element %d: %v", ErrMalformedForwarded, elemNo, err)
+		}
+		s.skipOWS()
+		if s.done() {
+			return nil
+		}
+		if s.peek() != ',' {
+			return fmt.Errorf("%w: element %d: unexpected %q at offset %d", ErrMalformedForwarded, elemNo, s.peek(), s.pos)
+		}
+		s.pos++
+	}
+}
+
+// forwardedScanner scans a Forwarded header, see ValidateForwarded
+type forwardedScanner struct {
+	s   string
+	pos int
+}
+
+func (s *forwardedScanner) done() bool {
+	return s.pos >= len(s.s)
+}
+
+// peek returns the current byte, or 0 at the end
+func (s *forwardedScanner) peek() byte {
+	if s.done() {
+		return 0
+	}
+	return s.s[s.pos]
+}
+
+func (s *forwardedScanner) skipOWS() {
+	for !s.done() && (s.peek() == ' ' || s.peek() == '\t') {
+		s.pos++
+	}
+}
+
+// element scans a forwarded-element. Empty pairs, as in "for=x;;by=y",
+// are allowed by the grammar, empty elements aren't.
+func (s *forwardedScanner) element() error {
+	seen := map[string]bool{}
+	for {
+		if c := s.peek(); c != ';' && c != ',' && c != ' ' && c != '\t' && c != 0 {
+			start := s.pos
+			name := s.token()
+			if name == "" {
+				return fmt.Errorf("unexpected %q at offset %d", s.peek(), s.pos)
+			}
+			if s.peek() != '=' {
+				return fmt.Errorf("parameter %q: expected \"=\" at offset %d", name, s.pos)
+			}
+			s.pos++
+			value, err := s.value()
+			if err != nil {
+				return fmt.Errorf("parameter %q: %v", name, err)
+			}
+			lower := strings.ToLower(name)
+			if seen[lower] {
+				return fmt.Errorf("duplicate parameter %q at offset %d", name, start)
+			}
+			seen[lower] = true
+			if err := validForwardedParam(lower, value); err != nil {
+				return fmt.Errorf("parameter %q: %v", name, err)
+			}
+		}
+		if s.peek() != ';' {
+			break
+		}
+		s.pos++
+	}
+	if len(seen) == 0 {
+		return errors.New("empty element")
+	}
+	return nil
+}
+
+// token scans a token, returning "" if there is none
+func (s *forwardedScanner) token() string {
+	start := s.pos
+	for !s.done() && isTokenChar(s.peek()) {
+		s.pos++
+	}
+	return s.s[start:s.pos]
+}
+
+// value scans a token or a quoted-string, returning it unquoted
+func (s *forwardedScanner) value() (string, error) {
+	if s.peek() != '"' {
+		if value := s.token(); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("missing value at offset %d", s.pos)
+	}
+	start := s.pos
+	s.pos++
+	var value strings.Builder
+	for !s.done() {
+		c := s.peek()
+		switch {
+		case c == '"':
+			s.pos++
+			return value.String(), nil
+		case c == '\\':
+			s.pos++
+			if s.done() || !isQuotedPairChar(s.peek()) {
+				return "", fmt.Errorf("invalid quoted-pair at offset %d", s.pos-1)
+			}
+			value.WriteByte(s.peek())
+		case isQdtextChar(c):
+			value.WriteByte(c)
+		default:
+			return "", fmt.Errorf("invalid character %q in quoted-string at offset %d", c, s.pos)
+		}
+		s.pos++
+	}
+	return "", fmt.Errorf("unterminated quoted-string at offset %d", start)
+}
+
+// validForwardedParam checks the value of the parameter named name,
+// which is lower case
+func validForwardedParam(name, value string) error {
+	switch name {
+	case "for", "by":
+		return validForwardedNode(value)
+	case "proto":
+		if !isURIScheme(value) {
+			return fmt.Errorf("invalid URI scheme %q", value)
+		}
+	case "host":
+		return validForwardedHost(value)
+	}
+	return nil
+}
+
+// validForwardedNode checks a node as defined by RFC 7239, section 6
+func validForwardedNode(node string) error {
+	name, port, hasPort := node, "", false
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return fmt.Errorf("unterminated IPv6 address in node %q", node)
+		}
+		addr := node[1:end]
+		if !strings.Contains(addr, ":") || net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid IPv6 address in node %q", node)
+		}
+		name = ""
+		if rest := node[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return fmt.Errorf("unexpected %q after IPv6 address in node %q", rest, node)
+			}
+			port, hasPort = rest[1:], true
+		}
+	} else {
+		if idx := strings.IndexByte(node, ':'); idx >= 0 {
+			name, port, hasPort = node[:idx], node[idx+1:], true
+		}
+		switch {
+		case strings.EqualFold(name, "unknown"), isObfuscated(name):
+		case !strings.Contains(name, ":") && net.ParseIP(name).To4() != nil:
+		default:
+			return fmt.Errorf("invalid node name in node %q", node)
+		}
+	}
+	if hasPort {
+		if !isObfuscated(port) && (len(port) < 1 || len(port) > 5 || !isDigits(port)) {
+			return fmt.Errorf("invalid port in node %q", node)
+		}
+	}
+	return nil
+}
+
+// validForwardedHost checks a host as in a Host header, i.e. a host as
+// defined by RFC 3986, optionally with a port
+func validForwardedHost(host string) error {
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 || net.ParseIP(host[1:end]) == nil {
+			return fmt.Errorf("invalid IP literal in host %q", host)
+		}
+		name = ""
+		if rest := host[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return fmt.Errorf("unexpected %q after IP literal in host %q", rest, host)
+			}
+			port = rest[1:]
+		}
+	} else {
+		if idx := strings.LastIndexByte(host, ':'); idx >= 0 {
+			name, port = host[:idx], host[idx+1:]
+		}
+		if name == "" {
+			return fmt.Errorf("empty name in host %q", host)
+		}
+		for idx := 0; idx < len(name); idx++ {
+			c := name[idx]
+			if c == '%' {
+				if idx+2 >= len(name) || !isHexDigit(name[idx+1]) || !isHexDigit(name[idx+2]) {
+					return fmt.Errorf("invalid percent-encoding in host %q", host)
+				}
+				idx += 2
+				continue
+			}
+			if !isAlphaNum(c) && !strings.ContainsRune("-._~!$&'()*+,;=", rune(c)) {
+				return fmt.Errorf("invalid character %q in host %q", c, host)
+			}
+		}
+	}
+	if !isDigits(port) {
+		return fmt.Errorf("invalid port in host %q", host)
+	}
+	return nil
+}
+
+// isTokenChar reports whether c is a tchar as defined by RFC 7230
+func isTokenChar(c byte) bool {
+	return isAlphaNum(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isQdtextChar reports whether c may appear unescaped in a
+// quoted-string
+func isQdtextChar(c byte) bool {
+	return c == '\t' || c == ' ' || c == 0x21 || (c >= 0x23 && c <= 0x5b) || (c >= 0x5d && c <= 0x7e) || c >= 0x80
+}
+
+// isQuotedPairChar reports whether c may follow a backslash in a
+// quoted-string
+func isQuotedPairChar(c byte) bool {
+	return c == '\t' || (c >= 0x20 && c <= 0x7e) || c >= 0x80
+}
+
+// isObfuscated reports whether s is an obfuscated node name or port,
+// e.g. "_hidden"
+func isObfuscated(s string) bool {
+	if len(s) < 2 || s[0] != '_' {
+		return false
+	}
+	for idx := 1; idx < len(s); idx++ {
+		if c := s[idx]; !isAlphaNum(c) && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isURIScheme reports whether s is a URI scheme as defined by RFC 3986
+func isURIScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for idx := 1; idx < len(s); idx++ {
+		if c := s[idx]; !isAlphaNum(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDigits reports whether s consists of decimal digits only. This
+// includes the empty string.
+func isDigits(s string) bool {
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] < '0' || s[idx] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlphaNum(c byte) bool {
+	return isAlpha(c) || (c >= '0' && c <= '9')
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
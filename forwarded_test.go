@@ -0,0 +1,56 @@
+package trustedproxies
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateForwarded(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{"Single node", "for=192.0.2.60", ""},
+		{"RFC 7239 example", `for=192.0.2.60;proto=http;by=203.0.113.43`, ""},
+		{"Multiple elements", `for=192.0.2.43, for=198.51.100.17`, ""},
+		{"Quoted IPv6 with port", `for="[2001:db8:cafe::17]:4711"`, ""},
+		{"Unknown and obfuscated", `for=unknown, for=_hidden, for="_SEVKISEK:_port"`, ""},
+		{"Quoted IPv4 with port", `for="192.0.2.43:47011"`, ""},
+		{"Case-insensitive names", `For=192.0.2.60;PROTO=https`, ""},
+		{"Host", `host=example.com;for=192.0.2.60, host="example.com:8080"`, ""},
+		{"Extension parameter", `for=192.0.2.60;secret="a \"quoted\" value"`, ""},
+		{"Empty pair", `for=192.0.2.60;;by=203.0.113.43;`, ""},
+		{"Empty header", " ", "empty header"},
+		{"Empty element", "for=192.0.2.60, ,for=198.51.100.17", "element 2: empty element"},
+		{"Missing value", "for=", `parameter "for": missing value`},
+		{"Missing equals sign", "for", `expected "="`},
+		{"Unquoted IPv6", "for=[2001:db8::1]", `parameter "for": missing value`},
+		{"Unquoted port", "for=192.0.2.43:80", `element 1: unexpected ':'`},
+		{"Unterminated quoted-string", `for="192.0.2.43`, "unterminated quoted-string"},
+		{"Whitespace around semicolon", "for=192.0.2.43; proto=http", "unexpected 'p'"},
+		{"Duplicate parameter", "for=192.0.2.43;For=198.51.100.17", `duplicate parameter "For"`},
+		{"Invalid node", "for=example.com", "invalid node name"},
+		{"IPv6 without brackets", `for="2001:db8::1"`, "invalid node name"},
+		{"IPv4 in brackets", `for="[192.0.2.43]"`, "invalid IPv6 address"},
+		{"Invalid port", `for="192.0.2.43:123456"`, "invalid port"},
+		{"Invalid proto", "proto=1http", "invalid URI scheme"},
+		{"Invalid host", `host="exa mple.com"`, "invalid character"},
+		{"Control character", "for=\"192.0.2.43\x01\"", "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateForwarded(tt.header)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateForwarded() error = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMalformedForwarded) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateForwarded() error = %v, want %v containing %q", err, ErrMalformedForwarded, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// gobVersion is the version of the format written by GobEncode
+const gobVersion = 1
+
+// gobState is the state written by GobEncode
+type gobState struct {
+	Version int
+	Entries []gobEntry
+	Denied  []string
+
+	MaxHops                 int
+	SkipBogonsInHeader      bool
+	DetectFamilyMismatch    bool
+	KeepCanonical           bool
+	QuoteAwareHeader        bool
+	LeftmostWhenTrusted     bool
+	TrustedCertFingerprints []string
+}
+
+type gobEntry struct {
+	CIDR    string
+	Label   string
+	Spec    string
+	Source  string
+	Ports   []int
+	Added   time.Time
+	Expires time.Time
+}
+
+// GobEncode implements gob.GobEncoder. It encodes the trusted entries,
+// including their labels, sources, port restrictions and TTLs, the deny list and
+// the options that can be serialized: MaxHops, SkipBogonsInHeader,
+// DetectFamilyMismatch, KeepCanonical, QuoteAwareHeader,
+// LeftmostWhenTrusted and TrustedCertFingerprints. Options holding functions or other objects,
+// such as Policy or Clock, are not encoded.
+func (t *TrustedProxies) GobEncode() ([]byte, error) {
+	t.mu.RLock()
+	state := gobState{
+		Version:              gobVersion,
+		Entries:              make([]gobEntry, 0, len(t.trustedCIDRs)),
+		MaxHops:              t.maxHops,
+		SkipBogonsInHeader:   t.skipBogonsInHeader,
+		DetectFamilyMismatch: t.detectFamilyMismatch,
+		KeepCanonical:        t.keepCanonical,
+		QuoteAwareHeader:     t.quoteAwareHeader,
+		LeftmostWhenTrusted:  t.leftmostWhenTrusted,
+	}
+	for _, ipnet := range t.trustedCIDRs {
+		entry := gobEntry{CIDR: ipnet.String(), Ports: t.portsOf(ipnet)}
+		if m, ok := t.meta[ipnet]; ok {
+			entry.Label = m.label
+			entry.Spec = m.spec
+			entry.Source = m.source
+			entry.Added = m.added
+			entry.Expires = m.expires
+		}
+		state.Entries = append(state.Entries, entry)
+	}
+	for _, ipnet := range t.deniedNets() {
+		state.Denied = append(state.Denied, ipnet.String())
+	}
+	for fp := range t.trustedCertFingerprints {
+		state.TrustedCertFingerprints = append(state.TrustedCertFingerprints, fp)
+	}
+	t.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder. It replaces the configuration and
+// the serializable options (see GobEncode) with the decoded ones. Other
+// options are left as they are, so they can be set up with New before
+// decoding. On error, the configuration is left untouched.
+func (t *TrustedProxies) GobDecode(data []byte) error {
+	var state gobState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != gobVersion {
+		return fmt.Errorf("unsupported version %d", state.Version)
+	}
+
+	n := New()
+	for _, entry := range state.Entries {
+		ipnet, err := netFromIPOrCIDR(entry.CIDR)
+		if err != nil {
+			return err
+		}
+		ports, err := portSet(entry.Ports)
+		if err != nil {
+			return err
+		}
+		n.trustedCIDRs = append(n.trustedCIDRs, ipnet)
+		m := n.metaFor(ipnet)
+		m.label = entry.Label
+		m.spec = entry.Spec
+		m.source = entry.Source
+		m.ports = ports
+		m.added = entry.Added
+		m.expires = entry.Expires
+		if !entry.Expires.IsZero() {
+			n.hasTTL = true
+		}
+	}
+	for _, s := range state.Denied {
+		ipnet, err := netFromIPOrCIDR(s)
+		if err != nil {
+			return err
+		}
+		n.deny(ipnet)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replaceWith(n)
+	t.hasTTL = t.hasTTL || n.hasTTL
+	t.maxHops = state.MaxHops
+	t.skipBogonsInHeader = state.SkipBogonsInHeader
+	t.detectFamilyMismatch = state.DetectFamilyMismatch
+	t.keepCanonical = state.KeepCanonical
+	t.quoteAwareHeader = state.QuoteAwareHeader
+	t.leftmostWhenTrusted = state.LeftmostWhenTrusted
+	t.trustedCertFingerprints = nil
+	if len(state.TrustedCertFingerprints) > 0 {
+		TrustedCertFingerprints(state.TrustedCertFingerprints...)(t)
+	}
+	t.canonicalize()
+	return nil
+}
@@ -0,0 +1,98 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies_Gob(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := Clock(func() time.Time { return now })
+
+	tr := New(MaxHops(2), SkipBogonsInHeader(), TrustedCertFingerprints("ab:cd"), clock)
+	tr.AddLabeled("10.0.0.0/8 !10.6.6.6", "internal")
+	tr.AddForPorts("172.16.0.1", 443)
+	tr.AddWithTTL("203.0.113.0/24", time.Hour)
+	tr.DenyFromString("10.7.0.0/16")
+	tr.AddCGNAT()
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(tr); err != nil {
+		t.Fatalf("gob.Encoder.Encode() error = %v", err)
+	}
+	restored := New(clock)
+	if err := gob.NewDecoder(buf).Decode(restored); err != nil {
+		t.Fatalf("gob.Decoder.Decode() error = %v", err)
+	}
+
+	if got, want := restored.Fingerprint(), tr.Fingerprint(); got != want {
+		t.Errorf("Restored Fingerprint() = %v, want %v", got, want)
+	}
+	if got, want := trustedStrings(restored), trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored entries = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		header     string
+	}{
+		{"10.0.0.1", "8.8.8.8"},
+		{"10.0.0.1", "8.8.8.8, 10.0.0.3, 10.0.0.2"},
+		{"10.0.0.1", "8.8.8.8, 192.168.1.1"},
+		{"10.6.6.6", "8.8.8.8"},
+		{"10.7.0.1", "8.8.8.8"},
+		{"203.0.113.1", "8.8.8.8"},
+		{"172.16.0.1", "8.8.8.8"},
+	}
+	for _, tt := range tests {
+		got := restored.DeduceClientIP(net.ParseIP(tt.remoteAddr), tt.header)
+		want := tr.DeduceClientIP(net.ParseIP(tt.remoteAddr), tt.header)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Restored DeduceClientIP(%v, %q) = %v, want %v", tt.remoteAddr, tt.header, got, want)
+		}
+	}
+	if got := restored.DeduceClientIPForPort(net.ParseIP("172.16.0.1"), "8.8.8.8", 443); got.String() != "8.8.8.8" {
+		t.Errorf("Restored DeduceClientIPForPort() = %v, want %v", got, "8.8.8.8")
+	}
+	if label, _ := restored.Label(net.ParseIP("10.1.1.1")); label != "internal" {
+		t.Errorf("Restored Label() = %q, want %q", label, "internal")
+	}
+	if got := stringsOf(restored.EntriesBySource("preset")); !reflect.DeepEqual(got, []string{"100.64.0.0/10"}) {
+		t.Errorf("Restored EntriesBySource() = %v, want %v", got, []string{"100.64.0.0/10"})
+	}
+	if restored.maxHops != 2 || !restored.skipBogonsInHeader {
+		t.Errorf("Restored options = %v, %v, want %v, %v", restored.maxHops, restored.skipBogonsInHeader, 2, true)
+	}
+	if _, ok := restored.trustedCertFingerprints["abcd"]; !ok {
+		t.Errorf("Restored fingerprints = %v", restored.trustedCertFingerprints)
+	}
+
+	// The TTL is restored, too
+	now = now.Add(2 * time.Hour)
+	if got := restored.DeduceClientIP(net.ParseIP("203.0.113.1"), "8.8.8.8"); got.String() != "203.0.113.1" {
+		t.Errorf("Restored DeduceClientIP() = %v, want %v", got, "203.0.113.1")
+	}
+}
+
+func TestTrustedProxies_GobDecodeErrors(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+
+	if err := tr.GobDecode([]byte("horse")); err == nil {
+		t.Errorf("TrustedProxies.GobDecode() error = %v, want an error", err)
+	}
+
+	buf := &bytes.Buffer{}
+	gob.NewEncoder(buf).Encode(gobState{Version: gobVersion + 1})
+	if err := tr.GobDecode(buf.Bytes()); err == nil {
+		t.Errorf("TrustedProxies.GobDecode() error = %v, want an error", err)
+	}
+
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("TrustedProxies.GobDecode() changed the entries to %v", got)
+	}
+}
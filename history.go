@@ -0,0 +1,60 @@
+package trustedproxies
+
+import (
+	"sync"
+)
+
+// history is a ring buffer of recent deduction results
+type history struct {
+	mu      sync.Mutex
+	results []DeduceResult
+	// next is the index the next result is written to
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{results: make([]DeduceResult, size)}
+}
+
+func (h *history) add(result DeduceResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results[h.next] = result.clone()
+	h.next++
+	if h.next == len(h.results) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// last returns up to n of the most recent results, oldest first
+func (h *history) last(n int) []DeduceResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.results)
+	}
+	if n > count {
+		n = count
+	}
+
+	rv := make([]DeduceResult, n)
+	for idx := range rv {
+		pos := (h.next - n + idx + len(h.results)) % len(h.results)
+		rv[idx] = h.results[pos].clone()
+	}
+	return rv
+}
+
+// RecentDecisions returns up to n of the most recent deduction results,
+// oldest first. It returns nothing unless the RecordHistory option is
+// used.
+func (t *TrustedProxies) RecentDecisions(n int) []DeduceResult {
+	if t.history == nil || n <= 0 {
+		return []DeduceResult{}
+	}
+	return t.history.last(n)
+}
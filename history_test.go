@@ -0,0 +1,58 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTrustedProxies_RecentDecisions(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		deduced   int
+		requested int
+		want      []string
+	}{
+		{"Empty", 3, 0, 3, []string{}},
+		{"Partially filled", 3, 2, 3, []string{"20.0.0.1", "20.0.0.2"}},
+		{"Exactly full", 3, 3, 3, []string{"20.0.0.1", "20.0.0.2", "20.0.0.3"}},
+		{"Wrapped", 3, 5, 3, []string{"20.0.0.3", "20.0.0.4", "20.0.0.5"}},
+		{"Wrapped twice", 3, 7, 3, []string{"20.0.0.5", "20.0.0.6", "20.0.0.7"}},
+		{"Fewer than recorded", 3, 5, 2, []string{"20.0.0.4", "20.0.0.5"}},
+		{"More than capacity", 3, 5, 10, []string{"20.0.0.3", "20.0.0.4", "20.0.0.5"}},
+		{"None requested", 3, 5, 0, []string{}},
+		{"Not recording", 0, 5, 3, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(RecordHistory(tt.size))
+			tr.AddFromString("10.0.0.1")
+			for i := 1; i <= tt.deduced; i++ {
+				tr.DeduceClientIP(net.ParseIP("10.0.0.1"), fmt.Sprintf("20.0.0.%d", i))
+			}
+			got := []string{}
+			for _, result := range tr.RecentDecisions(tt.requested) {
+				got = append(got, result.ClientIP.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.RecentDecisions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_RecentDecisionsDetails(t *testing.T) {
+	tr := New(RecordHistory(2))
+	tr.AddFromString("10.0.0.1")
+	tr.DeduceClientIPDetailed(net.ParseIP("10.0.0.1"), "20.0.0.1")
+
+	got := tr.RecentDecisions(1)
+	if len(got) != 1 {
+		t.Fatalf("TrustedProxies.RecentDecisions() returned %d results, want 1", len(got))
+	}
+	if got[0].Header != "20.0.0.1" || !got[0].RemoteAddr.Equal(net.ParseIP("10.0.0.1")) || got[0].TrustedHops != 1 || got[0].Time.IsZero() {
+		t.Errorf("TrustedProxies.RecentDecisions() = %+v", got[0])
+	}
+}
@@ -0,0 +1,174 @@
+package trustedproxies
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// matchIndex finds the entries containing an IP without trying each one.
+// Entries are grouped by family and prefix length, and within each group
+// by network address, so a lookup takes one map access per prefix length
+// in use.
+type matchIndex struct {
+	// n is the number of entries the index was built from
+	n int
+	// byKey maps indexKey of an entry's network to the indices of all
+	// entries with that network, in list order
+	byKey map[string][]int
+	// lengths holds the prefix lengths in use, for IPv4 and IPv6
+	lengths [2][]int
+	// other holds the indices of entries with non-canonical masks, which
+	// are looked at one by one
+	other []int
+}
+
+// maxIndexKey is the size of the longest indexKey
+const maxIndexKey = 2 + net.IPv6len
+
+// indexKey writes the key for addr, which must be 4 or 16 bytes, masked
+// to ones bits, to buf and returns its length
+func indexKey(buf *[maxIndexKey]byte, addr net.IP, ones int) int {
+	buf[0], buf[1] = byte(len(addr)), byte(ones)
+	for idx := range addr {
+		bits := ones - 8*idx
+		switch {
+		case bits >= 8:
+			buf[2+idx] = addr[idx]
+		case bits <= 0:
+			buf[2+idx] = 0
+		default:
+			buf[2+idx] = addr[idx] & (0xff << uint(8-bits))
+		}
+	}
+	return 2 + len(addr)
+}
+
+// familyOf returns 0 for 4 byte addresses and 1 for 16 byte ones
+func familyOf(addr net.IP) int {
+	if len(addr) == net.IPv4len {
+		return 0
+	}
+	return 1
+}
+
+// netAddr returns the address and prefix length of ipnet as seen by
+// net.IPNet.Contains: IPv4-mapped networks are IPv4 networks. ok is
+// false if the mask isn't canonical.
+func netAddr(ipnet *net.IPNet) (addr net.IP, ones int, ok bool) {
+	addr = ipnet.IP.To4()
+	if addr == nil {
+		addr = ipnet.IP
+	}
+	mask := ipnet.Mask
+	if len(mask) == net.IPv6len && len(addr) == net.IPv4len {
+		mask = mask[12:]
+	}
+	ones, bits := mask.Size()
+	if bits == 0 || bits != 8*len(addr) {
+		return nil, 0, false
+	}
+	return addr, ones, true
+}
+
+// buildIndex builds the index of the trusted entries
+func (t *TrustedProxies) buildIndex() *matchIndex {
+	idx := &matchIndex{n: len(t.trustedCIDRs), byKey: map[string][]int{}}
+	seen := map[[2]int]bool{}
+	var buf [maxIndexKey]byte
+	for pos, ipnet := range t.trustedCIDRs {
+		addr, ones, ok := netAddr(ipnet)
+		if !ok {
+			idx.other = append(idx.other, pos)
+			continue
+		}
+		key := string(buf[:indexKey(&buf, addr, ones)])
+		idx.byKey[key] = append(idx.byKey[key], pos)
+		family := familyOf(addr)
+		if !seen[[2]int{family, ones}] {
+			seen[[2]int{family, ones}] = true
+			idx.lengths[family] = append(idx.lengths[family], ones)
+		}
+	}
+	return idx
+}
+
+// compiledIndex returns the index, building it if the trusted entries
+// changed since it was last built. Concurrent callers holding the read
+// lock wait for a single build.
+func (t *TrustedProxies) compiledIndex() *matchIndex {
+	if idx, _ := t.index.Load().(*matchIndex); idx != nil && idx.n == len(t.trustedCIDRs) {
+		return idx
+	}
+	t.indexMu.Lock()
+	defer t.indexMu.Unlock()
+	if idx, _ := t.index.Load().(*matchIndex); idx != nil && idx.n == len(t.trustedCIDRs) {
+		return idx
+	}
+	idx := t.buildIndex()
+	t.index.Store(idx)
+	atomic.AddInt32(&t.compilations, 1)
+	return idx
+}
+
+// invalidateIndex makes the next lookup rebuild the index
+func (t *TrustedProxies) invalidateIndex() {
+	t.index.Store((*matchIndex)(nil))
+}
+
+// Compile builds the structure used to look up IPs, which otherwise
+// happens on the first lookup after a change, e.g. to keep that cost out
+// of serving requests after a bulk load.
+func (t *TrustedProxies) Compile() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.compiledIndex()
+}
+
+// firstMatch returns the first trusted entry, in list order, containing
+// ip and valid for port at the given time, skipping exclude
+func (t *TrustedProxies) firstMatch(ip net.IP, exclude *net.IPNet, port int, at time.Time) *net.IPNet {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+	if addr == nil {
+		return nil
+	}
+
+	idx := t.compiledIndex()
+	valid := func(pos int) bool {
+		ipnet := t.trustedCIDRs[pos]
+		if exclude != nil && sameNet(ipnet, exclude) {
+			return false
+		}
+		return t.validForPort(ipnet, port) && t.validAt(ipnet, at)
+	}
+
+	best := -1
+	var buf [maxIndexKey]byte
+	for _, ones := range idx.lengths[familyOf(addr)] {
+		for _, pos := range idx.byKey[string(buf[:indexKey(&buf, addr, ones)])] {
+			if best >= 0 && pos >= best {
+				break
+			}
+			if valid(pos) {
+				best = pos
+				break
+			}
+		}
+	}
+	for _, pos := range idx.other {
+		if best >= 0 && pos >= best {
+			break
+		}
+		if t.trustedCIDRs[pos].Contains(ip) && valid(pos) {
+			best = pos
+			break
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return t.trustedCIDRs[best]
+}
@@ -0,0 +1,98 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTrustedProxies_CompileIsLazy(t *testing.T) {
+	tr := New()
+	for idx := 0; idx < 1000; idx++ {
+		tr.AddFromString(fmt.Sprintf("10.%d.%d.0/24", idx/256, idx%256))
+	}
+	if got := atomic.LoadInt32(&tr.compilations); got != 0 {
+		t.Errorf("TrustedProxies compiled %v times while adding, want 0", got)
+	}
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 50; idx++ {
+		idx := idx
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := net.ParseIP(fmt.Sprintf("10.%d.%d.1", idx/256, idx%256))
+			if got := tr.IsIPTrusted(&ip); got == nil {
+				t.Errorf("TrustedProxies.IsIPTrusted(%v) = nil, want a match", ip)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&tr.compilations); got != 1 {
+		t.Errorf("TrustedProxies compiled %v times, want 1", got)
+	}
+
+	// A change invalidates it, Compile builds it right away
+	tr.AddFromString("192.0.2.0/24")
+	tr.Compile()
+	if got := atomic.LoadInt32(&tr.compilations); got != 2 {
+		t.Errorf("TrustedProxies compiled %v times, want 2", got)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if got := tr.IsIPTrusted(&ip); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted(%v) = nil, want a match", ip)
+	}
+	if got := atomic.LoadInt32(&tr.compilations); got != 2 {
+		t.Errorf("TrustedProxies compiled %v times, want 2", got)
+	}
+}
+
+func TestTrustedProxies_IndexMatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tr := New()
+	nets := []*net.IPNet{}
+	for idx := 0; idx < 300; idx++ {
+		var ip net.IP
+		var ones int
+		if rnd.Intn(2) == 0 {
+			ip = net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))).To4()
+			ones = 8 + rnd.Intn(25)
+		} else {
+			ip = net.ParseIP(fmt.Sprintf("2001:db8:%x::%x", rnd.Intn(4), rnd.Intn(65536)))
+			ones = 32 + rnd.Intn(97)
+		}
+		spec := fmt.Sprintf("%v/%d", ip, ones)
+		if rnd.Intn(10) == 0 {
+			// An IPv4-mapped network
+			spec = fmt.Sprintf("::ffff:%v/%d", ip.To4(), 96+ones)
+			if ip.To4() == nil {
+				continue
+			}
+		}
+		tr.AddFromString(spec)
+		_, ipnet, _ := net.ParseCIDR(spec)
+		nets = append(nets, ipnet)
+	}
+
+	for idx := 0; idx < 5000; idx++ {
+		var ip net.IP
+		if rnd.Intn(2) == 0 {
+			ip = net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+		} else {
+			ip = net.ParseIP(fmt.Sprintf("2001:db8:%x::%x", rnd.Intn(4), rnd.Intn(65536)))
+		}
+		want := -1
+		for pos, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				want = pos
+				break
+			}
+		}
+		if got := tr.MatchIndex(ip); got != want {
+			t.Fatalf("TrustedProxies.MatchIndex(%v) = %v, want %v", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package trustedproxies
+
+import (
+	"net"
+	"strings"
+)
+
+// ChainIter returns an iterator over the same IPs DeduceClientIP walks
+// through: remoteAddr first, followed by the header entries from right
+// to left, up to and including the first untrusted one, which is the
+// client. Each call returns the next IP, or false once the walk is over.
+//
+// The header is parsed on demand, from the right, so once the walk ends,
+// or the caller stops calling, the rest is never parsed. With the
+// QuoteAwareHeader, HeaderTokenizer or LeftmostWhenTrusted options, the
+// header is parsed as a whole up front, as is a folded header or one
+// without commas holding several entries (see DeduceClientIP). Changes
+// to t made while iterating apply to the remaining hops.
+func (t *TrustedProxies) ChainIter(remoteAddr net.IP, header string) func() (*net.IP, bool) {
+	spaceSeparated := !strings.Contains(header, ",") && len(strings.Fields(header)) > 1
+	folded := strings.ContainsAny(header, "\r\n\t")
+	t.mu.RLock()
+	if t.quoteAwareHeader || t.tokenizer != nil || t.leftmostWhenTrusted || spaceSeparated || folded {
+		ips := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
+		t.mu.RUnlock()
+		return func() (*net.IP, bool) {
+			if len(ips) == 0 {
+				return nil, false
+			}
+			ip := copyIP(normalizeIP(*ips[0]))
+			ips = ips[1:]
+			return &ip, true
+		}
+	}
+	maxHops, skipBogons := t.maxHops, t.skipBogonsInHeader
+	t.mu.RUnlock()
+
+	// end is where the unparsed part of header ends
+	end := len(header)
+	if strings.TrimSpace(header) == "" {
+		end = -1
+	}
+	rightmost := true
+	nextFromHeader := func() (net.IP, bool) {
+		for end >= 0 {
+			idx := strings.LastIndex(header[:end], ",")
+			ip := parseIP(strings.TrimSpace(header[idx+1 : end]))
+			end = idx
+			if skipBogons && ip != nil && IsBogon(ip) {
+				continue
+			}
+			if rightmost {
+				rightmost = false
+				// A peer that added itself to the header shouldn't be
+				// counted twice
+				if remoteAddr != nil && ip.Equal(remoteAddr) {
+					continue
+				}
+			}
+			return ip, true
+		}
+		return nil, false
+	}
+
+	hops, done := 0, false
+	return func() (*net.IP, bool) {
+		if done {
+			return nil, false
+		}
+		ip := copyIP(remoteAddr)
+		if hops > 0 {
+			ip, _ = nextFromHeader()
+		}
+		if ip == nil {
+			done = true
+			return nil, false
+		}
+		ip = normalizeIP(ip)
+
+		hops++
+		t.mu.RLock()
+		done = (maxHops > 0 && hops > maxHops) || !t.trustedHop(ip, hops-1, anyPort)
+		t.mu.RUnlock()
+		return &ip, true
+	}
+}
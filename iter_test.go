@@ -0,0 +1,90 @@
+package trustedproxies
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collect(next func() (*net.IP, bool)) []string {
+	rv := []string{}
+	for ip, ok := next(); ok; ip, ok = next() {
+		rv = append(rv, ip.String())
+	}
+	return rv
+}
+
+func TestTrustedProxies_ChainIter(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		header     string
+		want       []string
+	}{
+		{"no header", nil, "10.10.10.10", "", []string{"10.10.10.10"}},
+		{"untrusted peer", nil, "30.30.30.30", "20.20.20.20", []string{"30.30.30.30"}},
+		{"stops at first untrusted", nil, "10.10.10.10", "1.1.1.1, 30.30.30.30, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20", "30.30.30.30"}},
+		{"all trusted", nil, "10.10.10.10", "20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
+		{"unparseable", nil, "10.10.10.10", "30.30.30.30, horse, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
+		{"peer in header", nil, "10.10.10.10", "30.30.30.30, 10.10.10.10", []string{"10.10.10.10", "30.30.30.30"}},
+		{"max hops", []Option{MaxHops(1)}, "10.10.10.10", "30.30.30.30, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
+		{"bogons", []Option{SkipBogonsInHeader()}, "10.10.10.10", "30.30.30.30, 192.168.1.1, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20", "30.30.30.30"}},
+		{"quote-aware", []Option{QuoteAwareHeader()}, "10.10.10.10", `30.30.30.30, "20.20.20.20:443"`, []string{"10.10.10.10", "20.20.20.20", "30.30.30.30"}},
+		{"leftmost", []Option{LeftmostWhenTrusted()}, "10.10.10.10", "1.1.1.1, 30.30.30.30", []string{"10.10.10.10", "1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(tt.opts...)
+			tr.AddFromString("10.10.10.10")
+			tr.AddFromString("20.20.20.20")
+			remoteAddr := net.ParseIP(tt.remoteAddr)
+
+			got := collect(tr.ChainIter(remoteAddr, tt.header))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.ChainIter() = %v, want %v", got, tt.want)
+			}
+			if client := tr.DeduceClientIP(remoteAddr, tt.header); client.String() != got[len(got)-1] {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", client, got[len(got)-1])
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ChainIterIsLazy(t *testing.T) {
+	parsed := 0
+	parseIP = func(s string) net.IP {
+		parsed++
+		return net.ParseIP(s)
+	}
+	defer func() { parseIP = net.ParseIP }()
+
+	tr := New()
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
+	header := strings.Repeat("1.1.1.1, ", 1000) + "30.30.30.30, 20.20.20.20"
+
+	next := tr.ChainIter(net.ParseIP("10.10.10.10"), header)
+	if parsed != 0 {
+		t.Errorf("TrustedProxies.ChainIter() parsed %v entries before the first call, want 0", parsed)
+	}
+	if got := collect(next); len(got) != 3 {
+		t.Errorf("TrustedProxies.ChainIter() = %v, want 3 IPs", got)
+	}
+	if parsed != 2 {
+		t.Errorf("TrustedProxies.ChainIter() parsed %v entries, want 2", parsed)
+	}
+	if ip, ok := next(); ok {
+		t.Errorf("TrustedProxies.ChainIter() = %v after the end, want none", ip)
+	}
+
+	// The eager walk parses everything
+	parsed = 0
+	tr.mu.RLock()
+	tr.filterOutIPsFromUntrustedSources(net.ParseIP("10.10.10.10"), header)
+	tr.mu.RUnlock()
+	if parsed != 1002 {
+		t.Errorf("TrustedProxies.filterOutIPsFromUntrustedSources() parsed %v entries, want 1002", parsed)
+	}
+}
@@ -0,0 +1,97 @@
+package trustedproxies
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// jsonEntry is the object form of a trusted entry in JSON
+type jsonEntry struct {
+	CIDR  string `json:"cidr"`
+	Label string `json:"label,omitempty"`
+	Ports []int  `json:"ports,omitempty"`
+}
+
+// MarshalJSON encodes the trusted ranges as a JSON array. Plain entries
+// are encoded as strings, labeled or port-restricted entries as objects
+// of the form {"cidr": "10.0.0.0/8", "label": "internal", "ports": [443]}.
+// The deny list follows as strings prefixed with "!", e.g. "!10.6.6.0/24",
+// like in the output of WriteTo.
+func (t *TrustedProxies) MarshalJSON() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entries := []interface{}{}
+	for _, ipnet := range t.trustedCIDRs {
+		label, ports := t.labelOf(ipnet), t.portsOf(ipnet)
+		if label != "" || len(ports) > 0 {
+			entries = append(entries, jsonEntry{CIDR: ipnet.String(), Label: label, Ports: ports})
+		} else {
+			entries = append(entries, ipnet.String())
+		}
+	}
+	denied := []string{}
+	for _, ipnet := range t.deniedNets() {
+		denied = append(denied, "!"+ipnet.String())
+	}
+	sort.Strings(denied)
+	for _, spec := range denied {
+		entries = append(entries, spec)
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON replaces the configuration with the entries from a JSON
+// array. Each element may either be a string, as accepted by
+// AddFromString, or an object with a "cidr", an optional "label" and
+// optional "ports" (see AddForPorts). A string prefixed with "!" is added
+// to the deny list instead, see DenyFromString.
+// On error, the configuration is left untouched.
+func (t *TrustedProxies) UnmarshalJSON(data []byte) error {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+
+	n := t.staging()
+	for idx, element := range elements {
+		var spec string
+		if err := json.Unmarshal(element, &spec); err == nil {
+			if trimmed := strings.TrimSpace(spec); strings.HasPrefix(trimmed, "!") {
+				if err := n.DenyFromString(trimmed[1:]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := n.AddFromString(spec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var entry jsonEntry
+		if err := json.Unmarshal(element, &entry); err != nil {
+			return fmt.Errorf("element %d: expected string or object: %w", idx, err)
+		}
+		ports, err := portSet(entry.Ports)
+		if err != nil {
+			return err
+		}
+		nets, err := n.addFromString(entry.CIDR)
+		if err != nil {
+			return err
+		}
+		for _, ipnet := range nets {
+			m := n.metaFor(ipnet)
+			m.label = entry.Label
+			m.ports = ports
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	t.replaceWith(n)
+	return nil
+}
@@ -0,0 +1,122 @@
+package trustedproxies
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTrustedProxies_UnmarshalJSON(t *testing.T) {
+	type check struct {
+		ip    string
+		label string
+	}
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+		checks  []check
+	}{
+		{"Plain strings", `["10.0.0.0/8", "192.168.1.1"]`, false, []check{{"10.1.1.1", ""}, {"192.168.1.1", ""}}},
+		{"Objects with labels", `[{"cidr": "10.0.0.0/8", "label": "internal"}, {"cidr": "203.0.113.0/24", "label": "cdn"}]`, false,
+			[]check{{"10.1.1.1", "internal"}, {"203.0.113.5", "cdn"}}},
+		{"Object without label", `[{"cidr": "10.0.0.0/8"}]`, false, []check{{"10.1.1.1", ""}}},
+		{"Mixed", `["192.168.1.1", {"cidr": "10.0.0.0/8", "label": "internal"}]`, false, []check{{"10.1.1.1", "internal"}, {"192.168.1.1", ""}}},
+		{"Invalid spec", `["horse"]`, true, nil},
+		{"Invalid spec in object", `[{"cidr": "horse", "label": "internal"}]`, true, nil},
+		{"Invalid element", `[42]`, true, nil},
+		{"Invalid port", `[{"cidr": "10.0.0.0/8", "ports": [0]}]`, true, nil},
+		{"Not an array", `{"cidr": "10.0.0.0/8"}`, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			err := json.Unmarshal([]byte(tt.input), tr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("json.Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, c := range tt.checks {
+				ip := net.ParseIP(c.ip)
+				if tr.IsIPTrusted(&ip) == nil {
+					t.Errorf("%v should be trusted", c.ip)
+				}
+				label, ok := tr.Label(ip)
+				if label != c.label || ok != (c.label != "") {
+					t.Errorf("TrustedProxies.Label(%v) = %q, %v, want %q", c.ip, label, ok, c.label)
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_UnmarshalJSONKeepsConfigOnError(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	if err := json.Unmarshal([]byte(`["192.168.0.0/16", "horse"]`), tr); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Fatalf("json.Unmarshal() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	ip := net.ParseIP("10.1.1.1")
+	if tr.IsIPTrusted(&ip) == nil {
+		t.Errorf("Existing configuration was modified")
+	}
+}
+
+func TestTrustedProxies_JSONRoundTrip(t *testing.T) {
+	tr := New()
+	tr.AddFromString("192.168.1.1")
+	tr.AddLabeled("10.0.0.0/8", "internal")
+	tr.AddForPorts("172.16.0.0/12", 8443, 443)
+
+	data, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	want := `["192.168.1.1/32",{"cidr":"10.0.0.0/8","label":"internal"},{"cidr":"172.16.0.0/12","ports":[443,8443]}]`
+	if string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+
+	restored := New()
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if label, _ := restored.Label(net.ParseIP("10.1.1.1")); label != "internal" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "internal")
+	}
+	if got := restored.DeduceClientIP(net.ParseIP("172.16.0.1"), "8.8.8.8"); got.String() != "172.16.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "172.16.0.1")
+	}
+	if got := restored.DeduceClientIPForPort(net.ParseIP("172.16.0.1"), "8.8.8.8", 443); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIPForPort() = %v, want %v", got, "8.8.8.8")
+	}
+}
+
+func TestTrustedProxies_JSONRoundTripDenyList(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8 !10.6.6.0/24")
+	tr.DenyFromString("10.7.7.7")
+
+	data, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	want := `["10.0.0.0/8","!10.6.6.0/24","!10.7.7.7/32"]`
+	if string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+
+	restored := New()
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	for ip, want := range map[string]bool{"10.1.1.1": true, "10.6.6.1": false, "10.7.7.7": false} {
+		ip := net.ParseIP(ip)
+		if got := restored.IsIPTrusted(&ip) != nil; got != want {
+			t.Errorf("TrustedProxies.IsIPTrusted(%v) = %v, want %v", ip, got, want)
+		}
+	}
+	if got, want := restored.Fingerprint(), tr.Fingerprint(); got != want {
+		t.Errorf("TrustedProxies.Fingerprint() = %v after the round trip, want %v", got, want)
+	}
+}
@@ -0,0 +1,507 @@
+package trustedproxies
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddFromNginxConfig adds the addresses from all set_real_ip_from
+// directives found in an nginx configuration, e.g.
+//
+//	set_real_ip_from 192.168.1.0/24;
+//
+// Other directives and comments are ignored, as are "unix:" addresses.
+// Either all addresses are added or, on error, none of them.
+func (t *TrustedProxies) AddFromNginxConfig(r io.Reader) error {
+	nets := []*net.IPNet{}
+	specs := map[*net.IPNet]string{}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	pending := ""
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		statements := strings.Split(pending+" "+line, ";")
+		// The last element is an incomplete statement (or empty)
+		pending = statements[len(statements)-1]
+		for _, statement := range statements[:len(statements)-1] {
+			fields := strings.Fields(statement)
+			if len(fields) == 0 || fields[0] != "set_real_ip_from" {
+				continue
+			}
+			if len(fields) != 2 {
+				return fmt.Errorf("line %d: %w: %q", lineNo, ErrInvalidIPSpecification, strings.TrimSpace(statement))
+			}
+			if strings.HasPrefix(fields[1], "unix:") {
+				continue
+			}
+			ipnet, err := netFromIPOrCIDR(fields[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			nets = append(nets, ipnet)
+			specs[ipnet] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	for _, ipnet := range nets {
+		t.trustedCIDRs = append(t.trustedCIDRs, ipnet)
+		t.metaFor(ipnet).spec = specs[ipnet]
+	}
+	return nil
+}
+
+// AddFromBirdPrefixList adds the prefixes from a BIRD style prefix
+// list, one per line, optionally followed by "," or ";", e.g.
+//
+//	192.0.2.0/24;
+//	198.51.100.0/24{24,28};
+//	2001:db8::/32+;
+//
+// A length range "{a,b}", or "+" for any longer prefix, selects the
+// prefixes within the given one. As these cover exactly the addresses of
+// the given prefix, it is added as is. Ranges reaching beyond it,
+// including the "-" modifier, are rejected. Lines holding nothing but
+// "[" or "]" and everything following a "#" are ignored. Either all
+// prefixes are added or, on error, none of them.
+func (t *TrustedProxies) AddFromBirdPrefixList(r io.Reader) error {
+	nets := []*net.IPNet{}
+	specs := map[*net.IPNet]string{}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimRight(strings.TrimSpace(line), ",;")
+		line = strings.TrimSpace(line)
+		if line == "" || line == "[" || line == "]" {
+			continue
+		}
+		ipnet, err := netFromBirdPrefix(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		nets = append(nets, ipnet)
+		specs[ipnet] = line
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	for _, ipnet := range nets {
+		t.trustedCIDRs = append(t.trustedCIDRs, ipnet)
+		t.metaFor(ipnet).spec = specs[ipnet]
+	}
+	return nil
+}
+
+// netFromBirdPrefix parses a prefix as accepted by AddFromBirdPrefixList
+func netFromBirdPrefix(s string) (*net.IPNet, error) {
+	prefix, modifier := s, ""
+	if idx := strings.IndexAny(s, "{+-"); idx >= 0 {
+		prefix, modifier = s[:idx], s[idx:]
+	}
+	_, ipnet, err := net.ParseCIDR(strings.TrimSpace(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIPSpecification, s)
+	}
+	ones, bits := ipnet.Mask.Size()
+
+	switch {
+	case modifier == "" || modifier == "+":
+		return ipnet, nil
+	case strings.HasPrefix(modifier, "{") && strings.HasSuffix(modifier, "}"):
+		bounds := strings.Split(modifier[1:len(modifier)-1], ",")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("%w: %s (invalid length range)", ErrInvalidIPSpecification, s)
+		}
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s (invalid length range)", ErrInvalidIPSpecification, s)
+		}
+		high, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || low > high || high > bits {
+			return nil, fmt.Errorf("%w: %s (invalid length range)", ErrInvalidIPSpecification, s)
+		}
+		if low < ones {
+			return nil, fmt.Errorf("%w: %s (length range beyond the prefix is not supported)", ErrInvalidIPSpecification, s)
+		}
+		return ipnet, nil
+	default:
+		return nil, fmt.Errorf("%w: %s (unsupported modifier %q)", ErrInvalidIPSpecification, s, modifier)
+	}
+}
+
+// CSVColumns tells AddFromCSV where to find the fields of a row. Columns
+// are numbered from 1, so that 0, the zero value, means there is none.
+type CSVColumns struct {
+	// Network is the column holding the network address, or a CIDR if
+	// there is no PrefixLen column. It is required.
+	Network int
+	// PrefixLen is the column holding the prefix length, if any
+	PrefixLen int
+	// Label is the column holding the label of the entry, if any
+	Label int
+	// SkipHeader makes AddFromCSV skip the first row
+	SkipHeader bool
+}
+
+// AddFromCSV adds the networks from a CSV file, e.g. a threat
+// intelligence feed of known proxies, using the given columns. Lines
+// starting with "#" are ignored. Malformed rows don't stop the others
+// from being added: they are counted and returned as an error listing
+// each of them. A failure to read r, however, adds nothing, as do
+// invalid columns.
+func (t *TrustedProxies) AddFromCSV(r io.Reader, columns CSVColumns) (malformed int, err error) {
+	if columns.Network <= 0 || columns.PrefixLen < 0 || columns.Label < 0 {
+		return 0, fmt.Errorf("%w: invalid CSV columns %+v, Network is required and columns are numbered from 1", ErrInvalidIPSpecification, columns)
+	}
+	type row struct {
+		ipnet *net.IPNet
+		label string
+	}
+	rows := []row{}
+	errs := errorList{}
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for rowNo := 1; ; rowNo++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrInvalidIPSpecification, parseErr))
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if rowNo == 1 && columns.SkipHeader {
+			continue
+		}
+
+		ipnet, label, err := columns.parse(record)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", rowNo, err))
+			continue
+		}
+		rows = append(rows, row{ipnet, label})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	for _, row := range rows {
+		t.trustedCIDRs = append(t.trustedCIDRs, row.ipnet)
+		m := t.metaFor(row.ipnet)
+		m.spec = row.ipnet.String()
+		m.label = row.label
+	}
+	if len(errs) > 0 {
+		return len(errs), errs
+	}
+	return 0, nil
+}
+
+// parse returns the network and label of a CSV record
+func (c CSVColumns) parse(record []string) (*net.IPNet, string, error) {
+	field := func(column int) (string, error) {
+		if column > len(record) {
+			return "", fmt.Errorf("%w: missing column %d in %q", ErrInvalidIPSpecification, column, strings.Join(record, ","))
+		}
+		return strings.TrimSpace(record[column-1]), nil
+	}
+
+	cidr, err := field(c.Network)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.PrefixLen > 0 {
+		prefixLen, err := field(c.PrefixLen)
+		if err != nil {
+			return nil, "", err
+		}
+		cidr += "/" + prefixLen
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidIPSpecification, cidr)
+	}
+
+	label := ""
+	if c.Label > 0 {
+		if label, err = field(c.Label); err != nil {
+			return nil, "", err
+		}
+	}
+	return ipnet, label, nil
+}
+
+// AddFromReader adds the entries read from r, one per line, e.g. as
+// written by WriteTo. A line holds a specification as accepted by
+// AddFromString, optionally followed by "ports=" and a comma separated
+// list of ports (see AddForPorts), or an entry for the deny list
+// prefixed with "!". Empty lines and everything following a "#" are
+// ignored. Either all entries are added or, on error, none of them.
+func (t *TrustedProxies) AddFromReader(r io.Reader) error {
+	n := t.staging()
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := n.addLine(line); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	t.merge(n)
+	return nil
+}
+
+// streamingBatch is the number of lines AddFromReaderStreaming parses
+// before adding them
+const streamingBatch = 4096
+
+// AddFromReaderStreaming works like AddFromReader, but adds the entries
+// as it goes, a batch of lines at a time, rather than once all of r is
+// read. Memory use is thus bounded by the batch and the resulting list,
+// which matters for very large files such as threat feeds. Lookups made
+// meanwhile see the entries added so far. If progress isn't nil, it is
+// called after each batch with the number of lines read and entries
+// added so far. t isn't locked while it runs, so it may use t.
+//
+// Unlike AddFromReader, an error stops reading, but the entries of the
+// lines before remain. With the KeepCanonical option, the entries are
+// only sorted and deduplicated once reading stops.
+func (t *TrustedProxies) AddFromReaderStreaming(r io.Reader, progress func(lines, entries int)) error {
+	n := t.staging()
+	lineNo, batched, entries := 0, 0, 0
+	flush := func(last bool) {
+		entries += len(n.trustedCIDRs)
+		t.mu.Lock()
+		t.merge(n)
+		if last {
+			t.canonicalize()
+		} else {
+			t.invalidateIndex()
+		}
+		t.mu.Unlock()
+		n, batched = t.staging(), 0
+		if progress != nil {
+			progress(lineNo, entries)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			if err := n.addLine(line); err != nil {
+				flush(true)
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		}
+		if batched++; batched == streamingBatch {
+			flush(false)
+		}
+	}
+	flush(true)
+	return scanner.Err()
+}
+
+// merge adds the trusted entries, including their metadata, and the
+// deny list of n
+func (t *TrustedProxies) merge(n *TrustedProxies) {
+	t.trustedCIDRs = append(t.trustedCIDRs, n.trustedCIDRs...)
+	for ipnet, m := range n.meta {
+		*t.metaFor(ipnet) = *m
+	}
+	if n.hasTTL {
+		t.hasTTL = true
+	}
+	t.deny(n.deniedNets()...)
+}
+
+// addLine adds a single line as accepted by AddFromReader
+func (t *TrustedProxies) addLine(line string) error {
+	if strings.HasPrefix(line, "!") {
+		nets, err := netsFromString(line[1:])
+		if err != nil {
+			return err
+		}
+		t.deny(nets...)
+		return nil
+	}
+
+	var set map[int]bool
+	fields := strings.Fields(line)
+	if last := fields[len(fields)-1]; strings.HasPrefix(last, "ports=") {
+		ports := []int{}
+		for _, s := range strings.Split(strings.TrimPrefix(last, "ports="), ",") {
+			port, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("%w: invalid port %q", ErrInvalidIPSpecification, s)
+			}
+			ports = append(ports, port)
+		}
+		var err error
+		if set, err = portSet(ports); err != nil {
+			return err
+		}
+		line = strings.Join(fields[:len(fields)-1], " ")
+	}
+
+	nets, err := t.addFromString(line)
+	if err != nil {
+		return err
+	}
+	for _, ipnet := range nets {
+		t.metaFor(ipnet).ports = set
+	}
+	return nil
+}
+
+// Source adds entries from somewhere, e.g. a file or an environment
+// variable, to t, typically using one of the Add methods
+type Source func(t *TrustedProxies) error
+
+// Loader loads entries from several sources concurrently and combines
+// them into a single TrustedProxies, e.g.
+//
+//	tp, err := trustedproxies.NewLoader().
+//		Add(func(t *trustedproxies.TrustedProxies) error { return t.AddFromReader(f) }).
+//		Add(func(t *trustedproxies.TrustedProxies) error { return t.AddFromString(os.Getenv("PROXIES")) }).
+//		Load()
+type Loader struct {
+	opts     []Option
+	sources  []Source
+	names    []string
+	failFast bool
+}
+
+// NewLoader returns a Loader whose result is created with opts
+func NewLoader(opts ...Option) *Loader {
+	return &Loader{opts: opts}
+}
+
+// Add adds a source
+func (l *Loader) Add(source Source) *Loader {
+	return l.AddNamed("", source)
+}
+
+// AddNamed adds a source named name, e.g. "file:/etc/proxies" or "env".
+// The entries it loads are marked with name, see EntriesBySource.
+func (l *Loader) AddNamed(name string, source Source) *Loader {
+	l.sources = append(l.sources, source)
+	l.names = append(l.names, name)
+	return l
+}
+
+// FailFast makes Load return as soon as a source fails, without waiting
+// for the others
+func (l *Loader) FailFast() *Loader {
+	l.failFast = true
+	return l
+}
+
+// Load runs all sources concurrently, each on its own TrustedProxies,
+// and merges their entries in the order the sources were added.
+//
+// If any source fails, the returned error lists every failure. Unless
+// FailFast is used, the entries of the sources that succeeded are still
+// returned, so the caller may decide to continue with them. With
+// FailFast, Load returns nil and the first error as soon as it occurs.
+func (l *Loader) Load() (*TrustedProxies, error) {
+	type loaded struct {
+		idx int
+		tp  *TrustedProxies
+		err error
+	}
+
+	// Buffered, so that sources finishing after a fail-fast return
+	// don't block forever
+	results := make(chan loaded, len(l.sources))
+	for idx, source := range l.sources {
+		idx, source := idx, source
+		go func() {
+			tp := New(l.opts...)
+			results <- loaded{idx, tp, source(tp)}
+		}()
+	}
+
+	parts := make([]loaded, len(l.sources))
+	for range l.sources {
+		r := <-results
+		if r.err != nil && l.failFast {
+			return nil, r.err
+		}
+		parts[r.idx] = r
+	}
+
+	tp := New(l.opts...)
+	errs := errorList{}
+	tp.mu.Lock()
+	for idx, part := range parts {
+		if part.err != nil {
+			errs = append(errs, part.err)
+			continue
+		}
+		if name := l.names[idx]; name != "" {
+			for _, ipnet := range part.tp.trustedCIDRs {
+				part.tp.metaFor(ipnet).source = name
+			}
+		}
+		tp.merge(part.tp)
+	}
+	tp.canonicalize()
+	tp.mu.Unlock()
+
+	if len(errs) > 0 {
+		return tp, errs
+	}
+	return tp, nil
+}
@@ -0,0 +1,473 @@
+package trustedproxies
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func trustedStrings(t *TrustedProxies) []string {
+	rv := []string{}
+	for _, ipnet := range t.trustedCIDRs {
+		rv = append(rv, ipnet.String())
+	}
+	return rv
+}
+
+func TestTrustedProxies_AddFromNginxConfig(t *testing.T) {
+	config := `
+# Trust our load balancers
+set_real_ip_from 192.168.1.0/24;
+set_real_ip_from  10.0.0.1 ; # a single balancer
+set_real_ip_from 2001:db8::/32;
+set_real_ip_from unix:;
+#set_real_ip_from 172.16.0.0/12;
+real_ip_header X-Forwarded-For;
+real_ip_recursive on;
+
+server {
+	listen 80; set_real_ip_from 203.0.113.0/24;
+	set_real_ip_from
+		198.51.100.0/24;
+	location / {
+		proxy_pass http://backend;
+	}
+}
+`
+	tr := New()
+	if err := tr.AddFromNginxConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("TrustedProxies.AddFromNginxConfig() error = %v", err)
+	}
+	want := []string{"192.168.1.0/24", "10.0.0.1/32", "2001:db8::/32", "203.0.113.0/24", "198.51.100.0/24"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.AddFromNginxConfig() added %v, want %v", got, want)
+	}
+	if spec, _ := tr.MatchedSpec(net.ParseIP("10.0.0.1")); spec != "10.0.0.1" {
+		t.Errorf("TrustedProxies.MatchedSpec() = %v, want %v", spec, "10.0.0.1")
+	}
+}
+
+func TestTrustedProxies_AddFromNginxConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"Invalid address", "set_real_ip_from 192.168.1.0/24;\nset_real_ip_from horse;\n"},
+		{"Too many arguments", "set_real_ip_from 192.168.1.0/24 10.0.0.1;\n"},
+		{"Missing argument", "set_real_ip_from;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			if err := tr.AddFromNginxConfig(strings.NewReader(tt.config)); !errors.Is(err, ErrInvalidIPSpecification) {
+				t.Errorf("TrustedProxies.AddFromNginxConfig() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+			}
+			if len(tr.trustedCIDRs) != 0 {
+				t.Errorf("TrustedProxies.AddFromNginxConfig() added %v", tr.trustedCIDRs)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AddFromBirdPrefixList(t *testing.T) {
+	list := `
+# Our edge
+[
+	192.0.2.0/24,
+	198.51.100.0/24{24,28}, # announced in pieces
+	203.0.113.0/25{26, 32};
+	2001:db8::/32+;
+]
+`
+	tr := New()
+	if err := tr.AddFromBirdPrefixList(strings.NewReader(list)); err != nil {
+		t.Fatalf("TrustedProxies.AddFromBirdPrefixList() error = %v", err)
+	}
+	want := []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/25", "2001:db8::/32"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.AddFromBirdPrefixList() added %v, want %v", got, want)
+	}
+	if spec, _ := tr.MatchedSpec(net.ParseIP("198.51.100.200")); spec != "198.51.100.0/24{24,28}" {
+		t.Errorf("TrustedProxies.MatchedSpec() = %v, want %v", spec, "198.51.100.0/24{24,28}")
+	}
+}
+
+func TestTrustedProxies_AddFromBirdPrefixListErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+	}{
+		{"Invalid prefix", "192.0.2.0/24;\nhorse;\n"},
+		{"Bare address", "192.0.2.1;\n"},
+		{"Shorter prefixes", "192.0.2.0/24-;\n"},
+		{"Range beyond the prefix", "192.0.2.0/24{16,24};\n"},
+		{"Range too long", "192.0.2.0/24{24,33};\n"},
+		{"Reversed range", "192.0.2.0/24{28,24};\n"},
+		{"Single length", "192.0.2.0/24{24};\n"},
+		{"Unknown modifier", "192.0.2.0/24{24,28}+;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			if err := tr.AddFromBirdPrefixList(strings.NewReader(tt.list)); !errors.Is(err, ErrInvalidIPSpecification) {
+				t.Errorf("TrustedProxies.AddFromBirdPrefixList() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+			}
+			if len(tr.trustedCIDRs) != 0 {
+				t.Errorf("TrustedProxies.AddFromBirdPrefixList() added %v", tr.trustedCIDRs)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AddFromCSV(t *testing.T) {
+	feed := `network,prefixlen,label
+# Refreshed daily
+192.0.2.0,24,vpn
+198.51.100.0,horse,vpn
+2001:db8::,32,"hosting, inc."
+203.0.113.0
+"bad"quote",24,vpn
+10.0.0.0, 8 ,tor
+`
+	tr := New()
+	malformed, err := tr.AddFromCSV(strings.NewReader(feed), CSVColumns{Network: 1, PrefixLen: 2, Label: 3, SkipHeader: true})
+	if malformed != 3 {
+		t.Errorf("TrustedProxies.AddFromCSV() malformed = %v, want %v", malformed, 3)
+	}
+	if !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.AddFromCSV() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	want := []string{"192.0.2.0/24", "2001:db8::/32", "10.0.0.0/8"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.AddFromCSV() added %v, want %v", got, want)
+	}
+	if label, _ := tr.Label(net.ParseIP("2001:db8::1")); label != "hosting, inc." {
+		t.Errorf("TrustedProxies.Label() = %v, want %v", label, "hosting, inc.")
+	}
+
+	// A CIDR column, without labels, leaving the other fields zero
+	tr = New()
+	malformed, err = tr.AddFromCSV(strings.NewReader("x,10.0.0.0/8,label\ny,192.0.2.0/24,label\n"), CSVColumns{Network: 2})
+	if malformed != 0 || err != nil {
+		t.Errorf("TrustedProxies.AddFromCSV() = %v, %v, want 0, nil", malformed, err)
+	}
+	want = []string{"10.0.0.0/8", "192.0.2.0/24"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.AddFromCSV() added %v, want %v", got, want)
+	}
+	if _, ok := tr.Label(net.ParseIP("10.0.0.1")); ok {
+		t.Errorf("TrustedProxies.Label() reports a label")
+	}
+
+	// Invalid columns add nothing
+	for _, columns := range []CSVColumns{{}, {Network: 1, PrefixLen: -1}, {Network: -1}} {
+		tr = New()
+		if _, err := tr.AddFromCSV(strings.NewReader("10.0.0.0,8\n"), columns); !errors.Is(err, ErrInvalidIPSpecification) {
+			t.Errorf("TrustedProxies.AddFromCSV(%+v) error = %v, wantErr %v", columns, err, ErrInvalidIPSpecification)
+		}
+		if got := trustedStrings(tr); len(got) != 0 {
+			t.Errorf("TrustedProxies.AddFromCSV(%+v) added %v, want none", columns, got)
+		}
+	}
+}
+
+func TestTrustedProxies_AddFromReader(t *testing.T) {
+	list := `
+# Load balancers
+10.0.0.0/8 !10.6.6.6   # except the canary
+192.0.2.10-192.0.2.11
+
+!10.7.7.7
+172.16.0.1 ports=443,8443
+2001:db8::/32
+`
+	tr := New()
+	if err := tr.AddFromReader(strings.NewReader(list)); err != nil {
+		t.Fatalf("TrustedProxies.AddFromReader() error = %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.10/31", "172.16.0.1/32", "2001:db8::/32"}
+	if got := trustedStrings(tr); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.AddFromReader() added %v, want %v", got, want)
+	}
+	for _, s := range []string{"10.6.6.6", "10.7.7.7"} {
+		ip := net.ParseIP(s)
+		if got := tr.IsIPTrusted(&ip); got != nil {
+			t.Errorf("TrustedProxies.IsIPTrusted(%v) = %v, want nil", s, got)
+		}
+	}
+	if got := tr.DeduceClientIPForPort(net.ParseIP("172.16.0.1"), "8.8.8.8", 80); got.String() != "172.16.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIPForPort() = %v, want %v", got, "172.16.0.1")
+	}
+}
+
+// lineGenerator is an io.Reader producing the lines line(0) to
+// line(n-1), each followed by a newline, on the fly
+type lineGenerator struct {
+	n, next int
+	line    func(idx int) string
+	pending []byte
+}
+
+func (g *lineGenerator) Read(p []byte) (int, error) {
+	for len(g.pending) < len(p) && g.next < g.n {
+		g.pending = append(g.pending, g.line(g.next)+"\n"...)
+		g.next++
+	}
+	if len(g.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+func TestTrustedProxies_AddFromReaderStreaming(t *testing.T) {
+	const lines = 100000
+	gen := &lineGenerator{n: lines, line: func(idx int) string {
+		switch {
+		case idx%1000 == 999:
+			return "# comment"
+		case idx == 500:
+			return "!10.0.1.0"
+		}
+		return fmt.Sprintf("10.%d.%d.%d", idx>>16, idx>>8&255, idx&255)
+	}}
+
+	tr := New()
+	calls, lastLines, lastEntries := 0, 0, 0
+	err := tr.AddFromReaderStreaming(gen, func(lines, entries int) {
+		if calls == 0 && gen.next == gen.n {
+			t.Errorf("AddFromReaderStreaming() read all lines before adding any")
+		}
+		if lines-lastLines > streamingBatch {
+			t.Errorf("AddFromReaderStreaming() buffered %d lines, want at most %d", lines-lastLines, streamingBatch)
+		}
+		// Entries are visible between batches
+		tr.mu.RLock()
+		if got := len(tr.trustedCIDRs); got != entries {
+			t.Errorf("AddFromReaderStreaming() reported %d entries, %d added", entries, got)
+		}
+		tr.mu.RUnlock()
+		calls, lastLines, lastEntries = calls+1, lines, entries
+	})
+	if err != nil {
+		t.Fatalf("TrustedProxies.AddFromReaderStreaming() error = %v", err)
+	}
+
+	wantEntries := lines - lines/1000 - 1
+	if lastLines != lines || lastEntries != wantEntries || calls < lines/streamingBatch {
+		t.Errorf("progress called %d times, last with %d lines and %d entries, want %d lines and %d entries", calls, lastLines, lastEntries, lines, wantEntries)
+	}
+	if got := len(trustedStrings(tr)); got != wantEntries {
+		t.Errorf("TrustedProxies.AddFromReaderStreaming() added %d entries, want %d", got, wantEntries)
+	}
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.1.0": false, "10.0.1.1": true, "10.0.3.231": false, "10.1.134.158": true, "10.1.134.160": false} {
+		ip := net.ParseIP(ip)
+		if got := tr.IsIPTrusted(&ip) != nil; got != want {
+			t.Errorf("TrustedProxies.IsIPTrusted(%v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// The lines before an error remain
+	gen = &lineGenerator{n: lines, line: func(idx int) string {
+		if idx == 4999 {
+			return "horse"
+		}
+		return fmt.Sprintf("10.%d.%d.%d", idx>>16, idx>>8&255, idx&255)
+	}}
+	tr = New()
+	err = tr.AddFromReaderStreaming(gen, nil)
+	if !errors.Is(err, ErrInvalidIPSpecification) || !strings.Contains(err.Error(), "line 5000") {
+		t.Errorf("TrustedProxies.AddFromReaderStreaming() error = %v, want %v on line 5000", err, ErrInvalidIPSpecification)
+	}
+	if got := len(trustedStrings(tr)); got != 4999 {
+		t.Errorf("TrustedProxies.AddFromReaderStreaming() added %d entries before the error, want %d", got, 4999)
+	}
+}
+
+func TestTrustedProxies_AddFromReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+	}{
+		{"Invalid address", "10.0.0.0/8\nhorse\n"},
+		{"Invalid deny entry", "10.0.0.0/8\n!horse\n"},
+		{"Invalid port", "10.0.0.1 ports=https\n"},
+		{"Port out of range", "10.0.0.1 ports=443,0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			if err := tr.AddFromReader(strings.NewReader(tt.list)); !errors.Is(err, ErrInvalidIPSpecification) {
+				t.Errorf("TrustedProxies.AddFromReader() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+			}
+			if len(tr.trustedCIDRs) != 0 {
+				t.Errorf("TrustedProxies.AddFromReader() added %v", tr.trustedCIDRs)
+			}
+		})
+	}
+}
+
+func TestLoader_Load(t *testing.T) {
+	release := make(chan struct{})
+	file := func(t *TrustedProxies) error {
+		// Finishes last, but its entries still come first
+		<-release
+		return t.AddFromReader(strings.NewReader("10.0.0.0/8 !10.6.6.6\n"))
+	}
+	env := func(t *TrustedProxies) error {
+		defer close(release)
+		return t.AddLabeled("192.168.0.0/16", "env")
+	}
+	url := func(t *TrustedProxies) error {
+		return t.AddForPorts("2001:db8::/32", 443)
+	}
+
+	tp, err := NewLoader(MaxHops(2)).Add(file).Add(env).Add(url).Load()
+	if err != nil {
+		t.Fatalf("Loader.Load() error = %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}
+	if got := trustedStrings(tp); !reflect.DeepEqual(got, want) {
+		t.Errorf("Loader.Load() entries = %v, want %v", got, want)
+	}
+	if label, _ := tp.Label(net.ParseIP("192.168.1.1")); label != "env" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "env")
+	}
+	ip := net.ParseIP("10.6.6.6")
+	if got := tp.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+	if got := tp.DeduceClientIPForPort(net.ParseIP("2001:db8::1"), "8.8.8.8", 443); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIPForPort() = %v, want %v", got, "8.8.8.8")
+	}
+	if tp.maxHops != 2 {
+		t.Errorf("TrustedProxies.maxHops = %v, want %v", tp.maxHops, 2)
+	}
+}
+
+func TestLoader_LoadNamed(t *testing.T) {
+	file := func(t *TrustedProxies) error {
+		return t.AddFromReader(strings.NewReader("10.0.0.0/8\n2001:db8::/32\n"))
+	}
+	env := func(t *TrustedProxies) error {
+		t.AddCloudflare()
+		return t.AddFromString("192.168.0.0/16")
+	}
+
+	tp, err := NewLoader(KeepCanonical()).AddNamed("file", file).AddNamed("env", env).Add(func(t *TrustedProxies) error {
+		return t.AddFromString("10.0.0.0/8")
+	}).Load()
+	if err != nil {
+		t.Fatalf("Loader.Load() error = %v", err)
+	}
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"file", []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"env", append(append([]string{}, stringsOf(cloudflareRanges)...), "192.168.0.0/16")},
+		{"", []string{"10.0.0.0/8"}},
+		{"preset", []string{}},
+		{"url", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got := stringsOf(tp.EntriesBySource(tt.src))
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.EntriesBySource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Outside of a Loader, presets have their own source
+	tr := New()
+	tr.AddCloudflare()
+	if got := len(tr.EntriesBySource("preset")); got != len(cloudflareRanges) {
+		t.Errorf("TrustedProxies.EntriesBySource() returned %v entries, want %v", got, len(cloudflareRanges))
+	}
+}
+
+func stringsOf(nets []*net.IPNet) []string {
+	rv := []string{}
+	for _, ipnet := range nets {
+		rv = append(rv, ipnet.String())
+	}
+	return rv
+}
+
+func TestLoader_LoadErrors(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	good := func(t *TrustedProxies) error {
+		return t.AddFromString("10.0.0.0/8")
+	}
+	invalid := func(t *TrustedProxies) error {
+		return t.AddFromString("horse")
+	}
+	unreachable := func(t *TrustedProxies) error {
+		return errTimeout
+	}
+
+	// Best-effort: the good source is kept, all errors are reported
+	tp, err := NewLoader().Add(good).Add(invalid).Add(unreachable).Load()
+	if !errors.Is(err, ErrInvalidIPSpecification) || !errors.Is(err, errTimeout) {
+		t.Errorf("Loader.Load() error = %v, want both failures", err)
+	}
+	if got, want := trustedStrings(tp), []string{"10.0.0.0/8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Loader.Load() entries = %v, want %v", got, want)
+	}
+
+	// Fail-fast: no result, doesn't wait for the blocked source
+	block := make(chan struct{})
+	defer close(block)
+	blocked := func(t *TrustedProxies) error {
+		<-block
+		return nil
+	}
+	tp, err = NewLoader().FailFast().Add(blocked).Add(unreachable).Load()
+	if !errors.Is(err, errTimeout) || tp != nil {
+		t.Errorf("Loader.Load() = %v, %v, want nil, %v", tp, err, errTimeout)
+	}
+}
+
+func TestLoader_LoadNoSources(t *testing.T) {
+	tp, err := NewLoader().Load()
+	if err != nil || tp == nil || len(tp.trustedCIDRs) != 0 {
+		t.Errorf("Loader.Load() = %v, %v, want an empty list", tp, err)
+	}
+}
+
+func TestLoader_LoadOptions(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	ignored := []string{}
+	loader := NewLoader(Clock(func() time.Time { return start }), WarnOnIgnoredPort(func(spec string) { ignored = append(ignored, spec) }))
+	loader.Add(func(tp *TrustedProxies) error {
+		return tp.AddWithTTL("10.0.0.0/8", time.Hour)
+	})
+	loader.Add(func(tp *TrustedProxies) error {
+		return tp.AddFromString("192.168.0.1:8080")
+	})
+	tp, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Loader.Load() error = %v", err)
+	}
+
+	// The TTL starts at the injected time, not the wall clock
+	if got := tp.IsIPTrustedAt(net.ParseIP("10.0.0.1"), start.Add(30*time.Minute)); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrustedAt() = %v, want a match", got)
+	}
+	if got := tp.IsIPTrustedAt(net.ParseIP("10.0.0.1"), start.Add(time.Hour)); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrustedAt() = %v after the TTL, want nil", got)
+	}
+	if !reflect.DeepEqual(ignored, []string{"192.168.0.1:8080"}) {
+		t.Errorf("WarnOnIgnoredPort called with %v, want %v", ignored, []string{"192.168.0.1:8080"})
+	}
+}
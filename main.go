@@ -1,47 +1,892 @@
 package trustedproxies
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 )
 
 // ErrInvalidIPSpecification indicates the IP specification is invalid and cannot be parsed.
 var ErrInvalidIPSpecification = errors.New("invalid IP specification")
 
+// ErrNoSuchEntry indicates the requested entry isn't configured
+var ErrNoSuchEntry = errors.New("no such entry")
+
+// ErrConflictingEntries indicates a network is both trusted and denied
+var ErrConflictingEntries = errors.New("network is both trusted and denied")
+
+// errorList combines several errors into one
+type errorList []error
+
+func (e errorList) Error() string {
+	msgs := make([]string, len(e))
+	for idx, err := range e {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target
+func (e errorList) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 type TrustedProxies struct {
+	// lookups, trustedLookups and truncations are accessed atomically,
+	// see Stats. They come first to be 64-bit aligned on 32-bit
+	// platforms.
+	lookups        uint64
+	trustedLookups uint64
+	truncations    uint64
+
+	mu sync.RWMutex
+
 	trustedCIDRs []*net.IPNet
+	deniedCIDRs  []*net.IPNet
+	// deniedIPs holds denied single addresses, keyed by their 16-byte form
+	deniedIPs map[string]struct{}
+
+	// meta holds optional information about trusted entries
+	meta map[*net.IPNet]*entryMeta
+
+	skipBogonsInHeader   bool
+	maxHops              int
+	detectFamilyMismatch bool
+
+	warnIfUnconfigured     func()
+	warnIfUnconfiguredOnce sync.Once
+
+	history *history
+	// maxObservedHops is accessed atomically, see MaxObservedHops
+	maxObservedHops int32
+
+	trustedCertFingerprints map[string]struct{}
+
+	keepCanonical bool
+
+	policy TrustPolicy
+
+	now    func() time.Time
+	hasTTL bool
+	// distrusted holds the windows set by DistrustTemporarily, keyed by
+	// the 16 byte form of the IP
+	distrusted map[string]window
+
+	quoteAwareHeader bool
+	tokenizer        func(raw string) []string
+
+	leftmostWhenTrusted bool
+
+	verifyMatch func(matched *net.IPNet, ip net.IP) bool
+
+	warnOnIgnoredPort   func(spec string)
+	warnOnPrivateClient func(result DeduceResult)
+
+	exempt *TrustedProxies
+
+	trackMatches bool
+
+	// index holds the *matchIndex used by match, nil if it needs to be
+	// rebuilt. indexMu serializes building it and compilations, accessed
+	// atomically, counts the builds.
+	index        atomic.Value
+	indexMu      sync.Mutex
+	compilations int32
+}
+
+// entryMeta holds optional information about a trusted entry
+type entryMeta struct {
+	// hits counts the lookups the entry matched and lastHit is when it
+	// last did, in Unix nanoseconds, 0 if never. Both are accessed
+	// atomically, see MatchCount and UnusedEntries, and come first to be
+	// 64-bit aligned on 32-bit platforms.
+	hits    uint64
+	lastHit int64
+
+	label string
+	// spec is the specification the entry was added from
+	spec string
+	// source names where the entry was loaded from, see Loader.AddNamed
+	source string
+	// ports, if not empty, restricts the entry to these local ports
+	ports map[int]bool
+	// added and expires, if expires is set, limit when the entry is
+	// trusted, see AddWithTTL
+	added, expires time.Time
 }
 
 // New provides an initialized TrustedProxies
-func New() *TrustedProxies {
-	return &TrustedProxies{
+func New(opts ...Option) *TrustedProxies {
+	t := &TrustedProxies{
 		trustedCIDRs: []*net.IPNet{},
+		deniedCIDRs:  []*net.IPNet{},
+		deniedIPs:    map[string]struct{}{},
+		meta:         map[*net.IPNet]*entryMeta{},
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
 }
 
-// AddFromString adds a trusted proxy (IP or CIDR) to the list
+// AddFromString adds a trusted proxy (IP or CIDR) to the list.
+//
+// A range of addresses can be given as "start-end", e.g.
+// "192.0.2.10-192.0.2.20". It is added as the networks covering it.
+// For IPv4, the end can be shortened to its last octet, as in
+// "192.0.2.10-20", which stays within the start's /24.
+//
+// A range can be followed by one or more exclusions, each prefixed
+// with "!", e.g. "10.0.0.0/8 !10.6.6.0/24". The range is added as
+// trusted and the exclusions are added to the deny list. Either the
+// whole specification is applied or, on error, none of it.
+//
+// An address with a port, e.g. "10.0.0.1:8080" or "[2001:db8::1]:443",
+// is added without the port, see WarnOnIgnoredPort.
 func (t *TrustedProxies) AddFromString(s string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	_, err := t.addFromString(s)
+	return err
+}
+
+// AddLabeled works like AddFromString, but additionally attaches a
+// label to the trusted entry, e.g. "internal" or "cdn".
+func (t *TrustedProxies) AddLabeled(s string, label string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	nets, err := t.addFromString(s)
+	if err != nil {
+		return err
+	}
+	for _, ipnet := range nets {
+		t.metaFor(ipnet).label = label
+	}
+	return nil
+}
+
+// addFromString adds a specification and returns the trusted entries
+// created for it
+func (t *TrustedProxies) addFromString(s string) ([]*net.IPNet, error) {
+	spec := s
+	if stripped, ok := withoutPorts(s); ok {
+		if t.warnOnIgnoredPort != nil {
+			t.warnOnIgnoredPort(strings.TrimSpace(s))
+		}
+		spec = stripped
+	}
+	nets, denied, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	t.trustedCIDRs = append(t.trustedCIDRs, nets...)
+	t.deny(denied...)
+	for _, ipnet := range nets {
+		t.metaFor(ipnet).spec = strings.TrimSpace(s)
+	}
+	return nets, nil
+}
+
+// metaFor returns the metadata for a trusted entry, creating it if needed
+func (t *TrustedProxies) metaFor(ipnet *net.IPNet) *entryMeta {
+	if t.meta == nil {
+		t.meta = map[*net.IPNet]*entryMeta{}
+	}
+	m, ok := t.meta[ipnet]
+	if !ok {
+		m = &entryMeta{}
+		t.meta[ipnet] = m
+	}
+	return m
+}
+
+// Label returns the label of the entry trusting ip. The bool is false
+// if ip is not trusted or the matching entry has no label.
+func (t *TrustedProxies) Label(ip net.IP) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ipnet := t.effectiveTrust(ip, t.lookupTime())
+	if ipnet == nil {
+		return "", false
+	}
+	label := t.labelOf(ipnet)
+	return label, label != ""
+}
+
+// MatchLabeled returns the label and the prefix length of the entry
+// trusting ip in a single lookup. ok is false if ip is not trusted; an
+// unlabeled entry yields an empty label.
+func (t *TrustedProxies) MatchLabeled(ip net.IP) (label string, prefixLen int, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ipnet := t.effectiveTrust(ip, t.lookupTime())
+	if ipnet == nil {
+		return "", 0, false
+	}
+	prefixLen, _ = ipnet.Mask.Size()
+	return t.labelOf(ipnet), prefixLen, true
+}
+
+// MatchIndex returns the index, in TrustedCIDRs, of the entry trusting
+// ip, or -1 if ip is not trusted. Indices are only stable as long as
+// the list isn't changed; any change, including Compact and the
+// KeepCanonical option, may shift them.
+func (t *TrustedProxies) MatchIndex(ip net.IP) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ipnet := t.effectiveTrust(ip, t.lookupTime())
+	for idx, entry := range t.trustedCIDRs {
+		if entry == ipnet {
+			return idx
+		}
+	}
+	return -1
+}
+
+// EntryTrusting returns (a copy of) the most specific entry trusting ip,
+// e.g. to find the entry to remove with RemoveFromString to distrust a
+// compromised address with the least collateral. Entries restricted to
+// specific ports are not considered. Of several equally specific
+// entries, the first one is returned. Broader entries may still trust
+// ip once it is removed, so repeat until the bool is false, which it is
+// if ip is not trusted.
+func (t *TrustedProxies) EntryTrusting(ip net.IP) (*net.IPNet, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	at := t.lookupTime()
+	if t.effectiveTrust(ip, at) == nil {
+		return nil, false
+	}
+	var best *net.IPNet
+	bestOnes := -1
+	for _, ipnet := range t.trustedCIDRs {
+		if !ipnet.Contains(ip) || !t.validForPort(ipnet, anyPort) || !t.validAt(ipnet, at) {
+			continue
+		}
+		if ones, _ := ipnet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = ipnet, ones
+		}
+	}
+	return copyNet(best), true
+}
+
+// TrustedCIDRs returns a copy of the trusted entries, in the order they
+// are matched
+func (t *TrustedProxies) TrustedCIDRs() []*net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rv := make([]*net.IPNet, len(t.trustedCIDRs))
+	for idx, ipnet := range t.trustedCIDRs {
+		rv[idx] = copyNet(ipnet)
+	}
+	return rv
+}
+
+// MatchedSpec returns the specification, as originally passed to
+// AddFromString, of the entry trusting ip. E.g. "10.0.0.1" rather than
+// the normalized "10.0.0.1/32". The bool is false if ip is not trusted.
+func (t *TrustedProxies) MatchedSpec(ip net.IP) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ipnet := t.effectiveTrust(ip, t.lookupTime())
+	if ipnet == nil {
+		return "", false
+	}
+	if m, ok := t.meta[ipnet]; ok && m.spec != "" {
+		return m.spec, true
+	}
+	return ipnet.String(), true
+}
+
+// labelOf returns the label of a trusted entry, if any
+func (t *TrustedProxies) labelOf(ipnet *net.IPNet) string {
+	if m, ok := t.meta[ipnet]; ok {
+		return m.label
+	}
+	return ""
+}
+
+// EntriesBySource returns a copy of the trusted entries loaded from the
+// source named src, see Loader.AddNamed. Entries of the presets, such
+// as AddCloudflare, have the source "preset".
+func (t *TrustedProxies) EntriesBySource(src string) []*net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rv := []*net.IPNet{}
+	for _, ipnet := range t.trustedCIDRs {
+		if t.sourceOf(ipnet) == src {
+			rv = append(rv, copyNet(ipnet))
+		}
+	}
+	return rv
+}
+
+// sourceOf returns the source of a trusted entry, if any
+func (t *TrustedProxies) sourceOf(ipnet *net.IPNet) string {
+	if m, ok := t.meta[ipnet]; ok {
+		return m.source
+	}
+	return ""
+}
+
+// parseSpec parses a specification as accepted by AddFromString into
+// the trusted ranges and the ranges excluded from them
+func parseSpec(s string) ([]*net.IPNet, []*net.IPNet, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidIPSpecification, s)
+	}
+
+	nets, err := netsFromString(fields[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	denied := []*net.IPNet{}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "!") {
+			return nil, nil, fmt.Errorf("%w: %s (exclusions must start with '!')", ErrInvalidIPSpecification, field)
+		}
+		excluded, err := netsFromString(field[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ipnet := range excluded {
+			if !withinNets(nets, ipnet) {
+				return nil, nil, fmt.Errorf("%w: %s is not within %s", ErrInvalidIPSpecification, ipnet, fields[0])
+			}
+		}
+		denied = append(denied, excluded...)
+	}
+	return nets, denied, nil
+}
+
+// withoutPorts returns s with the ports removed from every field in
+// host:port form, e.g. "10.0.0.1:8080" or "[2001:db8::1]:443". The bool
+// is false if there are none.
+func withoutPorts(s string) (string, bool) {
+	fields := strings.Fields(s)
+	found := false
+	for idx, field := range fields {
+		prefix := ""
+		if strings.HasPrefix(field, "!") {
+			prefix, field = "!", field[1:]
+		}
+		host, port, err := net.SplitHostPort(field)
+		if err != nil || net.ParseIP(host) == nil {
+			continue
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			continue
+		}
+		fields[idx] = prefix + host
+		found = true
+	}
+	return strings.Join(fields, " "), found
+}
+
+// netsFromString parses an IP, a CIDR or a range of the form
+// "start-end" into the networks covering it
+func netsFromString(s string) ([]*net.IPNet, error) {
+	if strings.Contains(s, "-") {
+		return netsFromRange(s)
+	}
 	ipnet, err := netFromIPOrCIDR(s)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	return []*net.IPNet{ipnet}, nil
+}
+
+// netsFromRange parses a range of the form "192.0.2.10-192.0.2.20" into
+// the smallest list of networks covering exactly that range. For IPv4,
+// the end can be given as just its last octet, e.g. "192.0.2.10-20".
+func netsFromRange(s string) ([]*net.IPNet, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if parts[1] != "" && isDigits(parts[1]) {
+		return netsFromLastOctetRange(s, parts[0], parts[1])
+	}
+	start, end := net.ParseIP(parts[0]), net.ParseIP(parts[1])
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIPSpecification, s)
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, fmt.Errorf("%w: %s (mixed address families)", ErrInvalidIPSpecification, s)
+	}
+	if ipv4 := start.To4(); ipv4 != nil {
+		start, end = ipv4, end.To4()
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("%w: %s (end is before start)", ErrInvalidIPSpecification, s)
+	}
+	return rangeToNets(start, end), nil
+}
+
+// netsFromLastOctetRange parses the range s of the form "192.0.2.10-20",
+// given as its start and the last octet of its end
+func netsFromLastOctetRange(s, start, lastOctet string) ([]*net.IPNet, error) {
+	ipv4 := net.ParseIP(start).To4()
+	if ipv4 == nil || strings.Contains(start, ":") {
+		return nil, fmt.Errorf("%w: %s (last octet range requires an IPv4 start)", ErrInvalidIPSpecification, s)
+	}
+	octet, err := strconv.ParseUint(lastOctet, 10, 8)
+	if err != nil || (len(lastOctet) > 1 && lastOctet[0] == '0') {
+		return nil, fmt.Errorf("%w: %s (invalid last octet)", ErrInvalidIPSpecification, s)
+	}
+	if byte(octet) < ipv4[3] {
+		return nil, fmt.Errorf("%w: %s (end is before start)", ErrInvalidIPSpecification, s)
 	}
-	t.trustedCIDRs = append(t.trustedCIDRs, ipnet)
+	end := make(net.IP, net.IPv4len)
+	copy(end, ipv4)
+	end[3] = byte(octet)
+	return rangeToNets(ipv4, end), nil
+}
+
+// withinNets reports whether ipnet is entirely within nets, which must
+// be contiguous
+func withinNets(nets []*net.IPNet, ipnet *net.IPNet) bool {
+	first, last := Bounds(ipnet)
+	if first == nil {
+		return false
+	}
+	firstFound, lastFound := false, false
+	for _, n := range nets {
+		_, nBits := n.Mask.Size()
+		_, bits := ipnet.Mask.Size()
+		if nBits != bits {
+			continue
+		}
+		firstFound = firstFound || n.Contains(first)
+		lastFound = lastFound || n.Contains(last)
+	}
+	return firstFound && lastFound
+}
+
+// DenyFromString adds an IP, CIDR or range (see AddFromString) to the
+// deny list. Denied addresses are never trusted, even if they fall
+// within a trusted range. In particular, if the exact same network is
+// both trusted and denied, it is denied; Validate reports such
+// conflicts.
+func (t *TrustedProxies) DenyFromString(s string) error {
+	nets, err := netsFromString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deny(nets...)
 	return nil
 }
 
-// IsIPTrusted checks if a given IP is trusted. Returns the matching
-// net.IPNet or nil if there is no match
-func (t *TrustedProxies) IsIPTrusted(ip *net.IP) *net.IPNet {
+// deny adds nets to the deny list. Single addresses are kept in a map
+// so that long lists of them can be checked quickly.
+func (t *TrustedProxies) deny(nets ...*net.IPNet) {
+	for _, ipnet := range nets {
+		if ones, bits := ipnet.Mask.Size(); ones == bits {
+			if t.deniedIPs == nil {
+				t.deniedIPs = map[string]struct{}{}
+			}
+			t.deniedIPs[string(ipnet.IP.To16())] = struct{}{}
+			continue
+		}
+		t.deniedCIDRs = append(t.deniedCIDRs, ipnet)
+	}
+}
+
+// ReplaceFromStrings replaces the entire configuration, including the
+// deny list, with the given specifications (as accepted by
+// AddFromString). Either all specifications are applied or, if any of
+// them fails to parse, the current configuration is left untouched and
+// an error listing every failure is returned.
+func (t *TrustedProxies) ReplaceFromStrings(specs []string) error {
+	n, err := t.parseSpecs(specs)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	t.replaceWith(n)
+	return nil
+}
+
+// parseSpecs builds a new TrustedProxies from specs. If any of them
+// fails to parse, an error listing every failure is returned.
+func (t *TrustedProxies) parseSpecs(specs []string) (*TrustedProxies, error) {
+	n := t.staging()
+	errs := errorList{}
+	for _, spec := range specs {
+		if _, err := n.addFromString(spec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return n, nil
+}
+
+// staging returns an empty TrustedProxies to parse into before changing
+// t, with the options affecting parsing copied from t
+func (t *TrustedProxies) staging() *TrustedProxies {
+	n := New()
+	n.warnOnIgnoredPort = t.warnOnIgnoredPort
+	return n
+}
+
+// clone returns a copy of the configuration of t: the entries, the deny
+// list and the options. Statistics and history aren't copied.
+func (t *TrustedProxies) clone() *TrustedProxies {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := New()
+	n.trustedCIDRs = append(n.trustedCIDRs, t.trustedCIDRs...)
+	n.deniedCIDRs = append(n.deniedCIDRs, t.deniedCIDRs...)
+	for key := range t.deniedIPs {
+		n.deniedIPs[key] = struct{}{}
+	}
+	for ipnet, m := range t.meta {
+		// Not a struct copy, the match statistics are updated concurrently
+		c := &entryMeta{label: m.label, spec: m.spec, source: m.source, added: m.added, expires: m.expires}
+		if m.ports != nil {
+			c.ports = map[int]bool{}
+			for port, ok := range m.ports {
+				c.ports[port] = ok
+			}
+		}
+		n.meta[ipnet] = c
+	}
+	if t.distrusted != nil {
+		n.distrusted = map[string]window{}
+		for key, w := range t.distrusted {
+			n.distrusted[key] = w
+		}
+	}
+	if t.history != nil {
+		n.history = newHistory(len(t.history.results))
+	}
+
+	n.skipBogonsInHeader = t.skipBogonsInHeader
+	n.maxHops = t.maxHops
+	n.detectFamilyMismatch = t.detectFamilyMismatch
+	n.warnIfUnconfigured = t.warnIfUnconfigured
+	n.trustedCertFingerprints = t.trustedCertFingerprints
+	n.keepCanonical = t.keepCanonical
+	n.policy = t.policy
+	n.now = t.now
+	n.hasTTL = t.hasTTL
+	n.quoteAwareHeader = t.quoteAwareHeader
+	n.tokenizer = t.tokenizer
+	n.leftmostWhenTrusted = t.leftmostWhenTrusted
+	n.verifyMatch = t.verifyMatch
+	n.warnOnIgnoredPort = t.warnOnIgnoredPort
+	n.warnOnPrivateClient = t.warnOnPrivateClient
+	n.exempt = t.exempt
+	n.trackMatches = t.trackMatches
+	return n
+}
+
+// ApplyDelta changes the configuration to match newSpecs, the same as
+// ReplaceFromStrings would, but only adds and removes the entries that
+// differ. Entries that remain are kept as they are (the same *net.IPNet
+// values, with their match statistics, see UnusedEntries), which
+// avoids churn when reloading large lists. Either all
+// specifications are applied or, on error, none of them.
+func (t *TrustedProxies) ApplyDelta(newSpecs []string) error {
+	n, err := t.parseSpecs(newSpecs)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+
+	// Entries present in both the old and the new list are reused
+	existing := map[string][]*net.IPNet{}
+	for _, ipnet := range t.trustedCIDRs {
+		key := t.entryKey(ipnet)
+		existing[key] = append(existing[key], ipnet)
+	}
+
+	meta := make(map[*net.IPNet]*entryMeta, len(n.trustedCIDRs))
+	result := t.trustedCIDRs[:0]
+	for _, ipnet := range n.trustedCIDRs {
+		entry := ipnet
+		key := n.entryKey(ipnet)
+		if old := existing[key]; len(old) > 0 {
+			entry = old[0]
+			existing[key] = old[1:]
+		}
+		m := n.meta[ipnet]
+		if old, ok := t.meta[entry]; ok && m != nil && entry != ipnet {
+			// Kept entries keep their match statistics
+			m.hits = atomic.LoadUint64(&old.hits)
+			m.lastHit = atomic.LoadInt64(&old.lastHit)
+		}
+		meta[entry] = m
+		result = append(result, entry)
+	}
+	// Clear the now unused tail so removed entries can be collected
+	for idx := len(result); idx < len(t.trustedCIDRs); idx++ {
+		t.trustedCIDRs[idx] = nil
+	}
+
+	t.trustedCIDRs = result
+	t.meta = meta
+	t.deniedCIDRs = n.deniedCIDRs
+	t.deniedIPs = n.deniedIPs
+	return nil
+}
+
+// entryKey identifies a trusted entry by its network and specification
+func (t *TrustedProxies) entryKey(ipnet *net.IPNet) string {
+	spec := ""
+	if m, ok := t.meta[ipnet]; ok {
+		spec = m.spec
+	}
+	return ipnet.String() + "\x00" + spec
+}
+
+// RemoveFromString removes the trusted entries for an IP, CIDR or range
+// (see AddFromString). It returns ErrNoSuchEntry if nothing was removed.
+func (t *TrustedProxies) RemoveFromString(s string) error {
+	nets, err := netsFromString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	kept := t.trustedCIDRs[:0]
+	removed := 0
 	for _, ipnet := range t.trustedCIDRs {
-		if ipnet.Contains(*ip) {
-			return ipnet
+		if netIn(ipnet, nets) {
+			delete(t.meta, ipnet)
+			removed++
+			continue
 		}
+		kept = append(kept, ipnet)
+	}
+	for idx := len(kept); idx < len(t.trustedCIDRs); idx++ {
+		t.trustedCIDRs[idx] = nil
+	}
+	t.trustedCIDRs = kept
+
+	if removed == 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchEntry, s)
 	}
 	return nil
 }
 
+// netIn reports whether nets holds a network equal to ipnet
+func netIn(ipnet *net.IPNet, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if sameNet(canonicalNet(ipnet), canonicalNet(n)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unconfigured reports whether nothing can be trusted, see
+// WarnIfUnconfigured
+func (t *TrustedProxies) unconfigured() bool {
+	return len(t.trustedCIDRs) == 0 && t.policy == nil && len(t.trustedCertFingerprints) == 0
+}
+
+// replaceWith replaces the configured entries with those of n
+func (t *TrustedProxies) replaceWith(n *TrustedProxies) {
+	t.trustedCIDRs = n.trustedCIDRs
+	t.deniedCIDRs = n.deniedCIDRs
+	t.deniedIPs = n.deniedIPs
+	t.meta = n.meta
+}
+
+// IsIPTrusted checks if a given IP is trusted. Returns (a copy of) the
+// matching net.IPNet or nil if there is no match. Denied, temporarily
+// distrusted and expired entries are never trusted, here or by any
+// other lookup or deduction.
+func (t *TrustedProxies) IsIPTrusted(ip *net.IP) *net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return copyNet(t.effectiveTrust(*ip, t.lookupTime()))
+}
+
+// isDenied checks if a given IP is on the deny list
+func (t *TrustedProxies) isDenied(ip net.IP) bool {
+	if len(t.deniedIPs) > 0 {
+		if _, ok := t.deniedIPs[string(ip.To16())]; ok {
+			return true
+		}
+	}
+	for _, ipnet := range t.deniedCIDRs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIPv4Trusted checks if the IPv4 address ip is trusted. Unlike
+// IsIPTrusted, it takes a fixed-size array and does not allocate, which
+// may matter in very hot paths.
+func (t *TrustedProxies) IsIPv4Trusted(ip [4]byte) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.effectiveTrust(net.IP(ip[:]), t.lookupTime()) != nil
+}
+
+// IsIPv6Trusted checks if the IPv6 address ip is trusted. Unlike
+// IsIPTrusted, it takes a fixed-size array and does not allocate, which
+// may matter in very hot paths. IPv4-mapped addresses are matched
+// against IPv4 entries.
+func (t *TrustedProxies) IsIPv6Trusted(ip [16]byte) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.effectiveTrust(net.IP(ip[:]), t.lookupTime()) != nil
+}
+
+// IsBytesTrusted checks if the IP given as raw bytes, e.g. as read from
+// a binary protocol, is trusted. b must be a 4-byte IPv4 or a 16-byte
+// IPv6 address, otherwise an error wrapping ErrInvalidIPSpecification is
+// returned. Like IsIPv6Trusted, IPv4-mapped addresses are matched
+// against IPv4 entries.
+func (t *TrustedProxies) IsBytesTrusted(b []byte) (bool, error) {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return false, fmt.Errorf("%w: %d bytes, want %d or %d", ErrInvalidIPSpecification, len(b), net.IPv4len, net.IPv6len)
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.effectiveTrust(net.IP(b), t.lookupTime()) != nil, nil
+}
+
+// IsTrustedNetAddr checks if the IP of addr is trusted. addr can be a
+// *net.TCPAddr, *net.UDPAddr or *net.IPAddr, as returned by e.g.
+// net.Conn.RemoteAddr or net.PacketConn.ReadFrom. Any other kind of
+// address is never trusted.
+func (t *TrustedProxies) IsTrustedNetAddr(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.IPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	default:
+		return false
+	}
+	if ip == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.effectiveTrust(ip, t.lookupTime()) != nil
+}
+
+// IsIPTrustedExcluding works like IsIPTrusted, but ignores any configured
+// entry equal to exclude. This allows answering "would this IP still be
+// trusted without that entry?" without modifying the list.
+func (t *TrustedProxies) IsIPTrustedExcluding(ip net.IP, exclude *net.IPNet) *net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return copyNet(t.match(ip, exclude))
+}
+
+// effectiveTrust returns the first entry trusting ip at the given time,
+// or nil. It is what "trusted" means for every lookup, be it of a single
+// IP or of the hops of a chain: ip must be neither denied nor, at that
+// time, distrusted by DistrustTemporarily, the entry must be valid at
+// that time, see AddWithTTL, and VerifyMatch, if set, must accept it.
+// Entries restricted to specific ports are not considered. Lookups of
+// the current state pass lookupTime.
+func (t *TrustedProxies) effectiveTrust(ip net.IP, at time.Time) *net.IPNet {
+	return t.matchAt(ip, nil, anyPort, at)
+}
+
+// lookupTime returns the time lookups of the current state are made at.
+// It is the zero time if nothing depends on time, to spare reading the
+// clock.
+func (t *TrustedProxies) lookupTime() time.Time {
+	if t.hasTTL {
+		return t.clock()
+	}
+	return time.Time{}
+}
+
+// match works like effectiveTrust at lookupTime, but skips any entry
+// equal to exclude
+func (t *TrustedProxies) match(ip net.IP, exclude *net.IPNet) *net.IPNet {
+	return t.matchAt(ip, exclude, anyPort, t.lookupTime())
+}
+
+// matchForPort works like match, but also considers entries restricted
+// to port. With anyPort, only unrestricted entries are considered.
+func (t *TrustedProxies) matchForPort(ip net.IP, exclude *net.IPNet, port int) *net.IPNet {
+	return t.matchAt(ip, exclude, port, t.lookupTime())
+}
+
+// matchAt works like effectiveTrust, but skips any entry equal to
+// exclude and considers entries restricted to port
+func (t *TrustedProxies) matchAt(ip net.IP, exclude *net.IPNet, port int, at time.Time) *net.IPNet {
+	ipnet := t.peekAt(ip, exclude, port, at)
+	if ipnet != nil {
+		t.recordHit(ipnet)
+	}
+	return ipnet
+}
+
+// peekAt works like matchAt without recording a hit, for re-checking
+// IPs a lookup already matched, so they aren't counted twice
+func (t *TrustedProxies) peekAt(ip net.IP, exclude *net.IPNet, port int, at time.Time) *net.IPNet {
+	if t.isDenied(ip) || t.distrustedAt(ip, at) {
+		return nil
+	}
+	ipnet := t.firstMatch(ip, exclude, port, at)
+	if ipnet == nil {
+		return nil
+	}
+	if t.verifyMatch != nil && !t.verifyMatch(copyNet(ipnet), copyIP(ip)) {
+		return nil
+	}
+	return ipnet
+}
+
+// sameNet reports whether a and b describe the same network
+func sameNet(a, b *net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
+
+// containsNet reports whether inner is entirely within outer
+func containsNet(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
 func netFromIPOrCIDR(s string) (*net.IPNet, error) {
 	_, ipnet, err := net.ParseCIDR(s)
 	if err == nil {
@@ -58,22 +903,441 @@ func netFromIPOrCIDR(s string) (*net.IPNet, error) {
 	}
 
 	mask := net.CIDRMask(8*len(ip), 8*len(ip))
-	return &net.IPNet{ip, mask}, nil
+	return &net.IPNet{IP: ip, Mask: mask}, nil
 }
 
 // DeduceClientIP filters out untrusted information from the header
-// and returns the closest approximation of the client IP
+// and returns the closest approximation of the client IP. Returns nil
+// if no client IP can be determined (e.g. remoteAddr is nil)
+//
+// Some proxies append their own address to the header. If the rightmost
+// header entry equals remoteAddr, it is therefore ignored, so the peer
+// isn't counted twice (e.g. for MaxHops or DeduceResult.TrustedHops).
+// Any other trusted IP that is repeated in the chain is walked through
+// like any other trusted hop and counts as a hop, so the result is the
+// first untrusted hop beyond the repetitions. If there is none, the
+// result is the leftmost IP, which may be the proxy itself.
+//
+// The header entries are separated by commas. A header without commas
+// that consists of several IPs separated by whitespace, as sent by some
+// devices, is split at the whitespace instead. Line breaks and tabs, as
+// found in folded headers, separate entries, too.
+//
+// IPv4-mapped header entries, as sent by dual-stack proxies, match IPv4
+// entries regardless of the family of remoteAddr. An IPv4 client IP is
+// always returned in its 4-byte form, be it remoteAddr or a header
+// entry, mapped or not.
 func (t *TrustedProxies) DeduceClientIP(remoteAddr net.IP, header string) *net.IP {
-	trustedIPs := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
-	return trustedIPs[len(trustedIPs)-1]
+	ip := t.DeduceClientIPDetailed(remoteAddr, header).ClientIP
+	if ip == nil {
+		return nil
+	}
+	return &ip
+}
+
+// DeduceClientIPWithProxyProtocol works like DeduceClientIP for
+// connections using the PROXY protocol (e.g. from HAProxy), where the
+// actual source address is proxySrc, the one from the PROXY header, and
+// not the address of the connection. proxySrc takes the place of the
+// remote address: the header xff is only considered if proxySrc is
+// trusted.
+//
+// The PROXY header itself can't be verified here, so the listener must
+// only accept it from the load balancers sending it.
+func (t *TrustedProxies) DeduceClientIPWithProxyProtocol(proxySrc net.IP, xff string) *net.IP {
+	return t.DeduceClientIP(proxySrc, xff)
+}
+
+// DeduceClientIPFromCDNHeader returns the client IP for CDNs setting a
+// single header with the client's address, such as Akamai's
+// True-Client-IP or Fastly's Fastly-Client-IP. cdnIP, the value of that
+// header, is only believed if remoteAddr is trusted, i.e. the request
+// came from the CDN. Otherwise, or if cdnIP isn't an IP, remoteAddr is
+// the client. Like DeduceClientIP, it returns an IPv4 client IP in its
+// 4-byte form. Returns nil if remoteAddr is nil.
+func (t *TrustedProxies) DeduceClientIPFromCDNHeader(remoteAddr net.IP, cdnIP string) *net.IP {
+	if remoteAddr == nil {
+		return nil
+	}
+	t.mu.RLock()
+	trusted := t.trustedHop(remoteAddr, 0, anyPort)
+	t.mu.RUnlock()
+
+	if trusted {
+		if ip := net.ParseIP(strings.TrimSpace(cdnIP)); ip != nil {
+			ip = normalizeIP(ip)
+			return &ip
+		}
+	}
+	ip := copyIP(normalizeIP(remoteAddr))
+	return &ip
+}
+
+// OutermostUntrusted works like DeduceClientIP, but additionally reports
+// whether there is an untrusted hop. If false, every hop up to the
+// leftmost header entry was trusted and the returned IP is merely the
+// outermost one. A walk stopped short by MaxHops or an unparseable entry
+// counts as reaching an untrusted hop, since nothing further out is
+// known to be trusted.
+func (t *TrustedProxies) OutermostUntrusted(remoteAddr net.IP, header string) (*net.IP, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	chain := t.chainFor(remoteAddr, header)
+	trustedIPs := t.walkFrom(remoteAddr, chain, anyPort)
+	if len(trustedIPs) == 0 {
+		return nil, false
+	}
+	last := trustedIPs[len(trustedIPs)-1]
+	return lastHop(trustedIPs), last != chain[0] || !t.recheckHop(*last, len(trustedIPs)-1, anyPort)
+}
+
+// ClientIPOrDefault returns the deduced client IP as a string, or
+// fallback if no client IP can be determined
+func (t *TrustedProxies) ClientIPOrDefault(remoteAddr net.IP, header string, fallback string) string {
+	ip := t.DeduceClientIP(remoteAddr, header)
+	if ip == nil {
+		return fallback
+	}
+	return ip.String()
+}
+
+// VerifyClaimedIP reports whether claimed, e.g. an IP asserted by the
+// client itself, is the client IP deduced from remoteAddr and header.
+// IPv4 and IPv4-mapped IPv6 forms of the same address are considered
+// equal.
+func (t *TrustedProxies) VerifyClaimedIP(remoteAddr net.IP, header string, claimed net.IP) bool {
+	if claimed == nil {
+		return false
+	}
+	ip := t.DeduceClientIP(remoteAddr, header)
+	return ip != nil && ip.Equal(claimed)
+}
+
+// AgreeOn reports whether a and b deduce the same client IP from
+// remoteAddr and header, or both none, e.g. to test a configuration
+// change against recorded requests. Unlike DeduceClientIP, it doesn't
+// record history or observed hops.
+func AgreeOn(a, b *TrustedProxies, remoteAddr net.IP, header string) bool {
+	ipA, _ := a.OutermostUntrusted(remoteAddr, header)
+	ipB, _ := b.OutermostUntrusted(remoteAddr, header)
+	if ipA == nil || ipB == nil {
+		return ipA == nil && ipB == nil
+	}
+	return ipA.Equal(*ipB)
+}
+
+// ShouldExempt reports whether the client IP deduced from remoteAddr and
+// header is on the exempt list (see the ExemptList option), e.g. to skip
+// rate limiting for internal clients. Always false without an exempt
+// list.
+func (t *TrustedProxies) ShouldExempt(remoteAddr net.IP, header string) bool {
+	if t.exempt == nil {
+		return false
+	}
+	ip := t.DeduceClientIP(remoteAddr, header)
+	return ip != nil && t.exempt.IsIPTrusted(ip) != nil
+}
+
+// ChainMatchesTopology reports whether the trusted hops of a request,
+// i.e. the proxies walked through before reaching the client IP, are
+// exactly one per entry of expected and each within its entry. expected
+// is ordered like the header: from the outermost proxy to the peer the
+// request was received from. This is meant for validating deployments
+// against sample requests.
+func (t *TrustedProxies) ChainMatchesTopology(remoteAddr net.IP, header string, expected []*net.IPNet) bool {
+	t.mu.RLock()
+	walked := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
+	t.mu.RUnlock()
+
+	if len(walked) == 0 || len(walked)-1 != len(expected) {
+		return false
+	}
+	// walked starts at the peer and ends with the client
+	for idx, ipnet := range expected {
+		if !ipnet.Contains(*walked[len(walked)-2-idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireMinHops reports whether the request from remoteAddr passed
+// through at least min consecutive trusted proxies, remoteAddr included,
+// i.e. whether DeduceResult.TrustedHops would be at least min. This lets
+// endpoints reject requests that bypassed a tier of the proxy stack.
+func (t *TrustedProxies) RequireMinHops(remoteAddr net.IP, header string, min int) bool {
+	t.mu.RLock()
+	walked := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
+	t.mu.RUnlock()
+	return len(walked)-1 >= min
+}
+
+// AllHopsTrusted reports whether remoteAddr and every IP in header are
+// trusted, e.g. for endpoints only meant to be reached from within. An
+// unparseable header entry is untrusted. Unlike DeduceClientIP, it
+// doesn't stop at the first untrusted hop, and MaxHops doesn't apply.
+func (t *TrustedProxies) AllHopsTrusted(remoteAddr net.IP, header string) bool {
+	if remoteAddr == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ips := t.chainFor(remoteAddr, header)
+	for hop := 0; hop < len(ips); hop++ {
+		ip := *ips[len(ips)-1-hop]
+		if ip == nil || !t.trustedHop(ip, hop, anyPort) {
+			return false
+		}
+	}
+	return true
+}
+
+// SpoofRisk reports whether header holds entries an attacker may have
+// injected: the deduced client IP is an untrusted hop, and header holds
+// further entries in front of it. Those were written by the client (or
+// whoever it claims to have forwarded the request for), so they can be
+// arbitrary. This includes a header sent by an untrusted remoteAddr.
+// Requests whose chain is trusted up to the client, or entirely, aren't
+// at risk.
+func (t *TrustedProxies) SpoofRisk(remoteAddr net.IP, header string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	chain := t.chainFor(remoteAddr, header)
+	walked := t.walkFrom(remoteAddr, chain, anyPort)
+	if len(walked) == 0 {
+		return false
+	}
+	client := walked[len(walked)-1]
+	if t.recheckHop(*client, len(walked)-1, anyPort) {
+		return false
+	}
+	// With LeftmostWhenTrusted, the client is the leftmost entry
+	for idx, ip := range chain {
+		if ip == client {
+			return idx > 0
+		}
+	}
+	return false
+}
+
+// SanitizeHeader returns header rewritten for forwarding the request
+// from remoteAddr: the deduced client IP, followed by the trusted hops it
+// passed through, ending with remoteAddr, the way a proxy appends the
+// address it received a request from. Entries the client put in front
+// of its own address are dropped, as are unparseable ones. Returns ""
+// if no client IP can be determined.
+func (t *TrustedProxies) SanitizeHeader(remoteAddr net.IP, header string) string {
+	t.mu.RLock()
+	walked := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
+	t.mu.RUnlock()
+
+	// walked starts at remoteAddr and ends with the client
+	entries := make([]string, len(walked))
+	for idx, ip := range walked {
+		entries[len(walked)-1-idx] = ip.String()
+	}
+	return strings.Join(entries, ", ")
+}
+
+// MatchedRanges returns, for each trusted hop walked through by
+// DeduceClientIP, starting with remoteAddr, the trusted entry it
+// matched. The client IP the walk ends at isn't included, even if it is
+// trusted. Hops trusted by a Policy without matching any entry are
+// skipped, so the result never holds nil.
+func (t *TrustedProxies) MatchedRanges(remoteAddr net.IP, header string) []*net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	walked := t.filterOutIPsFromUntrustedSources(remoteAddr, header)
+	rv := []*net.IPNet{}
+	for idx := 0; idx < len(walked)-1; idx++ {
+		if ipnet := t.peekAt(*walked[idx], nil, anyPort, t.lookupTime()); ipnet != nil {
+			rv = append(rv, copyNet(ipnet))
+		}
+	}
+	return rv
+}
+
+// DeduceDualStack deduces the client IP separately from a header holding
+// the IPv4 chain and one holding the IPv6 chain, both received from
+// remoteAddr. v4 is nil unless the walk over v4Header ends at an IPv4
+// address, and likewise for v6.
+func (t *TrustedProxies) DeduceDualStack(remoteAddr net.IP, v4Header, v6Header string) (v4, v6 *net.IP) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if ips := t.filterOutIPsFromUntrustedSources(remoteAddr, v4Header); len(ips) > 0 {
+		if ip := lastHop(ips); ip.To4() != nil {
+			v4 = ip
+		}
+	}
+	if ips := t.filterOutIPsFromUntrustedSources(remoteAddr, v6Header); len(ips) > 0 {
+		if ip := lastHop(ips); ip.To4() == nil {
+			v6 = ip
+		}
+	}
+	return v4, v6
+}
+
+// DeduceFromChain applies the same walk as DeduceClientIP to a
+// caller-supplied list of hops, ordered from the edge (the client side)
+// to the peer the request was received from. Returns nil if no client
+// IP can be determined.
+func (t *TrustedProxies) DeduceFromChain(chain []net.IP) *net.IP {
+	ips := make([]*net.IP, 0, len(chain))
+	for _, ip := range chain {
+		ip := ip
+		ips = append(ips, &ip)
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return lastHop(t.walkChain(ips, anyPort, false))
+}
+
+// lastHop returns a copy of the last of the walked ips, in its 4-byte
+// form if it is IPv4 (see normalizeIP), or nil if there are none.
+// Callers get copies, so that changing them can't affect anything else,
+// such as the inputs or the recorded history.
+func lastHop(ips []*net.IP) *net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	ip := copyIP(normalizeIP(*ips[len(ips)-1]))
+	return &ip
+}
+
+// copyIP returns a copy of ip
+func copyIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	return append(net.IP(nil), ip...)
+}
+
+// normalizeIP returns ip in its 4-byte form if it is an IPv4 or an
+// IPv4-mapped IPv6 address, and as is otherwise
+func normalizeIP(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return ip
+}
+
+// copyNet returns a copy of ipnet, or nil if ipnet is nil
+func copyNet(ipnet *net.IPNet) *net.IPNet {
+	if ipnet == nil {
+		return nil
+	}
+	return &net.IPNet{IP: copyIP(ipnet.IP), Mask: append(net.IPMask(nil), ipnet.Mask...)}
+}
+
+// ClientIPExtractor gets the client IP from the value of a header using
+// a custom encoding, e.g. hex, base64 or a JWT claim, see
+// DeduceClientIPCustom
+type ClientIPExtractor func(headerValue string) (net.IP, error)
+
+// DeduceClientIPCustom returns the client IP for gateways propagating it
+// in a non-standard way. rawHeader is only believed if remoteAddr is
+// trusted, in which case extract gets the client IP from it. Otherwise,
+// remoteAddr is the client. Errors of extract are returned as they are,
+// and a nil IP is treated like an error. Returns nil if remoteAddr is
+// nil.
+func (t *TrustedProxies) DeduceClientIPCustom(remoteAddr net.IP, rawHeader string, extract ClientIPExtractor) (*net.IP, error) {
+	if remoteAddr == nil {
+		return nil, nil
+	}
+	t.mu.RLock()
+	trusted := t.trustedHop(remoteAddr, 0, anyPort)
+	t.mu.RUnlock()
+
+	if !trusted {
+		ip := copyIP(normalizeIP(remoteAddr))
+		return &ip, nil
+	}
+	ip, err := extract(rawHeader)
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("%w: no client IP in %q", ErrInvalidIPSpecification, rawHeader)
+	}
+	ip = copyIP(normalizeIP(ip))
+	return &ip, nil
 }
 
 func (t *TrustedProxies) filterOutIPsFromUntrustedSources(remoteAddr net.IP, header string) []*net.IP {
-	rv := []*net.IP{}
-	ips := headerToIPs(header)
+	return t.filterForPort(remoteAddr, header, anyPort)
+}
 
-	// We need to consider remoteAddr, too
-	ips = append(ips, &remoteAddr)
+// filterForPort works like filterOutIPsFromUntrustedSources, considering
+// entries valid for port (see matchForPort)
+func (t *TrustedProxies) filterForPort(remoteAddr net.IP, header string, port int) []*net.IP {
+	return t.walkFrom(remoteAddr, t.chainFor(remoteAddr, header), port)
+}
+
+// walkFrom walks the chain ips of a request from remoteAddr, as returned
+// by chainFor
+func (t *TrustedProxies) walkFrom(remoteAddr net.IP, ips []*net.IP, port int) []*net.IP {
+	return t.appendWalkFrom([]*net.IP{}, remoteAddr, ips, port)
+}
+
+// appendWalkFrom works like walkFrom, appending the walked IPs to dst
+func (t *TrustedProxies) appendWalkFrom(dst []*net.IP, remoteAddr net.IP, ips []*net.IP, port int) []*net.IP {
+	if t.leftmostWhenTrusted && len(ips) > 1 && remoteAddr != nil && t.trustedHop(remoteAddr, 0, port) {
+		// See LeftmostWhenTrusted: the peer vouches for the whole header
+		dst = append(dst, ips[len(ips)-1])
+		if *ips[0] != nil {
+			dst = append(dst, ips[0])
+		}
+		return dst
+	}
+	return t.appendWalk(dst, ips, port, false)
+}
+
+// chainFor returns the IPs in header followed by remoteAddr
+func (t *TrustedProxies) chainFor(remoteAddr net.IP, header string) []*net.IP {
+	return t.chainFrom(remoteAddr, t.parseHeader(header))
+}
+
+// chainFrom works like chainFor, given the parsed header, which is left
+// untouched
+func (t *TrustedProxies) chainFrom(remoteAddr net.IP, ips []*net.IP) []*net.IP {
+	return t.appendChain(nil, &remoteAddr, ips)
+}
+
+// appendChain works like chainFrom, appending the chain to dst, which
+// must not share its backing array with ips. remote points to the
+// remote address.
+func (t *TrustedProxies) appendChain(dst []*net.IP, remote *net.IP, ips []*net.IP) []*net.IP {
+	if t.skipBogonsInHeader {
+		ips = withoutBogons(ips)
+	}
+
+	// A peer that added itself to the header shouldn't be counted twice
+	if len(ips) > 0 && *remote != nil && ips[len(ips)-1].Equal(*remote) {
+		ips = ips[:len(ips)-1]
+	}
+
+	// We need to consider the remote address, too
+	if dst == nil {
+		dst = make([]*net.IP, 0, len(ips)+1)
+	}
+	dst = append(dst, ips...)
+	return append(dst, remote)
+}
+
+// walkChain walks ips from the end (the peer) towards the beginning (the
+// edge) as long as the IPs are trusted for port. Returns the walked IPs,
+// the last one being the first untrusted IP or the leftmost one. If
+// trustPeer is set, the last IP is trusted regardless of its address.
+func (t *TrustedProxies) walkChain(ips []*net.IP, port int, trustPeer bool) []*net.IP {
+	return t.appendWalk([]*net.IP{}, ips, port, trustPeer)
+}
+
+// appendWalk works like walkChain, appending the walked IPs to rv
+func (t *TrustedProxies) appendWalk(rv []*net.IP, ips []*net.IP, port int, trustPeer bool) []*net.IP {
+	if len(ips) == 0 {
+		return rv
+	}
+	walked := len(rv)
 
 	// Moving backwards!
 	idx := len(ips) - 1
@@ -84,7 +1348,11 @@ func (t *TrustedProxies) filterOutIPsFromUntrustedSources(remoteAddr net.IP, hea
 		}
 
 		rv = append(rv, ip)
-		if t.IsIPTrusted(ip) != nil {
+		if t.maxHops > 0 && len(rv)-walked > t.maxHops {
+			// We've walked as many trusted hops as we're allowed to
+			break
+		}
+		if (trustPeer && idx == len(ips)-1) || t.trustedHop(*ip, len(rv)-walked-1, port) {
 			idx--
 			if idx < 0 {
 				break
@@ -97,18 +1365,188 @@ func (t *TrustedProxies) filterOutIPsFromUntrustedSources(remoteAddr net.IP, hea
 	return rv
 }
 
-func headerToIPs(headerValue string) []*net.IP {
+// withoutBogons returns ips without the entries that are bogons.
+// Unparseable entries are kept.
+func withoutBogons(ips []*net.IP) []*net.IP {
 	rv := []*net.IP{}
-	items := strings.Split(headerValue, ",")
+	for _, ip := range ips {
+		if *ip != nil && IsBogon(*ip) {
+			continue
+		}
+		rv = append(rv, ip)
+	}
+	return rv
+}
+
+// parseIP parses header entries. It is a variable so tests can observe
+// parsing.
+var parseIP = net.ParseIP
+
+// headerToIPs splits headerValue at commas. Some devices separate the
+// entries with whitespace instead, so a header without commas made up of
+// several whitespace separated IPs is split at the whitespace. Line
+// breaks and tabs, as left by header folding, separate entries, too.
+func headerToIPs(headerValue string) []*net.IP {
+	if ips := spaceSeparatedIPs(headerValue); ips != nil {
+		return ips
+	}
 
-	if len(items) == 1 && strings.TrimSpace(items[0]) == "" {
+	ips := appendHeaderIPs(nil, nil, headerValue)
+	rv := make([]*net.IP, len(ips))
+	for idx := range ips {
+		rv[idx] = &ips[idx]
+	}
+	return rv
+}
+
+// appendHeaderIPs appends the IPs in headerValue, which is split at
+// commas, to dst. Unparseable entries are appended as nil. If backing
+// isn't nil, the IPs are parsed into it, see parseIPInto, rather than
+// allocated one by one.
+func appendHeaderIPs(dst []net.IP, backing *[]byte, headerValue string) []net.IP {
+	if strings.TrimSpace(headerValue) == "" {
+		return dst
+	}
+	for {
+		end := strings.IndexByte(headerValue, ',')
+		if end < 0 {
+			return appendFoldedIPs(dst, backing, headerValue)
+		}
+		dst = appendFoldedIPs(dst, backing, headerValue[:end])
+		headerValue = headerValue[end+1:]
+	}
+}
+
+// appendFoldedIPs appends the IPs in item, an entry between two commas,
+// to dst. Folded headers have line breaks and tabs between entries, so
+// they separate entries, too, but unlike commas never make for empty
+// ones. A bracketed IPv6 address can't hold any of them, so they are
+// always separators.
+func appendFoldedIPs(dst []net.IP, backing *[]byte, item string) []net.IP {
+	n := len(dst)
+	for {
+		end := strings.IndexAny(item, "\r\n\t")
+		field := item
+		if end >= 0 {
+			field = item[:end]
+		}
+		if field = strings.TrimSpace(field); field != "" {
+			dst = append(dst, parseFieldInto(backing, field))
+		}
+		if end < 0 {
+			break
+		}
+		item = item[end+1:]
+	}
+	if len(dst) == n {
+		// An empty entry, which stops the walk like any unparseable one
+		dst = append(dst, nil)
+	}
+	return dst
+}
+
+// parseFieldInto parses a header entry into backing, if it isn't nil, or
+// with parseIP
+func parseFieldInto(backing *[]byte, field string) net.IP {
+	if backing == nil {
+		return parseIP(field)
+	}
+	b, start := *backing, len(*backing)
+	if cap(b)-start < net.IPv6len {
+		// IPs parsed before keep the old array
+		b = append(b, make([]byte, net.IPv6len)...)[:start]
+	}
+	n, ok := parseIPInto(b[start:start+net.IPv6len], field)
+	if !ok {
+		return nil
+	}
+	*backing = b[:start+n]
+	return net.IP(b[start : start+n : start+n])
+}
+
+// spaceSeparatedIPs returns the IPs in headerValue if it holds no commas
+// and at least two whitespace separated fields, all of them IPs.
+// Otherwise, it returns nil.
+func spaceSeparatedIPs(headerValue string) []*net.IP {
+	if strings.Contains(headerValue, ",") || strings.IndexFunc(strings.TrimSpace(headerValue), unicode.IsSpace) < 0 {
+		return nil
+	}
+	fields := strings.Fields(headerValue)
+	if len(fields) < 2 {
+		return nil
+	}
+	rv := make([]*net.IP, len(fields))
+	for idx, field := range fields {
+		ip := parseIP(field)
+		if ip == nil {
+			return nil
+		}
+		rv[idx] = &ip
+	}
+	return rv
+}
+
+// parseHeader splits header into IPs, see QuoteAwareHeader and
+// HeaderTokenizer
+func (t *TrustedProxies) parseHeader(header string) []*net.IP {
+	if t.tokenizer != nil {
+		rv := []*net.IP{}
+		for _, token := range t.tokenizer(header) {
+			ip := parseIP(strings.TrimSpace(token))
+			rv = append(rv, &ip)
+		}
+		return rv
+	}
+	if t.quoteAwareHeader {
+		return quotedHeaderToIPs(header)
+	}
+	return headerToIPs(header)
+}
+
+// quotedHeaderToIPs works like headerToIPs, but doesn't split at commas
+// within double quotes. Quoted values are unquoted and may include a
+// port, e.g. "[2001:db8::1]:443".
+func quotedHeaderToIPs(headerValue string) []*net.IP {
+	rv := []*net.IP{}
+	if strings.TrimSpace(headerValue) == "" {
 		return rv
 	}
 
-	for _, val := range items {
-		val = strings.TrimSpace(val)
-		ip := net.ParseIP(val)
+	start, quoted := 0, false
+	for idx := 0; idx <= len(headerValue); idx++ {
+		if idx < len(headerValue) {
+			if headerValue[idx] == '"' {
+				quoted = !quoted
+			}
+			if quoted || headerValue[idx] != ',' {
+				continue
+			}
+		}
+		ip := parseQuotedIP(strings.TrimSpace(headerValue[start:idx]))
 		rv = append(rv, &ip)
+		start = idx + 1
 	}
 	return rv
 }
+
+// parseQuotedIP parses val, which may be a quoted IP, optionally with a
+// port. Returns nil if it can't be parsed.
+func parseQuotedIP(val string) net.IP {
+	if len(val) < 2 || val[0] != '"' || val[len(val)-1] != '"' {
+		return net.ParseIP(val)
+	}
+	val = val[1 : len(val)-1]
+	if ip := net.ParseIP(val); ip != nil {
+		return ip
+	}
+	if host, port, err := net.SplitHostPort(val); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err == nil {
+			return net.ParseIP(host)
+		}
+		return nil
+	}
+	if strings.HasPrefix(val, "[") && strings.HasSuffix(val, "]") {
+		return net.ParseIP(val[1 : len(val)-1])
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package trustedproxies
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -38,64 +41,1331 @@ func Test_netFromIPOrCIDR(t *testing.T) {
 	}
 }
 
+func Test_netsFromRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    []string
+		wantErr error
+	}{
+		{"Aligned", "192.0.2.0-192.0.2.255", []string{"192.0.2.0/24"}, nil},
+		{"Aligned, multiple blocks", "192.0.2.0-192.0.3.255", []string{"192.0.2.0/23"}, nil},
+		{"Unaligned", "192.0.2.10-192.0.2.20", []string{"192.0.2.10/31", "192.0.2.12/30", "192.0.2.16/30", "192.0.2.20/32"}, nil},
+		{"Single address", "192.0.2.10-192.0.2.10", []string{"192.0.2.10/32"}, nil},
+		{"Everything", "0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}, nil},
+		{"Crossing octets", "192.0.2.255-192.0.3.0", []string{"192.0.2.255/32", "192.0.3.0/32"}, nil},
+		{"IPv6", "2001:db8::1-2001:db8::6", []string{"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/127", "2001:db8::6/128"}, nil},
+		{"Reversed", "192.0.2.20-192.0.2.10", nil, ErrInvalidIPSpecification},
+		{"Mixed families", "192.0.2.10-2001:db8::1", nil, ErrInvalidIPSpecification},
+		{"Invalid start", "horse-192.0.2.10", nil, ErrInvalidIPSpecification},
+		{"Invalid end", "192.0.2.10-", nil, ErrInvalidIPSpecification},
+		{"Last octet", "10.0.0.1-50", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/28", "10.0.0.48/31", "10.0.0.50/32"}, nil},
+		{"Last octet, aligned", "192.0.2.0-255", []string{"192.0.2.0/24"}, nil},
+		{"Last octet, single address", "192.0.2.10-10", []string{"192.0.2.10/32"}, nil},
+		{"Last octet, reversed", "192.0.2.20-10", nil, ErrInvalidIPSpecification},
+		{"Last octet, out of bounds", "192.0.2.10-256", nil, ErrInvalidIPSpecification},
+		{"Last octet, leading zero", "192.0.2.1-050", nil, ErrInvalidIPSpecification},
+		{"Last octet, IPv6 start", "2001:db8::1-6", nil, ErrInvalidIPSpecification},
+		{"Last octet, invalid start", "192.0.2-10", nil, ErrInvalidIPSpecification},
+		{"Last octet, IPv4-mapped start", "::ffff:192.0.2.1-10", nil, ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := netsFromRange(tt.arg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("netsFromRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var got []string
+			for _, ipnet := range nets {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("netsFromRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func optimisticParseCIDR(s string) *net.IPNet {
 	_, ipnet, err := net.ParseCIDR(s)
 	fmt.Print(err)
 	return ipnet
 }
 
-func TestTrustedProxies(t *testing.T) {
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		TrustedIPs []string
+		IPToCheck  string
+		want       *net.IPNet
+	}{
+		{"Empty trust list, check ipv4", []string{}, "192.168.10.2", nil},
+		{"Empty trust list, check ipv6", []string{}, exampleIPv6Address, nil},
+		{"Match ipv4", []string{"192.168.10.10/24"}, "192.168.10.2", optimisticParseCIDR("192.168.10.10/24")},
+		{"Match ipv4, weird accepted ipnet", []string{"192.168.10.10/24", "this is not valid"}, "192.168.10.2", optimisticParseCIDR("192.168.10.10/24")},
+		{"Match ipv6", []string{exampleIPv6Address}, exampleIPv6Address, optimisticParseCIDR(exampleIPv6Address + "/128")},
+		{"No match", []string{"192.168.10.10/24"}, "192.168.11.2", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, spec := range tt.TrustedIPs {
+				tr.AddFromString(spec)
+			}
+			ip := net.ParseIP(tt.IPToCheck)
+
+			matchingIPNet := tr.IsIPTrusted(&ip)
+			if !reflect.DeepEqual(matchingIPNet, tt.want) {
+				t.Errorf("TrustedProxies.IsIPTrusted() = %v, wanted %v", matchingIPNet, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AddFromStringWithExclusions(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantErr   error
+		trusted   []string
+		untrusted []string
+	}{
+		{"Single exclusion", "10.0.0.0/8 !10.6.6.0/24", nil, []string{"10.0.0.1", "10.6.7.1"}, []string{"10.6.6.1", "10.6.6.255"}},
+		{"Multiple exclusions", "10.0.0.0/8 !10.6.6.0/24 !10.1.1.1", nil, []string{"10.0.0.1", "10.1.1.2"}, []string{"10.6.6.1", "10.1.1.1"}},
+		{"IPv6 exclusion", "2001:db8::/32 !2001:db8:1::/48", nil, []string{"2001:db8:2::1"}, []string{"2001:db8:1::1"}},
+		{"Exclusion without '!'", "10.0.0.0/8 10.6.6.0/24", ErrInvalidIPSpecification, []string{}, []string{"10.0.0.1", "10.6.6.1"}},
+		{"Invalid exclusion", "10.0.0.0/8 !horse", ErrInvalidIPSpecification, []string{}, []string{"10.0.0.1"}},
+		{"Exclusion outside range", "10.0.0.0/8 !192.168.0.0/24", ErrInvalidIPSpecification, []string{}, []string{"10.0.0.1"}},
+		{"Last octet range", "10.0.0.1-50 !10.0.0.7", nil, []string{"10.0.0.1", "10.0.0.50"}, []string{"10.0.0.0", "10.0.0.7", "10.0.0.51"}},
+		{"Malformed last octet range", "10.0.0.1-5x", ErrInvalidIPSpecification, []string{}, []string{"10.0.0.1"}},
+		{"Empty", " ", ErrInvalidIPSpecification, []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			if err := tr.AddFromString(tt.spec); !errors.Is(err, tt.wantErr) {
+				t.Errorf("TrustedProxies.AddFromString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, s := range tt.trusted {
+				ip := net.ParseIP(s)
+				if tr.IsIPTrusted(&ip) == nil {
+					t.Errorf("%v should be trusted", s)
+				}
+			}
+			for _, s := range tt.untrusted {
+				ip := net.ParseIP(s)
+				if tr.IsIPTrusted(&ip) != nil {
+					t.Errorf("%v should not be trusted", s)
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AddFromStringRange(t *testing.T) {
+	tr := New()
+	if err := tr.AddFromString("192.0.2.10-192.0.2.20 !192.0.2.12-192.0.2.13"); err != nil {
+		t.Fatalf("TrustedProxies.AddFromString() error = %v", err)
+	}
+	for _, s := range []string{"192.0.2.10", "192.0.2.11", "192.0.2.14", "192.0.2.20"} {
+		ip := net.ParseIP(s)
+		if tr.IsIPTrusted(&ip) == nil {
+			t.Errorf("%v should be trusted", s)
+		}
+	}
+	for _, s := range []string{"192.0.2.9", "192.0.2.12", "192.0.2.13", "192.0.2.21"} {
+		ip := net.ParseIP(s)
+		if tr.IsIPTrusted(&ip) != nil {
+			t.Errorf("%v should not be trusted", s)
+		}
+	}
+	if spec, _ := tr.MatchedSpec(net.ParseIP("192.0.2.20")); spec != "192.0.2.10-192.0.2.20 !192.0.2.12-192.0.2.13" {
+		t.Errorf("TrustedProxies.MatchedSpec() = %v", spec)
+	}
+
+	if err := tr.AddFromString("192.0.2.30-192.0.2.40 !192.0.2.39-192.0.2.41"); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.AddFromString() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	if err := tr.AddFromString("192.0.2.40-192.0.2.30"); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.AddFromString() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+}
+
+func TestTrustedProxies_AddFromStringWithPort(t *testing.T) {
+	tests := []struct {
+		spec        string
+		trusted     string
+		wantWarning bool
+		wantErr     error
+	}{
+		{"10.0.0.1:8080", "10.0.0.1", true, nil},
+		{"[2001:db8::1]:443", "2001:db8::1", true, nil},
+		{"10.0.0.0/8 !10.6.6.6:80", "10.6.6.7", true, nil},
+		{"2001:db8::1", "2001:db8::1", false, nil},
+		{"10.0.0.1", "10.0.0.1", false, nil},
+		{"10.0.0.1:http", "", false, ErrInvalidIPSpecification},
+		{"10.0.0.1:99999", "", false, ErrInvalidIPSpecification},
+		{"horse:80", "", false, ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			warnings := []string{}
+			tr := New(WarnOnIgnoredPort(func(spec string) {
+				warnings = append(warnings, spec)
+			}))
+			err := tr.AddFromString(tt.spec)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrustedProxies.AddFromString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := len(warnings) > 0; got != tt.wantWarning {
+				t.Errorf("WarnOnIgnoredPort() called = %v, want %v", got, tt.wantWarning)
+			}
+			if tt.trusted != "" {
+				ip := net.ParseIP(tt.trusted)
+				if tr.IsIPTrusted(&ip) == nil {
+					t.Errorf("%v should be trusted", tt.trusted)
+				}
+			}
+		})
+	}
+
+	// The port is ignored even without a callback
+	tr := New()
+	if err := tr.AddFromString("10.0.0.1:8080"); err != nil {
+		t.Fatalf("TrustedProxies.AddFromString() error = %v", err)
+	}
+	if spec, _ := tr.MatchedSpec(net.ParseIP("10.0.0.1")); spec != "10.0.0.1:8080" {
+		t.Errorf("TrustedProxies.MatchedSpec() = %v, want %v", spec, "10.0.0.1:8080")
+	}
+}
+
+func TestTrustedProxies_DenyFromString(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	if err := tr.DenyFromString("10.6.6.6"); err != nil {
+		t.Fatalf("TrustedProxies.DenyFromString() error = %v", err)
+	}
+	if err := tr.DenyFromString("horse"); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.DenyFromString() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+
+	denied := net.ParseIP("10.6.6.6")
+	if got := tr.IsIPTrusted(&denied); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, wanted nil", got)
+	}
+	allowed := net.ParseIP("10.6.6.7")
+	if got := tr.IsIPTrusted(&allowed); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = nil, wanted a match")
+	}
+	if got := tr.DeduceClientIP(net.ParseIP("10.6.6.6"), "20.20.20.20"); got.String() != "10.6.6.6" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, wanted 10.6.6.6", got)
+	}
+}
+
+func TestTrustedProxies_MatchLabeled(t *testing.T) {
+	tests := []struct {
+		name          string
+		IPToCheck     string
+		wantLabel     string
+		wantPrefixLen int
+		wantOK        bool
+	}{
+		{"Labeled IPv4", "10.1.2.3", "internal", 8, true},
+		{"Labeled IPv6", "2001:db8::1", "cdn", 32, true},
+		{"Labeled single IP", "192.0.2.1", "lb", 32, true},
+		{"Unlabeled", "172.16.1.1", "", 12, true},
+		{"No match", "8.8.8.8", "", 0, false},
+	}
+	tr := New()
+	tr.AddLabeled("10.0.0.0/8", "internal")
+	tr.AddLabeled("2001:db8::/32", "cdn")
+	tr.AddLabeled("192.0.2.1", "lb")
+	tr.AddFromString("172.16.0.0/12")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			label, prefixLen, ok := tr.MatchLabeled(net.ParseIP(tt.IPToCheck))
+			if label != tt.wantLabel || prefixLen != tt.wantPrefixLen || ok != tt.wantOK {
+				t.Errorf("TrustedProxies.MatchLabeled() = %q, %v, %v, wanted %q, %v, %v",
+					label, prefixLen, ok, tt.wantLabel, tt.wantPrefixLen, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_MatchedSpec(t *testing.T) {
+	tests := []struct {
+		name       string
+		TrustedIPs []string
+		IPToCheck  string
+		want       string
+		wantOK     bool
+	}{
+		{"Bare IPv4", []string{"10.0.0.1"}, "10.0.0.1", "10.0.0.1", true},
+		{"Bare IPv6", []string{"2001:0db8::0001"}, "2001:db8::1", "2001:0db8::0001", true},
+		{"Unnormalized CIDR", []string{"10.0.0.5/24"}, "10.0.0.1", "10.0.0.5/24", true},
+		{"With exclusion", []string{"10.0.0.0/8 !10.6.6.0/24"}, "10.0.0.1", "10.0.0.0/8 !10.6.6.0/24", true},
+		{"Surrounding whitespace", []string{" 10.0.0.1 "}, "10.0.0.1", "10.0.0.1", true},
+		{"Second entry", []string{"10.0.0.1", "192.168.0.0/16"}, "192.168.1.1", "192.168.0.0/16", true},
+		{"No match", []string{"10.0.0.1"}, "10.0.0.2", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, spec := range tt.TrustedIPs {
+				tr.AddFromString(spec)
+			}
+			got, ok := tr.MatchedSpec(net.ParseIP(tt.IPToCheck))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("TrustedProxies.MatchedSpec() = %q, %v, wanted %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ReplaceFromStrings(t *testing.T) {
+	tests := []struct {
+		name      string
+		specs     []string
+		wantErr   []string
+		trusted   []string
+		untrusted []string
+	}{
+		{"Success", []string{"192.168.0.0/16", "172.16.0.0/12 !172.16.6.0/24"}, nil,
+			[]string{"192.168.1.1", "172.16.1.1"}, []string{"10.1.1.1", "172.16.6.1", "10.6.6.6"}},
+		{"Empty", []string{}, nil, []string{}, []string{"10.1.1.1", "192.168.1.1"}},
+		{"Single failure", []string{"192.168.0.0/16", "horse"}, []string{"horse"},
+			[]string{"10.1.1.1"}, []string{"10.6.6.6", "192.168.1.1"}},
+		{"Multiple failures", []string{"cow", "192.168.0.0/16", "horse"}, []string{"cow", "horse"},
+			[]string{"10.1.1.1"}, []string{"10.6.6.6", "192.168.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			tr.AddFromString("10.0.0.0/8 !10.6.6.0/24")
+
+			err := tr.ReplaceFromStrings(tt.specs)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("TrustedProxies.ReplaceFromStrings() error = %v", err)
+			}
+			if len(tt.wantErr) > 0 {
+				if !errors.Is(err, ErrInvalidIPSpecification) {
+					t.Errorf("TrustedProxies.ReplaceFromStrings() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+				}
+				for _, want := range tt.wantErr {
+					if err == nil || !strings.Contains(err.Error(), want) {
+						t.Errorf("TrustedProxies.ReplaceFromStrings() error = %v, should mention %v", err, want)
+					}
+				}
+			}
+			for _, s := range tt.trusted {
+				ip := net.ParseIP(s)
+				if tr.IsIPTrusted(&ip) == nil {
+					t.Errorf("%v should be trusted", s)
+				}
+			}
+			for _, s := range tt.untrusted {
+				ip := net.ParseIP(s)
+				if tr.IsIPTrusted(&ip) != nil {
+					t.Errorf("%v should not be trusted", s)
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ReplaceFromStringsConcurrently(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tr.ReplaceFromStrings([]string{"10.0.0.0/8", "192.168.0.0/16"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if got := tr.DeduceClientIP(net.ParseIP("10.1.1.1"), "20.20.20.20"); got.String() != "20.20.20.20" {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want 20.20.20.20", got)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestTrustedProxies_MatchIndex(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"192.168.1.1", 0},
+		{"10.1.2.3", 1},
+		{"10.6.6.6", -1},
+		{"2001:db8::1", 2},
+		{"10.0.0.1", 1},
+		{"172.16.0.1", -1},
+		{"8.8.8.8", -1},
+	}
+	tr := New()
+	tr.AddFromString("192.168.0.0/16")
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("2001:db8::/32")
+	tr.AddForPorts("172.16.0.1", 443)
+	tr.AddFromString("10.0.0.1")
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got := tr.MatchIndex(net.ParseIP(tt.ip))
+			if got != tt.want {
+				t.Fatalf("TrustedProxies.MatchIndex() = %v, want %v", got, tt.want)
+			}
+			if got >= 0 && !tr.TrustedCIDRs()[got].Contains(net.ParseIP(tt.ip)) {
+				t.Errorf("TrustedProxies.TrustedCIDRs()[%v] = %v", got, tr.TrustedCIDRs()[got])
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_EntryTrusting(t *testing.T) {
+	tests := []struct {
+		ip     string
+		want   string
+		wantOk bool
+	}{
+		{"10.1.2.3", "10.1.0.0/16", true},
+		{"10.1.2.4", "10.1.2.4/32", true},
+		{"10.9.9.9", "10.0.0.0/8", true},
+		{"10.6.6.6", "<nil>", false},
+		{"::ffff:10.1.2.3", "10.1.0.0/16", true},
+		{"2001:db8:1::1", "2001:db8:1::/48", true},
+		{"2001:db8:2::1", "2001:db8::/32", true},
+		{"172.16.0.1", "<nil>", false},
+		{"8.8.8.8", "<nil>", false},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("10.1.0.0/16")
+	tr.AddFromString("10.1.2.4")
+	tr.AddFromString("2001:db8::/32")
+	tr.AddFromString("2001:db8:1::/48")
+	tr.AddForPorts("172.16.0.1", 443)
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got, ok := tr.EntryTrusting(net.ParseIP(tt.ip))
+			if fmt.Sprint(got) != tt.want || ok != tt.wantOk {
+				t.Errorf("TrustedProxies.EntryTrusting() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	// Removing the culprits one by one eventually distrusts the IP
+	ip := net.ParseIP("10.1.2.4")
+	for _, want := range []string{"10.1.2.4/32", "10.1.0.0/16", "10.0.0.0/8"} {
+		got, ok := tr.EntryTrusting(ip)
+		if !ok || got.String() != want {
+			t.Fatalf("TrustedProxies.EntryTrusting() = %v, %v, want %v, true", got, ok, want)
+		}
+		if err := tr.RemoveFromString(got.String()); err != nil {
+			t.Fatalf("TrustedProxies.RemoveFromString() error = %v", err)
+		}
+	}
+	if got, ok := tr.EntryTrusting(ip); ok {
+		t.Errorf("TrustedProxies.EntryTrusting() = %v, %v after removing all culprits", got, ok)
+	}
+}
+
+func TestTrustedProxies_IsIPv4TrustedAndIsIPv6Trusted(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("2001:db8::/32")
+	tr.AddFromString("192.168.1.1")
+
+	for _, s := range []string{"10.1.2.3", "10.6.6.6", "192.168.1.1", "192.168.1.2", "8.8.8.8", "2001:db8::1", "2001:db9::1", "::ffff:10.1.2.3", "::1"} {
+		ip := net.ParseIP(s)
+		want := tr.IsIPTrusted(&ip) != nil
+
+		var v6 [16]byte
+		copy(v6[:], ip.To16())
+		if got := tr.IsIPv6Trusted(v6); got != want {
+			t.Errorf("TrustedProxies.IsIPv6Trusted(%v) = %v, want %v", s, got, want)
+		}
+
+		if ipv4 := ip.To4(); ipv4 != nil {
+			var v4 [4]byte
+			copy(v4[:], ipv4)
+			if got := tr.IsIPv4Trusted(v4); got != want {
+				t.Errorf("TrustedProxies.IsIPv4Trusted(%v) = %v, want %v", s, got, want)
+			}
+		}
+	}
+
+	v4 := [4]byte{10, 1, 2, 3}
+	v6 := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	if allocs := testing.AllocsPerRun(100, func() { tr.IsIPv4Trusted(v4) }); allocs != 0 {
+		t.Errorf("TrustedProxies.IsIPv4Trusted() allocates %v times", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { tr.IsIPv6Trusted(v6) }); allocs != 0 {
+		t.Errorf("TrustedProxies.IsIPv6Trusted() allocates %v times", allocs)
+	}
+}
+
+func BenchmarkIsIPv4Trusted(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	ip := [4]byte{192, 168, 1, 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.IsIPv4Trusted(ip)
+	}
+}
+
+func BenchmarkIsIPv6Trusted(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	ip := [16]byte{0xfd, 15: 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.IsIPv6Trusted(ip)
+	}
+}
+
+func BenchmarkIsIPTrusted(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	ip := net.ParseIP("192.168.1.1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.IsIPTrusted(&ip)
+	}
+}
+
+func TestTrustedProxies_IsBytesTrusted(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    bool
+		wantErr bool
+	}{
+		{"Trusted IPv4", []byte{10, 1, 2, 3}, true, false},
+		{"Denied IPv4", []byte{10, 6, 6, 6}, false, false},
+		{"Untrusted IPv4", []byte{8, 8, 8, 8}, false, false},
+		{"Trusted IPv6", []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}, true, false},
+		{"Untrusted IPv6", []byte{0x20, 0x01, 0x0d, 0xb9, 15: 1}, false, false},
+		{"IPv4-mapped", []byte{10: 0xff, 11: 0xff, 12: 10, 13: 1, 14: 2, 15: 3}, true, false},
+		{"Empty", []byte{}, false, true},
+		{"Nil", nil, false, true},
+		{"Too short", []byte{10, 1, 2}, false, true},
+		{"Between lengths", make([]byte, 8), false, true},
+		{"Too long", make([]byte, 17), false, true},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("2001:db8::/32")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tr.IsBytesTrusted(tt.b)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidIPSpecification)) {
+				t.Errorf("TrustedProxies.IsBytesTrusted() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("TrustedProxies.IsBytesTrusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_IsTrustedNetAddr(t *testing.T) {
+	var nilTCPAddr *net.TCPAddr
+	tests := []struct {
+		name string
+		addr net.Addr
+		want bool
+	}{
+		{"Trusted TCP", &net.TCPAddr{IP: net.ParseIP("10.10.10.10"), Port: 443}, true},
+		{"Untrusted TCP", &net.TCPAddr{IP: net.ParseIP("20.20.20.20"), Port: 443}, false},
+		{"Trusted UDP", &net.UDPAddr{IP: net.ParseIP("10.10.10.10"), Port: 443}, true},
+		{"Untrusted UDP", &net.UDPAddr{IP: net.ParseIP("20.20.20.20"), Port: 443}, false},
+		{"Trusted IPv6 UDP", &net.UDPAddr{IP: net.ParseIP(exampleIPv6Address), Port: 443}, true},
+		{"Trusted IP", &net.IPAddr{IP: net.ParseIP("10.10.10.10")}, true},
+		{"Untrusted IP", &net.IPAddr{IP: net.ParseIP("20.20.20.20")}, false},
+		{"TCP without IP", &net.TCPAddr{Port: 443}, false},
+		{"Nil TCP", nilTCPAddr, false},
+		{"Unix", &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, false},
+		{"Nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			tr.AddFromString("10.10.10.10")
+			tr.AddFromString(exampleIPv6Address)
+			if got := tr.IsTrustedNetAddr(tt.addr); got != tt.want {
+				t.Errorf("TrustedProxies.IsTrustedNetAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DenySingleIPsAndCIDRs(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("2001:db8::/32")
+	tr.DenyFromString("10.1.1.1")
+	tr.DenyFromString("10.2.0.0/16")
+	tr.DenyFromString("2001:db8::1")
+	tr.DenyFromString("::ffff:10.3.3.3")
+	tr.DenyFromString("2001:db8:1::/48")
+
+	if len(tr.deniedIPs) != 3 || len(tr.deniedCIDRs) != 2 {
+		t.Errorf("Expected 3 single IP and 2 CIDR denials, got %d and %d", len(tr.deniedIPs), len(tr.deniedCIDRs))
+	}
+
+	for s, want := range map[string]bool{
+		"10.1.1.1":         false,
+		"::ffff:10.1.1.1":  false,
+		"10.1.1.2":         true,
+		"10.2.3.4":         false,
+		"10.3.3.3":         false,
+		"2001:db8::1":      false,
+		"2001:db8::2":      true,
+		"2001:db8:1::1":    false,
+		"2001:db8:2::1":    true,
+		"192.168.1.1":      false,
+		"::ffff:10.1.1.2":  true,
+		"2001:db8:0:0::01": false,
+	} {
+		ip := net.ParseIP(s)
+		if got := tr.IsIPTrusted(&ip) != nil; got != want {
+			t.Errorf("TrustedProxies.IsIPTrusted(%v) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func benchmarkDenied(b *testing.B, spec func(i int) string) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	for i := 0; i < 10000; i++ {
+		tr.DenyFromString(spec(i))
+	}
+	ip := net.ParseIP("10.200.200.200")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.IsIPTrusted(&ip)
+	}
+}
+
+func BenchmarkIsIPTrustedDeniedSingleIPs(b *testing.B) {
+	benchmarkDenied(b, func(i int) string { return fmt.Sprintf("10.0.%d.%d", i/256, i%256) })
+}
+
+func BenchmarkIsIPTrustedDeniedCIDRs(b *testing.B) {
+	benchmarkDenied(b, func(i int) string { return fmt.Sprintf("10.0.%d.%d/31", i/128, 2*(i%128)) })
+}
+
+func TestTrustedProxies_ApplyDelta(t *testing.T) {
+	oldSpecs := []string{"10.0.0.0/8 !10.6.6.0/24", "192.168.0.0/16", "172.16.0.0/12", "192.168.0.0/16"}
+	newSpecs := []string{"192.168.0.0/16", "203.0.113.0/24", "10.0.0.0/8 !10.6.6.0/24", "2001:db8::/32"}
+
+	tr := New()
+	tr.ReplaceFromStrings(oldSpecs)
+	before := map[string]*net.IPNet{}
+	for _, ipnet := range tr.trustedCIDRs {
+		if _, ok := before[ipnet.String()]; !ok {
+			before[ipnet.String()] = ipnet
+		}
+	}
+
+	if err := tr.ApplyDelta(newSpecs); err != nil {
+		t.Fatalf("TrustedProxies.ApplyDelta() error = %v", err)
+	}
+
+	fresh := New()
+	fresh.ReplaceFromStrings(newSpecs)
+	if got, want := trustedStrings(tr), trustedStrings(fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.ApplyDelta() = %v, want %v", got, want)
+	}
+	if got, want := tr.Fingerprint(), fresh.Fingerprint(); got != want {
+		t.Errorf("TrustedProxies.Fingerprint() = %v, want %v", got, want)
+	}
+	for _, ipnet := range tr.trustedCIDRs {
+		old, ok := before[ipnet.String()]
+		switch ipnet.String() {
+		case "192.168.0.0/16", "10.0.0.0/8":
+			if !ok || old != ipnet {
+				t.Errorf("Entry %v was not preserved", ipnet)
+			}
+		default:
+			if ok {
+				t.Errorf("Entry %v should be new", ipnet)
+			}
+		}
+		if spec, _ := tr.MatchedSpec(ipnet.IP); spec == "" {
+			t.Errorf("Entry %v lost its spec", ipnet)
+		}
+	}
+	if len(tr.meta) != len(tr.trustedCIDRs) {
+		t.Errorf("Metadata for %d entries, want %d", len(tr.meta), len(tr.trustedCIDRs))
+	}
+	denied := net.ParseIP("10.6.6.6")
+	if tr.IsIPTrusted(&denied) != nil {
+		t.Errorf("Exclusion was lost")
+	}
+}
+
+func TestTrustedProxies_ApplyDeltaError(t *testing.T) {
+	tr := New()
+	tr.ReplaceFromStrings([]string{"10.0.0.0/8"})
+	fingerprint := tr.Fingerprint()
+	if err := tr.ApplyDelta([]string{"192.168.0.0/16", "horse"}); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.ApplyDelta() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	if tr.Fingerprint() != fingerprint {
+		t.Errorf("TrustedProxies.ApplyDelta() changed the configuration on error")
+	}
+}
+
+func TestTrustedProxies_RemoveFromString(t *testing.T) {
+	tests := []struct {
+		name    string
+		remove  string
+		want    []string
+		wantErr error
+	}{
+		{"Single IP", "10.0.0.1", []string{"192.168.0.0/16", "192.0.2.10/31", "192.0.2.12/31"}, nil},
+		{"CIDR", "192.168.0.0/16", []string{"10.0.0.1/32", "192.0.2.10/31", "192.0.2.12/31"}, nil},
+		{"Range", "192.0.2.10-192.0.2.13", []string{"10.0.0.1/32", "192.168.0.0/16"}, nil},
+		{"IPv4-mapped", "::ffff:10.0.0.1", []string{"192.168.0.0/16", "192.0.2.10/31", "192.0.2.12/31"}, nil},
+		{"Not configured", "10.0.0.2", []string{"10.0.0.1/32", "192.168.0.0/16", "192.0.2.10/31", "192.0.2.12/31"}, ErrNoSuchEntry},
+		{"Contained but not equal", "192.168.1.0/24", []string{"10.0.0.1/32", "192.168.0.0/16", "192.0.2.10/31", "192.0.2.12/31"}, ErrNoSuchEntry},
+		{"Invalid", "horse", []string{"10.0.0.1/32", "192.168.0.0/16", "192.0.2.10/31", "192.0.2.12/31"}, ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			tr.ReplaceFromStrings([]string{"10.0.0.1", "192.168.0.0/16", "192.0.2.10-192.0.2.13"})
+			if err := tr.RemoveFromString(tt.remove); !errors.Is(err, tt.wantErr) {
+				t.Errorf("TrustedProxies.RemoveFromString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := trustedStrings(tr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.RemoveFromString() left %v, want %v", got, tt.want)
+			}
+			if len(tr.meta) != len(tr.trustedCIDRs) {
+				t.Errorf("Metadata for %d entries, want %d", len(tr.meta), len(tr.trustedCIDRs))
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_IsIPTrustedExcluding(t *testing.T) {
+	tests := []struct {
+		name       string
+		TrustedIPs []string
+		IPToCheck  string
+		exclude    *net.IPNet
+		want       *net.IPNet
+	}{
+		{"Nothing excluded", []string{"10.0.0.0/8"}, "10.1.2.3", nil, optimisticParseCIDR("10.0.0.0/8")},
+		{"Only match excluded", []string{"10.0.0.0/8"}, "10.1.2.3", optimisticParseCIDR("10.0.0.0/8"), nil},
+		{"Other match remains", []string{"10.0.0.0/8", "10.1.0.0/16"}, "10.1.2.3", optimisticParseCIDR("10.0.0.0/8"), optimisticParseCIDR("10.1.0.0/16")},
+		{"Unrelated exclusion", []string{"10.0.0.0/8"}, "10.1.2.3", optimisticParseCIDR("192.168.0.0/16"), optimisticParseCIDR("10.0.0.0/8")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, spec := range tt.TrustedIPs {
+				tr.AddFromString(spec)
+			}
+			got := tr.IsIPTrustedExcluding(net.ParseIP(tt.IPToCheck), tt.exclude)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.IsIPTrustedExcluding() = %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_headerToIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		headerValue string
+		want        []string
+	}{
+		{"Empty", "", []string{}},
+		{"Almost empty", " ", []string{}},
+		{"Single IP", "10.10.10.10", []string{"10.10.10.10"}},
+		{"Two IPs", "10.10.10.10, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
+		{"IP + nonsense + IP", "10.10.10.10, ugh, 20.20.20.20", []string{"10.10.10.10", "", "20.20.20.20"}},
+		{"IP + empty", "10.10.10.10, , 20.20.20.20", []string{"10.10.10.10", "", "20.20.20.20"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realWant := getRealWant(tt.want)
+			if got := headerToIPs(tt.headerValue); !reflect.DeepEqual(got, realWant) {
+				t.Errorf("headerToIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+func Test_quotedHeaderToIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		headerValue string
+		want        []string
+	}{
+		{"Empty", "", []string{}},
+		{"Almost empty", " ", []string{}},
+		{"Unquoted", "10.10.10.10, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
+		{"Quoted IP", `"10.10.10.10", 20.20.20.20`, []string{"10.10.10.10", "20.20.20.20"}},
+		{"Quoted IPv6 with port", `"[2001:db8::1]:443", 20.20.20.20`, []string{"2001:db8::1", "20.20.20.20"}},
+		{"Quoted IPv6 in brackets", `"[2001:db8::1]"`, []string{"2001:db8::1"}},
+		{"Quoted IPv4 with port", `"10.10.10.10:8080"`, []string{"10.10.10.10"}},
+		{"Quoted IP with invalid port", `"[2001:db8::1]:https"`, []string{""}},
+		{"Comma within quotes", `"10.10.10.10, 30.30.30.30", 20.20.20.20`, []string{"", "20.20.20.20"}},
+		{"Unterminated quote", `"10.10.10.10, 20.20.20.20`, []string{""}},
+		{"Nonsense", "10.10.10.10, ugh", []string{"10.10.10.10", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realWant := getRealWant(tt.want)
+			if got := quotedHeaderToIPs(tt.headerValue); !reflect.DeepEqual(got, realWant) {
+				t.Errorf("quotedHeaderToIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_QuoteAwareHeader(t *testing.T) {
+	header := `30.30.30.30, "[2001:db8::1]:443, via gateway", 20.20.20.20`
+
+	tr := New(QuoteAwareHeader())
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
+	if got := tr.DeduceClientIP(net.ParseIP("10.10.10.10"), header); got.String() != "20.20.20.20" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "20.20.20.20")
+	}
+	tr.AddFromString("2001:db8::1")
+	if got := tr.DeduceClientIP(net.ParseIP("10.10.10.10"), `30.30.30.30, "[2001:db8::1]:443", 20.20.20.20`); got.String() != "30.30.30.30" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "30.30.30.30")
+	}
+
+	// Without the option, the quoted value isn't understood
+	naive := New()
+	naive.AddFromString("10.10.10.10")
+	naive.AddFromString("20.20.20.20")
+	naive.AddFromString("2001:db8::1")
+	if got := naive.DeduceClientIP(net.ParseIP("10.10.10.10"), `30.30.30.30, "[2001:db8::1]:443", 20.20.20.20`); got.String() != "20.20.20.20" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "20.20.20.20")
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPWithProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxySrc string
+		xff      string
+		want     string
+	}{
+		{"trusted source", "10.0.0.1", "30.30.30.30", "30.30.30.30"},
+		{"trusted source and hops", "10.0.0.1", "30.30.30.30, 10.0.0.2", "30.30.30.30"},
+		{"untrusted source", "40.40.40.40", "30.30.30.30", "40.40.40.40"},
+		{"no header", "40.40.40.40", "", "40.40.40.40"},
+		{"no source", "", "30.30.30.30", "<nil>"},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.DeduceClientIPWithProxyProtocol(net.ParseIP(tt.proxySrc), tt.xff); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPWithProxyProtocol() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_RequireMinHops(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		min        int
+		want       bool
+	}{
+		{"full stack", "10.0.0.1", "30.30.30.30, 192.0.2.7", 2, true},
+		{"more than required", "10.0.0.1", "30.30.30.30, 192.0.2.7, 10.0.0.2", 2, true},
+		{"skipped a tier", "10.0.0.1", "30.30.30.30", 2, false},
+		{"untrusted in between", "10.0.0.1", "192.0.2.7, 30.30.30.30", 2, false},
+		{"untrusted peer", "30.30.30.30", "192.0.2.7, 10.0.0.2", 1, false},
+		{"no header", "10.0.0.1", "", 1, false},
+		{"no minimum", "30.30.30.30", "", 0, true},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("192.0.2.0/24")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.RequireMinHops(net.ParseIP(tt.remoteAddr), tt.header, tt.min); got != tt.want {
+				t.Errorf("TrustedProxies.RequireMinHops() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AllHopsTrusted(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"fully trusted", nil, "10.0.0.1", "192.0.2.7, 10.0.0.2", true},
+		{"no header", nil, "10.0.0.1", "", true},
+		{"untrusted client", nil, "10.0.0.1", "30.30.30.30, 192.0.2.7", false},
+		{"untrusted in between", nil, "10.0.0.1", "192.0.2.7, 30.30.30.30, 10.0.0.2", false},
+		{"untrusted peer", nil, "30.30.30.30", "192.0.2.7", false},
+		{"unparseable", nil, "10.0.0.1", "horse, 192.0.2.7", false},
+		{"max hops ignored", []Option{MaxHops(1)}, "10.0.0.1", "192.0.2.7, 10.0.0.2", true},
+		{"no remote address", nil, "", "192.0.2.7", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(tt.opts...)
+			tr.AddFromString("10.0.0.0/8")
+			tr.AddFromString("192.0.2.0/24")
+			if got := tr.AllHopsTrusted(net.ParseIP(tt.remoteAddr), tt.header); got != tt.want {
+				t.Errorf("TrustedProxies.AllHopsTrusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_SanitizeHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"multi-hop", "10.0.0.1", "30.30.30.30, 192.0.2.7, 10.0.0.2", "30.30.30.30, 192.0.2.7, 10.0.0.2, 10.0.0.1"},
+		{"spoofed entries", "10.0.0.1", "1.1.1.1, 2.2.2.2, 30.30.30.30, 192.0.2.7", "30.30.30.30, 192.0.2.7, 10.0.0.1"},
+		{"unparseable", "10.0.0.1", "1.1.1.1, horse, 192.0.2.7", "192.0.2.7, 10.0.0.1"},
+		{"normalized", "10.0.0.1", " 2001:0db8::1 ,192.0.2.7", "2001:db8::1, 192.0.2.7, 10.0.0.1"},
+		{"peer in header", "10.0.0.1", "30.30.30.30, 10.0.0.1", "30.30.30.30, 10.0.0.1"},
+		{"untrusted peer", "30.30.30.30", "1.1.1.1, 192.0.2.7", "30.30.30.30"},
+		{"no header", "10.0.0.1", "", "10.0.0.1"},
+		{"no remote address", "", "30.30.30.30", ""},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("192.0.2.0/24")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.SanitizeHeader(net.ParseIP(tt.remoteAddr), tt.header); got != tt.want {
+				t.Errorf("TrustedProxies.SanitizeHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_MatchedRanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       []string
+	}{
+		{"multi-tier", "10.0.0.1", "30.30.30.30, 192.0.2.7, 172.16.5.5", []string{"10.0.0.0/8", "172.16.0.0/12", "192.0.2.0/24"}},
+		{"stops at untrusted", "10.0.0.1", "192.0.2.7, 30.30.30.30, 172.16.5.5", []string{"10.0.0.0/8", "172.16.0.0/12"}},
+		{"repeated tier", "10.0.0.1", "30.30.30.30, 10.0.0.2", []string{"10.0.0.0/8", "10.0.0.0/8"}},
+		{"all trusted", "10.0.0.1", "172.16.5.5", []string{"10.0.0.0/8"}},
+		{"untrusted peer", "30.30.30.30", "172.16.5.5", []string{}},
+		{"no header", "10.0.0.1", "", []string{}},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("172.16.0.0/12")
+	tr.AddFromString("192.0.2.0/24")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, ipnet := range tr.MatchedRanges(net.ParseIP(tt.remoteAddr), tt.header) {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.MatchedRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPFromCDNHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		cdnIP      string
+		want       string
+	}{
+		{"trusted CDN", "104.16.0.1", "30.30.30.30", "30.30.30.30"},
+		{"trusted CDN, IPv6 client", "104.16.0.1", " 2001:db8::1 ", "2001:db8::1"},
+		{"spoofed direct", "30.30.30.30", "1.1.1.1", "30.30.30.30"},
+		{"trusted CDN, invalid header", "104.16.0.1", "horse", "104.16.0.1"},
+		{"trusted CDN, no header", "104.16.0.1", "", "104.16.0.1"},
+		{"trusted CDN, list", "104.16.0.1", "30.30.30.30, 1.1.1.1", "104.16.0.1"},
+		{"no remote address", "", "30.30.30.30", "<nil>"},
+	}
+	tr := New()
+	tr.AddFromString("104.16.0.0/13")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.DeduceClientIPFromCDNHeader(net.ParseIP(tt.remoteAddr), tt.cdnIP); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPFromCDNHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPCustom(t *testing.T) {
+	hexExtractor := func(headerValue string) (net.IP, error) {
+		b, err := hex.DecodeString(strings.TrimSpace(headerValue))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != net.IPv4len && len(b) != net.IPv6len {
+			return nil, fmt.Errorf("%v bytes", len(b))
+		}
+		return net.IP(b), nil
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+		wantErr    bool
+	}{
+		{"trusted gateway", "10.0.0.1", "1e1e1e1e", "30.30.30.30", false},
+		{"trusted gateway, IPv6 client", "10.0.0.1", "20010db8000000000000000000000001", "2001:db8::1", false},
+		{"spoofed direct", "30.30.30.30", "01010101", "30.30.30.30", false},
+		{"spoofed direct, invalid header", "30.30.30.30", "horse", "30.30.30.30", false},
+		{"trusted gateway, invalid header", "10.0.0.1", "horse", "<nil>", true},
+		{"trusted gateway, wrong length", "10.0.0.1", "1e1e1e", "<nil>", true},
+		{"trusted gateway, no header", "10.0.0.1", "", "<nil>", true},
+		{"no remote address", "", "1e1e1e1e", "<nil>", false},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tr.DeduceClientIPCustom(net.ParseIP(tt.remoteAddr), tt.header, hexExtractor)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TrustedProxies.DeduceClientIPCustom() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPCustom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A nil IP without an error is an error, too
+	none := func(string) (net.IP, error) { return nil, nil }
+	if got, err := tr.DeduceClientIPCustom(net.ParseIP("10.0.0.1"), "x", none); got != nil || !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.DeduceClientIPCustom() = %v, %v, want <nil>, %v", got, err, ErrInvalidIPSpecification)
+	}
+}
+
+func TestAgreeOn(t *testing.T) {
+	tests := []struct {
+		name       string
+		a          []string
+		b          []string
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"same config", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, "10.0.0.1", "30.30.30.30", true},
+		{"different notation", []string{"10.0.0.0/8"}, []string{"10.0.0.0-10.255.255.255"}, "10.0.0.1", "30.30.30.30", true},
+		{"difference not on the path", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8", "20.20.20.20"}, "10.0.0.1", "30.30.30.30", true},
+		{"difference on the path", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8", "20.20.20.20"}, "10.0.0.1", "30.30.30.30, 20.20.20.20", false},
+		{"peer trusted by one", []string{"10.0.0.0/8"}, []string{}, "10.0.0.1", "30.30.30.30", false},
+		{"no remote address", []string{"10.0.0.0/8"}, []string{}, "", "30.30.30.30", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := New(), New()
+			for _, spec := range tt.a {
+				a.AddFromString(spec)
+			}
+			for _, spec := range tt.b {
+				b.AddFromString(spec)
+			}
+			remoteAddr := net.ParseIP(tt.remoteAddr)
+			if got := AgreeOn(a, b, remoteAddr, tt.header); got != tt.want {
+				t.Errorf("AgreeOn() = %v, want %v", got, tt.want)
+			}
+			if got := AgreeOn(b, a, remoteAddr, tt.header); got != tt.want {
+				t.Errorf("AgreeOn() swapped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_LeftmostWhenTrusted(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+		wantWalk   string
+	}{
+		{"untrusted hops in between", "10.10.10.10", "30.30.30.30, 40.40.40.40, 20.20.20.20", "30.30.30.30", "40.40.40.40"},
+		{"trusted hops in between", "10.10.10.10", "30.30.30.30, 20.20.20.20", "30.30.30.30", "30.30.30.30"},
+		{"leftmost trusted", "10.10.10.10", "20.20.20.20, 40.40.40.40", "20.20.20.20", "40.40.40.40"},
+		{"single entry", "10.10.10.10", "30.30.30.30", "30.30.30.30", "30.30.30.30"},
+		{"untrusted peer", "50.50.50.50", "30.30.30.30, 40.40.40.40", "50.50.50.50", "50.50.50.50"},
+		{"no header", "10.10.10.10", "", "10.10.10.10", "10.10.10.10"},
+		{"unparseable leftmost", "10.10.10.10", "bogus, 40.40.40.40", "10.10.10.10", "40.40.40.40"},
+	}
+	leftmost := New(LeftmostWhenTrusted())
+	walk := New()
+	for _, tr := range []*TrustedProxies{leftmost, walk} {
+		tr.AddFromString("10.10.10.10")
+		tr.AddFromString("20.20.20.20")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteAddr := net.ParseIP(tt.remoteAddr)
+			if got := leftmost.DeduceClientIP(remoteAddr, tt.header); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
+			}
+			if got := walk.DeduceClientIP(remoteAddr, tt.header); fmt.Sprint(got) != tt.wantWalk {
+				t.Errorf("TrustedProxies.DeduceClientIP() without LeftmostWhenTrusted = %v, want %v", got, tt.wantWalk)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_VerifyMatch(t *testing.T) {
+	var calls []string
+	tr := New(VerifyMatch(func(matched *net.IPNet, ip net.IP) bool {
+		calls = append(calls, matched.String()+" "+ip.String())
+		// Pretend 10.0.0.0/24 is located where it shouldn't be
+		return !(matched.String() == "10.0.0.0/8" && ip.Mask(net.CIDRMask(24, 32)).Equal(net.ParseIP("10.0.0.0")))
+	}))
+	tr.AddFromString("10.0.0.0/8 !10.6.6.6")
+	tr.AddFromString("20.20.20.20")
+
+	tests := []struct {
+		ip        string
+		want      string
+		wantCalls []string
+	}{
+		{"10.1.1.1", "10.0.0.0/8", []string{"10.0.0.0/8 10.1.1.1"}},
+		{"10.0.0.1", "<nil>", []string{"10.0.0.0/8 10.0.0.1"}},
+		{"20.20.20.20", "20.20.20.20/32", []string{"20.20.20.20/32 20.20.20.20"}},
+		{"10.6.6.6", "<nil>", nil},
+		{"30.30.30.30", "<nil>", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			calls = nil
+			ip := net.ParseIP(tt.ip)
+			if got := tr.IsIPTrusted(&ip); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.IsIPTrusted() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("VerifyMatch() calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	// A vetoed hop ends the walk like any other untrusted hop
+	if got := tr.DeduceClientIP(net.ParseIP("20.20.20.20"), "30.30.30.30, 10.1.1.1, 10.0.0.1"); got.String() != "10.0.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.0.0.1")
+	}
+}
+
+func TestTrustedProxies_SpaceSeparatedHeader(t *testing.T) {
 	tests := []struct {
-		name       string
-		TrustedIPs []string
-		IPToCheck  string
-		want       *net.IPNet
+		name   string
+		header string
+		want   string
 	}{
-		{"Empty trust list, check ipv4", []string{}, "192.168.10.2", nil},
-		{"Empty trust list, check ipv6", []string{}, exampleIPv6Address, nil},
-		{"Match ipv4", []string{"192.168.10.10/24"}, "192.168.10.2", optimisticParseCIDR("192.168.10.10/24")},
-		{"Match ipv4, weird accepted ipnet", []string{"192.168.10.10/24", "this is not valid"}, "192.168.10.2", optimisticParseCIDR("192.168.10.10/24")},
-		{"Match ipv6", []string{exampleIPv6Address}, exampleIPv6Address, optimisticParseCIDR(exampleIPv6Address + "/128")},
-		{"No match", []string{"192.168.10.10/24"}, "192.168.11.2", nil},
+		{"space separated", "30.30.30.30 20.20.20.20", "30.30.30.30"},
+		{"more whitespace", " 1.1.1.1\t30.30.30.30  20.20.20.20 ", "30.30.30.30"},
+		{"IPv6", "2001:db8::1 20.20.20.20", "2001:db8::1"},
+		{"single IP", "30.30.30.30", "30.30.30.30"},
+		{"single IPv6", "2001:db8::1", "2001:db8::1"},
+		{"single bracketed IPv6", "[2001:db8::1]", "10.10.10.10"},
+		{"not all IPs", "30.30.30.30 horse", "10.10.10.10"},
+		{"commas", "30.30.30.30 40.40.40.40, 20.20.20.20", "20.20.20.20"},
 	}
+	tr := New()
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tr := New()
-			for _, spec := range tt.TrustedIPs {
-				tr.AddFromString(spec)
+			remoteAddr := net.ParseIP("10.10.10.10")
+			if got := tr.DeduceClientIP(remoteAddr, tt.header); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
 			}
-			ip := net.ParseIP(tt.IPToCheck)
+			if got := collect(tr.ChainIter(remoteAddr, tt.header)); got[len(got)-1] != tt.want {
+				t.Errorf("TrustedProxies.ChainIter() = %v, want %v last", got, tt.want)
+			}
+		})
+	}
+}
 
-			matchingIPNet := tr.IsIPTrusted(&ip)
-			if !reflect.DeepEqual(matchingIPNet, tt.want) {
-				t.Errorf("TrustedProxies.IsIPTrusted() = %v, wanted %v", matchingIPNet, tt.want)
+func TestTrustedProxies_FoldedHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"folded after comma", "30.30.30.30,\r\n 20.20.20.20", "30.30.30.30"},
+		{"folded without comma", "30.30.30.30\r\n\t20.20.20.20", "30.30.30.30"},
+		{"folded within entry", "30.30.30.30, 40.40.40.40\n 20.20.20.20", "40.40.40.40"},
+		{"folded before comma", "30.30.30.30\n, 20.20.20.20", "30.30.30.30"},
+		{"tab separated", "30.30.30.30\t20.20.20.20", "30.30.30.30"},
+		{"IPv6", "2001:db8::1,\n\t20.20.20.20", "2001:db8::1"},
+		{"not all IPs", "horse\n30.30.30.30, 20.20.20.20", "30.30.30.30"},
+		{"empty entry", "30.30.30.30,\r\n,20.20.20.20", "20.20.20.20"},
+		{"only folding", "\r\n\t", "10.10.10.10"},
+	}
+	tr := New()
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteAddr := net.ParseIP("10.10.10.10")
+			if got := tr.DeduceClientIP(remoteAddr, tt.header); fmt.Sprint(got) != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
+			}
+			if got := collect(tr.ChainIter(remoteAddr, tt.header)); got[len(got)-1] != tt.want {
+				t.Errorf("TrustedProxies.ChainIter() = %v, want %v last", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_headerToIPs(t *testing.T) {
+func TestTrustedProxies_DualStackIPv4Mapped(t *testing.T) {
+	tr := New()
+	tr.AddFromString("2001:db8::/32")
+	tr.AddFromString("10.0.0.0/8")
+	remoteAddr := net.ParseIP("2001:db8::10")
+
 	tests := []struct {
-		name        string
-		headerValue string
-		want        []string
+		name   string
+		header string
+		want   string
 	}{
-		{"Empty", "", []string{}},
-		{"Almost empty", " ", []string{}},
-		{"Single IP", "10.10.10.10", []string{"10.10.10.10"}},
-		{"Two IPs", "10.10.10.10, 20.20.20.20", []string{"10.10.10.10", "20.20.20.20"}},
-		{"IP + nonsense + IP", "10.10.10.10, ugh, 20.20.20.20", []string{"10.10.10.10", "", "20.20.20.20"}},
-		{"IP + empty", "10.10.10.10, , 20.20.20.20", []string{"10.10.10.10", "", "20.20.20.20"}},
+		{"mapped proxies", "203.0.113.5, ::ffff:10.0.0.2, ::ffff:10.0.0.1", "203.0.113.5"},
+		{"mapped client", "::ffff:203.0.113.5, ::ffff:10.0.0.1", "203.0.113.5"},
+		{"mixed", "::ffff:203.0.113.5, 10.0.0.2, ::ffff:10.0.0.1, 2001:db8::20", "203.0.113.5"},
+		{"untrusted mapped proxy", "203.0.113.5, ::ffff:192.0.2.1, ::ffff:10.0.0.1", "192.0.2.1"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			realWant := getRealWant(tt.want)
-			if got := headerToIPs(tt.headerValue); !reflect.DeepEqual(got, realWant) {
-				t.Errorf("headerToIPs() = %v, want %v", got, tt.want)
+			got := *tr.DeduceClientIP(remoteAddr, tt.header)
+			if len(got) != net.IPv4len || got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %#v, want the 4-byte form of %v", got, tt.want)
+			}
+			plain := strings.Replace(tt.header, "::ffff:", "", -1)
+			if got := *tr.DeduceClientIP(net.ParseIP("10.0.0.1").To4(), plain); len(got) != net.IPv4len {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %#v for %q from a 4-byte peer, want the 4-byte form", got, plain)
+			}
+		})
+	}
+
+	// The peer is the client, in 16-byte form
+	if got := *tr.DeduceClientIP(net.ParseIP("203.0.113.5"), ""); len(got) != net.IPv4len {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %#v for an untrusted peer, want the 4-byte form", got)
+	}
+	if got := *tr.DeduceClientIP(remoteAddr, "2001:db8:1::5"); len(got) != net.IPv6len {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %#v for an IPv6 client, want the 16-byte form", got)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" detailed", func(t *testing.T) {
+			if got := tr.DeduceClientIPDetailed(remoteAddr, tt.header).ClientIP; len(got) != net.IPv4len {
+				t.Errorf("TrustedProxies.DeduceClientIPDetailed().ClientIP = %#v, want the 4-byte form", got)
 			}
 		})
 	}
+
+	// Every entry point returns the same form
+	entryPoints := []struct {
+		name   string
+		deduce func(header string) *net.IP
+	}{
+		{"DeduceClientIPForPort", func(header string) *net.IP { return tr.DeduceClientIPForPort(remoteAddr, header, 443) }},
+		{"DeduceFromChain", func(header string) *net.IP {
+			chain := []net.IP{}
+			for _, entry := range strings.Split(header, ",") {
+				chain = append(chain, net.ParseIP(strings.TrimSpace(entry)))
+			}
+			return tr.DeduceFromChain(append(chain, remoteAddr))
+		}},
+		{"OutermostUntrusted", func(header string) *net.IP {
+			ip, _ := tr.OutermostUntrusted(remoteAddr, header)
+			return ip
+		}},
+		{"ChainIter", func(header string) *net.IP {
+			var last *net.IP
+			next := tr.ChainIter(remoteAddr, header)
+			for ip, ok := next(); ok; ip, ok = next() {
+				last = ip
+			}
+			return last
+		}},
+	}
+	for _, ep := range entryPoints {
+		for _, tt := range tests {
+			t.Run(tt.name+" "+ep.name, func(t *testing.T) {
+				if got := ep.deduce(tt.header); got == nil || len(*got) != net.IPv4len || got.String() != tt.want {
+					t.Errorf("TrustedProxies.%s() = %#v, want the 4-byte form of %v", ep.name, got, tt.want)
+				}
+			})
+		}
+	}
+	ip := tr.DeduceClientIPFromCDNHeader(remoteAddr, "::ffff:203.0.113.5")
+	if ip == nil || len(*ip) != net.IPv4len {
+		t.Errorf("TrustedProxies.DeduceClientIPFromCDNHeader() = %#v, want the 4-byte form", ip)
+	}
+}
+
+func TestTrustedProxies_HeaderTokenizer(t *testing.T) {
+	// Every address is followed by the protocol it was received with
+	header := "30.30.30.30, https, 20.20.20.20, http"
+	tokenizer := func(raw string) []string {
+		rv := []string{}
+		for idx, token := range strings.Split(raw, ",") {
+			if idx%2 == 0 {
+				rv = append(rv, token)
+			}
+		}
+		return rv
+	}
+
+	tr := New(HeaderTokenizer(tokenizer))
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
+	if got := tr.DeduceClientIP(net.ParseIP("10.10.10.10"), header); got.String() != "30.30.30.30" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "30.30.30.30")
+	}
+	if got := collect(tr.ChainIter(net.ParseIP("10.10.10.10"), header)); !reflect.DeepEqual(got, []string{"10.10.10.10", "20.20.20.20", "30.30.30.30"}) {
+		t.Errorf("TrustedProxies.ChainIter() = %v", got)
+	}
+
+	// By default, the protocol ends the walk
+	naive := New()
+	naive.AddFromString("10.10.10.10")
+	naive.AddFromString("20.20.20.20")
+	if got := naive.DeduceClientIP(net.ParseIP("10.10.10.10"), header); got.String() != "10.10.10.10" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.10.10.10")
+	}
 }
+
 func getRealWant(wants []string) []*net.IP {
 	realWant := []*net.IP{}
 	for _, ip := range wants {
@@ -194,7 +1464,7 @@ func TestTrustedProxies_DeduceClientIP(t *testing.T) {
 			for _, t := range tt.trustedCIDRs {
 				tr.AddFromString(t)
 			}
-			realWant := net.ParseIP(tt.want)
+			realWant := net.ParseIP(tt.want).To4()
 			if got := tr.DeduceClientIP(tt.args.remoteAddr, tt.args.header); !reflect.DeepEqual(got, &realWant) {
 				t.Errorf("TrustedProxies.filterOutIPsFromUntrustedSources() = %v, want %v", got, &realWant)
 			}
@@ -202,6 +1472,440 @@ func TestTrustedProxies_DeduceClientIP(t *testing.T) {
 	}
 }
 
+func TestTrustedProxies_DeduceClientIPRepeatedIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxHops    int
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"Peer repeated in header", 0, "10.0.0.1", "10.0.0.1", "10.0.0.1"},
+		{"Peer repeated, then client", 0, "10.0.0.1", "20.20.20.20, 10.0.0.1", "20.20.20.20"},
+		{"Peer repeated several times, then client", 0, "10.0.0.1", "20.20.20.20, 10.0.0.1, 10.0.0.1, 10.0.0.1", "20.20.20.20"},
+		{"Repeated hop in the middle", 0, "10.0.0.1", "20.20.20.20, 10.0.0.2, 10.0.0.2, 10.0.0.1", "20.20.20.20"},
+		{"Repeated untrusted client", 0, "10.0.0.1", "30.30.30.30, 20.20.20.20, 20.20.20.20", "20.20.20.20"},
+		{"Untrusted peer repeated", 0, "20.20.20.20", "30.30.30.30, 20.20.20.20", "20.20.20.20"},
+		{"Repetitions count as hops", 2, "10.0.0.1", "20.20.20.20, 10.0.0.2, 10.0.0.2", "10.0.0.2"},
+		{"Peer in header isn't counted twice", 2, "10.0.0.1", "20.20.20.20, 10.0.0.2, 10.0.0.1", "20.20.20.20"},
+		{"Only the rightmost peer is ignored", 2, "10.0.0.1", "20.20.20.20, 10.0.0.1, 10.0.0.1, 10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(MaxHops(tt.maxHops))
+			tr.AddFromString("10.0.0.0/8")
+			if got := tr.DeduceClientIP(net.ParseIP(tt.remoteAddr), tt.header); got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_VerifyClaimedIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr net.IP
+		header     string
+		claimed    net.IP
+		want       bool
+	}{
+		{"Matching claim", net.ParseIP("10.0.0.1"), "20.20.20.20", net.ParseIP("20.20.20.20"), true},
+		{"Matching claim behind several proxies", net.ParseIP("10.0.0.1"), "20.20.20.20, 10.0.0.2", net.ParseIP("20.20.20.20"), true},
+		{"Matching IPv4-mapped claim", net.ParseIP("10.0.0.1"), "20.20.20.20", net.ParseIP("::ffff:20.20.20.20"), true},
+		{"Spoofed claim", net.ParseIP("10.0.0.1"), "20.20.20.20", net.ParseIP("30.30.30.30"), false},
+		{"Claim spoofed in header", net.ParseIP("10.0.0.1"), "30.30.30.30, 20.20.20.20", net.ParseIP("30.30.30.30"), false},
+		{"Claim via untrusted peer", net.ParseIP("40.40.40.40"), "30.30.30.30", net.ParseIP("30.30.30.30"), false},
+		{"Untrusted peer claiming itself", net.ParseIP("40.40.40.40"), "30.30.30.30", net.ParseIP("40.40.40.40"), true},
+		{"No claim", net.ParseIP("10.0.0.1"), "20.20.20.20", nil, false},
+		{"No remote address", nil, "20.20.20.20", net.ParseIP("20.20.20.20"), false},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.VerifyClaimedIP(tt.remoteAddr, tt.header, tt.claimed); got != tt.want {
+				t.Errorf("TrustedProxies.VerifyClaimedIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ShouldExempt(t *testing.T) {
+	exempt := New()
+	exempt.AddFromString("192.168.0.0/16 !192.168.6.6")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"Exempt client behind proxy", "10.0.0.1", "192.168.1.1", true},
+		{"Other client behind proxy", "10.0.0.1", "8.8.8.8", false},
+		{"Excluded client behind proxy", "10.0.0.1", "192.168.6.6", false},
+		{"Exempt client spoofed via untrusted peer", "8.8.8.8", "192.168.1.1", false},
+		{"Exempt client connecting directly", "192.168.1.1", "", true},
+		{"Proxy isn't exempt", "10.0.0.1", "", false},
+		{"No remote address", "", "192.168.1.1", false},
+	}
+	tr := New(ExemptList(exempt))
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.ShouldExempt(net.ParseIP(tt.remoteAddr), tt.header); got != tt.want {
+				t.Errorf("TrustedProxies.ShouldExempt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := New().ShouldExempt(net.ParseIP("192.168.1.1"), ""); got {
+		t.Errorf("TrustedProxies.ShouldExempt() = %v without an exempt list", got)
+	}
+}
+
+func TestTrustedProxies_ChainMatchesTopology(t *testing.T) {
+	cdn := optimisticParseCIDR("203.0.113.0/24")
+	lb := optimisticParseCIDR("10.1.0.0/16")
+	ingress := optimisticParseCIDR("10.2.0.0/16")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		expected   []*net.IPNet
+		want       bool
+	}{
+		{"Matching", "10.2.0.1", "8.8.8.8, 203.0.113.5, 10.1.0.1", []*net.IPNet{cdn, lb, ingress}, true},
+		{"Wrong order", "10.2.0.1", "8.8.8.8, 10.1.0.1, 203.0.113.5", []*net.IPNet{cdn, lb, ingress}, false},
+		{"One hop too many", "10.2.0.1", "8.8.8.8, 203.0.113.5, 10.1.0.2, 10.1.0.1", []*net.IPNet{cdn, lb, ingress}, false},
+		{"One hop too few", "10.2.0.1", "8.8.8.8, 10.1.0.1", []*net.IPNet{cdn, lb, ingress}, false},
+		{"Shorter topology", "10.2.0.1", "8.8.8.8, 10.1.0.1", []*net.IPNet{lb, ingress}, true},
+		{"Direct connection", "8.8.8.8", "", []*net.IPNet{}, true},
+		{"Direct connection, expecting a proxy", "8.8.8.8", "", []*net.IPNet{ingress}, false},
+		{"No remote address", "", "8.8.8.8", []*net.IPNet{}, false},
+	}
+	tr := New()
+	tr.AddFromString("203.0.113.0/24")
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.ChainMatchesTopology(net.ParseIP(tt.remoteAddr), tt.header, tt.expected); got != tt.want {
+				t.Errorf("TrustedProxies.ChainMatchesTopology() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DeduceDualStack(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		v4Header   string
+		v6Header   string
+		wantV4     string
+		wantV6     string
+	}{
+		{"Both chains", "10.0.0.1", "20.20.20.20, 10.0.0.2", "2001:db8:1::1, 2001:db8::2", "20.20.20.20", "2001:db8:1::1"},
+		{"Independent lengths", "10.0.0.1", "20.20.20.20", "2001:db8:2::1, 2001:db8:1::1, 2001:db8::2", "20.20.20.20", "2001:db8:1::1"},
+		{"Only IPv4", "10.0.0.1", "20.20.20.20", "", "20.20.20.20", "<nil>"},
+		{"Only IPv6", "10.0.0.1", "", "2001:db8:1::1", "10.0.0.1", "2001:db8:1::1"},
+		{"IPv6 peer", "2001:db8::2", "20.20.20.20", "2001:db8:1::1", "20.20.20.20", "2001:db8:1::1"},
+		{"Untrusted IPv4 peer", "30.30.30.30", "20.20.20.20", "2001:db8:1::1", "30.30.30.30", "<nil>"},
+		{"Wrong family in header", "10.0.0.1", "2001:db8:1::1", "20.20.20.20", "<nil>", "<nil>"},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("2001:db8::/48")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v4, v6 := tr.DeduceDualStack(net.ParseIP(tt.remoteAddr), tt.v4Header, tt.v6Header)
+			if fmt.Sprint(v4) != tt.wantV4 || fmt.Sprint(v6) != tt.wantV6 {
+				t.Errorf("TrustedProxies.DeduceDualStack() = %v, %v, want %v, %v", v4, v6, tt.wantV4, tt.wantV6)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ReturnedIPsAreCopies(t *testing.T) {
+	tr := New(RecordHistory(4))
+	tr.AddFromString("10.0.0.0/8")
+
+	// Mutating a returned network doesn't change the list
+	ip := net.ParseIP("10.1.1.1")
+	ipnet := tr.IsIPTrusted(&ip)
+	ipnet.IP[0] = 192
+	ipnet.Mask[0] = 0
+	if got := tr.IsIPTrusted(&ip); got.String() != "10.0.0.0/8" {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want %v", got, "10.0.0.0/8")
+	}
+
+	// Mutating a deduced IP doesn't change the inputs or the history
+	remoteAddr := net.ParseIP("10.0.0.1")
+	got := tr.DeduceClientIP(remoteAddr, "20.20.20.20")
+	(*got)[len(*got)-1] = 99
+	if got := tr.RecentDecisions(1)[0].ClientIP.String(); got != "20.20.20.20" {
+		t.Errorf("DeduceResult.ClientIP = %v, want %v", got, "20.20.20.20")
+	}
+	recent := tr.RecentDecisions(1)[0]
+	recent.ClientIP[len(recent.ClientIP)-1] = 99
+	if got := tr.RecentDecisions(1)[0].ClientIP.String(); got != "20.20.20.20" {
+		t.Errorf("DeduceResult.ClientIP = %v, want %v", got, "20.20.20.20")
+	}
+
+	got = tr.DeduceClientIP(remoteAddr, "")
+	(*got)[len(*got)-1] = 99
+	if remoteAddr.String() != "10.0.0.1" {
+		t.Errorf("remoteAddr = %v, want %v", remoteAddr, "10.0.0.1")
+	}
+
+	chain := []net.IP{net.ParseIP("20.20.20.20"), net.ParseIP("10.0.0.1")}
+	got = tr.DeduceFromChain(chain)
+	(*got)[len(*got)-1] = 99
+	if chain[0].String() != "20.20.20.20" {
+		t.Errorf("chain[0] = %v, want %v", chain[0], "20.20.20.20")
+	}
+}
+
+func TestTrustedProxies_DeduceFromChain(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		chain        []string
+		want         string
+	}{
+		{"Empty chain", []string{}, []string{}, ""},
+		{"Single hop, untrusted", []string{}, []string{"10.10.10.10"}, "10.10.10.10"},
+		{"Single hop, trusted", []string{"10.10.10.10"}, []string{"10.10.10.10"}, "10.10.10.10"},
+		{"Peer trusted", []string{"10.10.10.10"}, []string{"30.30.30.30", "20.20.20.20", "10.10.10.10"}, "20.20.20.20"},
+		{"Two trusted hops", []string{"10.10.10.10", "20.20.20.20"}, []string{"30.30.30.30", "20.20.20.20", "10.10.10.10"}, "30.30.30.30"},
+		{"Peer not trusted", []string{"20.20.20.20"}, []string{"30.30.30.30", "20.20.20.20", "10.10.10.10"}, "10.10.10.10"},
+		{"Invalid hop stops walk", []string{"10.10.10.10"}, []string{"30.30.30.30", "", "10.10.10.10"}, "10.10.10.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			chain := []net.IP{}
+			for _, s := range tt.chain {
+				chain = append(chain, net.ParseIP(s))
+			}
+			got := tr.DeduceFromChain(chain)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("TrustedProxies.DeduceFromChain() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceFromChain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_WarnIfUnconfigured(t *testing.T) {
+	calls := 0
+	tr := New(WarnIfUnconfigured(func() { calls++ }))
+
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), " ")
+	if calls != 0 {
+		t.Errorf("Callback called %d times without a header, want 0", calls)
+	}
+
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "20.20.20.20")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "20.20.20.20")
+	if calls != 1 {
+		t.Errorf("Callback called %d times, want 1", calls)
+	}
+
+	configuredCalls := 0
+	configured := New(WarnIfUnconfigured(func() { configuredCalls++ }))
+	configured.AddFromString("10.10.10.10")
+	configured.DeduceClientIP(net.ParseIP("10.10.10.10"), "20.20.20.20")
+	if configuredCalls != 0 {
+		t.Errorf("Callback called %d times for a configured list, want 0", configuredCalls)
+	}
+
+	// Trust may come from elsewhere than the list
+	others := []struct {
+		name      string
+		opts      []Option
+		configure func(tr *TrustedProxies)
+	}{
+		{"Policy only", []Option{Policy(NewFCrDNSPolicy(newFakeResolver(), 16, "edge.example.com"))}, nil},
+		{"Certificate fingerprints only", []Option{TrustedCertFingerprints(strings.Repeat("ab", 32))}, nil},
+		{"Port-restricted entries only", nil, func(tr *TrustedProxies) { tr.AddForPorts("10.10.10.10", 443) }},
+	}
+	for _, tt := range others {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			tr := New(append(tt.opts, WarnIfUnconfigured(func() { calls++ }))...)
+			if tt.configure != nil {
+				tt.configure(tr)
+			}
+			tr.DeduceClientIP(net.ParseIP("20.20.20.1"), "8.8.8.8")
+			if calls != 0 {
+				t.Errorf("Callback called %d times, want 0", calls)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_SpoofRisk(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"trusted up to the client", nil, "10.10.10.10", "1.1.1.1", false},
+		{"trusted chain up to the client", nil, "10.10.10.10", "1.1.1.1, 20.20.20.20", false},
+		{"peer appended itself", nil, "10.10.10.10", "1.1.1.1, 10.10.10.10", false},
+		{"entries in front of the client", nil, "10.10.10.10", "6.6.6.6, 1.1.1.1", true},
+		{"entries in front of the client behind a chain", nil, "10.10.10.10", "6.6.6.6, 10.0.0.1, 1.1.1.1, 20.20.20.20", true},
+		{"forged trusted entry in front of the client", nil, "10.10.10.10", "20.20.20.20, 1.1.1.1", true},
+		{"untrusted peer with header", nil, "1.1.1.1", "6.6.6.6", true},
+		{"untrusted peer without header", nil, "1.1.1.1", "", false},
+		{"whole chain trusted", nil, "10.10.10.10", "20.20.20.20", false},
+		{"unparseable entry", nil, "10.10.10.10", "6.6.6.6, horse", false},
+		{"cut short by MaxHops", []Option{MaxHops(1)}, "10.10.10.10", "6.6.6.6, 1.1.1.1, 20.20.20.20", false},
+		{"leftmost when trusted", []Option{LeftmostWhenTrusted()}, "10.10.10.10", "1.1.1.1, 6.6.6.6, 7.7.7.7", false},
+		{"no remote address", nil, "", "1.1.1.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(tt.opts...)
+			tr.AddFromString("10.10.10.10")
+			tr.AddFromString("20.20.20.20")
+			if got := tr.SpoofRisk(net.ParseIP(tt.remoteAddr), tt.header); got != tt.want {
+				t.Errorf("TrustedProxies.SpoofRisk() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_WarnOnPrivateClient(t *testing.T) {
+	warned := []DeduceResult{}
+	peerTrusted := []bool{}
+	var tr *TrustedProxies
+	tr = New(WarnOnPrivateClient(func(result DeduceResult) {
+		// The callback may use the list
+		warned = append(warned, result)
+		peerTrusted = append(peerTrusted, tr.IsIPTrusted(&result.RemoteAddr) != nil)
+	}))
+	tr.AddFromString("10.10.10.10")
+
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "8.8.8.8")
+	tr.DeduceClientIP(net.ParseIP("1.1.1.1"), "192.168.1.1")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "2606:4700::1")
+	tr.DeduceClientIP(nil, "192.168.1.1")
+	if len(warned) != 0 {
+		t.Errorf("Callback called for %v, want no calls for public clients", warned)
+	}
+
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "8.8.8.8, 192.168.1.1")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "fd00::1")
+	tr.DeduceClientIP(net.ParseIP("172.16.0.1"), "8.8.8.8")
+	want := []string{"192.168.1.1", "fd00::1", "172.16.0.1"}
+	wantTrusted := []bool{true, true, false}
+	if len(warned) != len(want) {
+		t.Fatalf("Callback called %d times, want %d", len(warned), len(want))
+	}
+	for idx, result := range warned {
+		if result.ClientIP.String() != want[idx] || peerTrusted[idx] != wantTrusted[idx] {
+			t.Errorf("Callback called with %+v, want client %v", result, want[idx])
+		}
+	}
+}
+
+func TestTrustedProxies_OutermostUntrusted(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		remoteAddr   net.IP
+		header       string
+		want         string
+		wantFound    bool
+	}{
+		{"Untrusted remote", []string{}, net.ParseIP("10.10.10.10"), "20.20.20.20", "10.10.10.10", true},
+		{"Untrusted hop in header", []string{"10.10.10.10"}, net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20", "20.20.20.20", true},
+		{"Whole chain trusted", []string{"10.10.10.10", "20.20.20.20", "30.30.30.30"}, net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20", "30.30.30.30", false},
+		{"Trusted remote, no header", []string{"10.10.10.10"}, net.ParseIP("10.10.10.10"), "", "10.10.10.10", false},
+		{"Trusted remote, invalid header", []string{"10.10.10.10"}, net.ParseIP("10.10.10.10"), "horse", "10.10.10.10", true},
+		{"Unparseable entry beyond trusted hops", []string{"10.10.10.10", "20.20.20.20"}, net.ParseIP("10.10.10.10"), "30.30.30.30, garbage, 20.20.20.20", "20.20.20.20", true},
+		{"No remote address", []string{}, nil, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			got, found := tr.OutermostUntrusted(tt.remoteAddr, tt.header)
+			gotStr := ""
+			if got != nil {
+				gotStr = got.String()
+			}
+			if gotStr != tt.want || found != tt.wantFound {
+				t.Errorf("TrustedProxies.OutermostUntrusted() = %v, %v, want %v, %v", gotStr, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_OutermostUntrustedMaxHops(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		want      string
+		wantFound bool
+	}{
+		{"Truncated", "8.8.8.8, 10.0.0.2", "10.0.0.2", true},
+		{"Truncated within trusted hops", "10.0.0.3, 10.0.0.2", "10.0.0.2", true},
+		{"Whole chain trusted", "10.0.0.2", "10.0.0.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(MaxHops(1))
+			tr.AddFromString("10.0.0.0/8")
+			got, found := tr.OutermostUntrusted(net.ParseIP("10.0.0.1"), tt.header)
+			if got == nil || got.String() != tt.want || found != tt.wantFound {
+				t.Errorf("TrustedProxies.OutermostUntrusted() = %v, %v, want %v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_ClientIPOrDefault(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		remoteAddr   net.IP
+		header       string
+		want         string
+	}{
+		{"Untrusted remote", []string{}, net.ParseIP("10.10.10.10"), "20.20.20.20", "10.10.10.10"},
+		{"Trusted remote", []string{"10.10.10.10"}, net.ParseIP("10.10.10.10"), "20.20.20.20", "20.20.20.20"},
+		{"No remote address", []string{}, nil, "", "unknown"},
+		{"No remote address, header present", []string{}, nil, "20.20.20.20", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			if got := tr.ClientIPOrDefault(tt.remoteAddr, tt.header, "unknown"); got != tt.want {
+				t.Errorf("TrustedProxies.ClientIPOrDefault() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestFromREADME(t *testing.T) {
 	tp := New()
 	// Suppose our proxy is 10.10.10.10
@@ -0,0 +1,113 @@
+package trustedproxies
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	trustedProxiesContextKey contextKey = iota
+	clientIPContextKey
+	originalRemoteAddrContextKey
+)
+
+// ContextWithTrustedProxies returns a copy of ctx carrying tp. Middleware
+// uses the TrustedProxies found in the request context in preference to
+// its own, which allows e.g. selecting a tenant-specific list in an
+// earlier handler.
+func ContextWithTrustedProxies(ctx context.Context, tp *TrustedProxies) context.Context {
+	return context.WithValue(ctx, trustedProxiesContextKey, tp)
+}
+
+// trustedProxiesFromContext returns the TrustedProxies carried by ctx, if any
+func trustedProxiesFromContext(ctx context.Context) *TrustedProxies {
+	tp, _ := ctx.Value(trustedProxiesContextKey).(*TrustedProxies)
+	return tp
+}
+
+// ClientIPFromContext returns the client IP deduced by Middleware. The
+// bool is false if no client IP was deduced.
+func ClientIPFromContext(ctx context.Context) (net.IP, bool) {
+	ip, ok := ctx.Value(clientIPContextKey).(net.IP)
+	return ip, ok && ip != nil
+}
+
+// Middleware deduces the client IP of each request from its remote
+// address and X-Forwarded-For header and makes it available to next
+// through ClientIPFromContext. If the request context carries a
+// TrustedProxies (see ContextWithTrustedProxies), that one is used
+// instead of t.
+func (t *TrustedProxies) Middleware(next http.Handler) http.Handler {
+	return t.middleware(next, false)
+}
+
+// RealIPMiddleware works like Middleware, but additionally sets the
+// request's RemoteAddr to the deduced client IP for the benefit of
+// handlers and loggers that only look at RemoteAddr. Like net/http, it
+// uses the "IP:port" form, e.g. "[2001:db8::1]:1234", keeping the
+// original port, as the client's isn't known, or "0" if there is none. If
+// the header isn't trusted, RemoteAddr is left as is. The original
+// value is available through OriginalRemoteAddrFromContext.
+func (t *TrustedProxies) RealIPMiddleware(next http.Handler) http.Handler {
+	return t.middleware(next, true)
+}
+
+func (t *TrustedProxies) middleware(next http.Handler, rewriteRemoteAddr bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp := t
+		if ctxTP := trustedProxiesFromContext(r.Context()); ctxTP != nil {
+			tp = ctxTP
+		}
+
+		peerIP := remoteIP(r)
+		clientIP := tp.DeduceClientIP(peerIP, forwardedFor(r))
+		if clientIP == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPContextKey, *clientIP)
+		if rewriteRemoteAddr {
+			ctx = context.WithValue(ctx, originalRemoteAddrContextKey, r.RemoteAddr)
+		}
+		r = r.WithContext(ctx)
+		if rewriteRemoteAddr && !clientIP.Equal(peerIP) {
+			r.RemoteAddr = net.JoinHostPort(clientIP.String(), remotePort(r))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OriginalRemoteAddrFromContext returns the request's RemoteAddr as it
+// was before RealIPMiddleware rewrote it
+func OriginalRemoteAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(originalRemoteAddrContextKey).(string)
+	return addr, ok
+}
+
+// remoteIP extracts the IP from the request's RemoteAddr
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// remotePort extracts the port from the request's RemoteAddr, or returns
+// "0" if it has none
+func remotePort(r *http.Request) string {
+	if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil && port != "" {
+		return port
+	}
+	return "0"
+}
+
+// forwardedFor returns the combined value of all X-Forwarded-For headers
+func forwardedFor(r *http.Request) string {
+	return strings.Join(r.Header["X-Forwarded-For"], ", ")
+}
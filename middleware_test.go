@@ -0,0 +1,135 @@
+package trustedproxies
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func clientIPRecorder(got *string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := ClientIPFromContext(r.Context())
+		if !ok {
+			*got = ""
+			return
+		}
+		*got = ip.String()
+	})
+}
+
+func TestTrustedProxies_Middleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		remoteAddr   string
+		headers      []string
+		want         string
+	}{
+		{"No header", []string{}, "10.10.10.10:1234", []string{}, "10.10.10.10"},
+		{"Untrusted remote", []string{}, "10.10.10.10:1234", []string{"20.20.20.20"}, "10.10.10.10"},
+		{"Trusted remote", []string{"10.10.10.10"}, "10.10.10.10:1234", []string{"20.20.20.20"}, "20.20.20.20"},
+		{"Trusted IPv6 remote", []string{exampleIPv6Address}, "[" + exampleIPv6Address + "]:1234", []string{"20.20.20.20"}, "20.20.20.20"},
+		{"Remote without port", []string{"10.10.10.10"}, "10.10.10.10", []string{"20.20.20.20"}, "20.20.20.20"},
+		{"Multiple headers", []string{"10.10.10.10", "30.30.30.30"}, "10.10.10.10:1234", []string{"20.20.20.20", "30.30.30.30"}, "20.20.20.20"},
+		{"Bogus remote", []string{}, "horse", []string{"20.20.20.20"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.headers {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+
+			var got string
+			tr.Middleware(clientIPRecorder(&got)).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("ClientIPFromContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_MiddlewarePrefersContext(t *testing.T) {
+	global := New()
+
+	tenantA := New()
+	tenantA.AddFromString("10.10.10.10")
+	tenantB := New()
+
+	tenants := map[string]*TrustedProxies{"a": tenantA, "b": tenantB}
+	selectTenant := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := ContextWithTrustedProxies(r.Context(), tenants[r.Host])
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	var got string
+	handler := selectTenant(global.Middleware(clientIPRecorder(&got)))
+	for host, want := range map[string]string{"a": "20.20.20.20", "b": "10.10.10.10"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		r.RemoteAddr = "10.10.10.10:1234"
+		r.Header.Set("X-Forwarded-For", "20.20.20.20")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got != want {
+			t.Errorf("Tenant %v: ClientIPFromContext() = %v, want %v", host, got, want)
+		}
+	}
+
+	if ip, ok := ClientIPFromContext(httptest.NewRequest("GET", "/", nil).Context()); ok {
+		t.Errorf("ClientIPFromContext() = %v, want nothing", ip)
+	}
+}
+
+func TestTrustedProxies_RealIPMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedCIDRs   []string
+		remoteAddr     string
+		header         string
+		wantRemoteAddr string
+	}{
+		{"Trusted chain", []string{"10.10.10.10"}, "10.10.10.10:1234", "20.20.20.20", "20.20.20.20:1234"},
+		{"Trusted multi-hop chain", []string{"10.10.10.10", "30.30.30.30"}, "10.10.10.10:1234", "20.20.20.20, 30.30.30.30", "20.20.20.20:1234"},
+		{"Trusted IPv6 client", []string{"10.10.10.10"}, "10.10.10.10:1234", exampleIPv6Address, "[2001:db8:85a3::8a2e:370:7334]:1234"},
+		{"Remote address without port", []string{"10.10.10.10"}, "10.10.10.10", "20.20.20.20", "20.20.20.20:0"},
+		{"Untrusted chain", []string{}, "10.10.10.10:1234", "20.20.20.20", "10.10.10.10:1234"},
+		{"Trusted, no header", []string{"10.10.10.10"}, "10.10.10.10:1234", "", "10.10.10.10:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set("X-Forwarded-For", tt.header)
+			}
+
+			var gotRemoteAddr, gotOriginal string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRemoteAddr = r.RemoteAddr
+				gotOriginal, _ = OriginalRemoteAddrFromContext(r.Context())
+			})
+			tr.RealIPMiddleware(handler).ServeHTTP(httptest.NewRecorder(), r)
+			if gotRemoteAddr != tt.wantRemoteAddr {
+				t.Errorf("r.RemoteAddr = %v, want %v", gotRemoteAddr, tt.wantRemoteAddr)
+			}
+			if host, _, err := net.SplitHostPort(gotRemoteAddr); gotRemoteAddr != tt.remoteAddr && (err != nil || net.ParseIP(host) == nil) {
+				t.Errorf("net.SplitHostPort(%q) = %q, %v, want an IP", gotRemoteAddr, host, err)
+			}
+			if gotOriginal != tt.remoteAddr {
+				t.Errorf("OriginalRemoteAddrFromContext() = %v, want %v", gotOriginal, tt.remoteAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package trustedproxies
+
+import (
+	"net"
+	"time"
+)
+
+// Option configures optional behaviour of a TrustedProxies
+type Option func(*TrustedProxies)
+
+// SkipBogonsInHeader makes DeduceClientIP ignore private and other
+// non-public addresses (see IsBogon) found in the header. A bogon header
+// entry is treated as if it weren't there: the walk continues with the
+// next hop further out instead of returning it as the client. This
+// defeats clients stuffing private addresses into X-Forwarded-For. The
+// remote address itself is never skipped.
+func SkipBogonsInHeader() Option {
+	return func(t *TrustedProxies) {
+		t.skipBogonsInHeader = true
+	}
+}
+
+// MaxHops limits the number of trusted hops DeduceClientIP walks through.
+// Once n trusted hops have been walked, the next hop is taken as the
+// client, trusted or not. n <= 0 means no limit, which is the default.
+func MaxHops(n int) Option {
+	return func(t *TrustedProxies) {
+		t.maxHops = n
+	}
+}
+
+// DetectFamilyMismatch makes DeduceClientIPDetailed set FamilyMismatch
+// when the remote address is IPv6 but the header only holds IPv4
+// addresses, or vice versa. This often indicates a misconfigured
+// dual-stack proxy.
+func DetectFamilyMismatch() Option {
+	return func(t *TrustedProxies) {
+		t.detectFamilyMismatch = true
+	}
+}
+
+// WarnIfUnconfigured registers fn to be called, once, the first time
+// DeduceClientIP is given a non-empty header while nothing can be
+// trusted: there are no trusted entries, including port-restricted ones,
+// no Policy and no TrustedCertFingerprints. This usually means the list
+// was never set up, so the header is ignored and the proxy's address is
+// taken as the client.
+func WarnIfUnconfigured(fn func()) Option {
+	return func(t *TrustedProxies) {
+		t.warnIfUnconfigured = fn
+	}
+}
+
+// RecordHistory makes DeduceClientIP and DeduceClientIPDetailed remember
+// the last size results, see RecentDecisions
+func RecordHistory(size int) Option {
+	return func(t *TrustedProxies) {
+		if size > 0 {
+			t.history = newHistory(size)
+		}
+	}
+}
+
+// TrustedCertFingerprints makes peers presenting a TLS certificate with
+// one of the given SPKI fingerprints trusted, regardless of their
+// address. Fingerprints are hex encoded SHA-256 hashes as returned by
+// SPKIFingerprint; colons and case are ignored. Only considered by
+// DeduceClientIPFromTLS.
+func TrustedCertFingerprints(fps ...string) Option {
+	return func(t *TrustedProxies) {
+		if t.trustedCertFingerprints == nil {
+			t.trustedCertFingerprints = map[string]struct{}{}
+		}
+		for _, fp := range fps {
+			t.trustedCertFingerprints[normalizeFingerprint(fp)] = struct{}{}
+		}
+	}
+}
+
+// KeepCanonical keeps the trusted entries sorted and free of duplicates
+// (the same network with the same label, ports and expiry) after every
+// change. This makes each change cost a sort of the whole list, in
+// exchange for a list that is always in canonical order, e.g. for
+// MarshalJSON. It is meant for lists that are read much more often than
+// they are changed.
+func KeepCanonical() Option {
+	return func(t *TrustedProxies) {
+		t.keepCanonical = true
+	}
+}
+
+// Policy makes p decide which hops are trusted, instead of just the
+// configured ranges (see TrustPolicy)
+func Policy(p TrustPolicy) Option {
+	return func(t *TrustedProxies) {
+		t.policy = p
+	}
+}
+
+// Clock makes the TrustedProxies use now instead of time.Now, e.g. to
+// decide whether entries added with AddWithTTL have expired
+func Clock(now func() time.Time) Option {
+	return func(t *TrustedProxies) {
+		t.now = now
+	}
+}
+
+// QuoteAwareHeader makes the header parsing skip commas within double
+// quotes, as emitted by some gateways mimicking the Forwarded header,
+// e.g. `"[2001:db8::1]:443", 192.0.2.1`. Quoted values are unquoted and
+// may include a port. Without this option, the header is simply split at
+// every comma, which is faster.
+func QuoteAwareHeader() Option {
+	return func(t *TrustedProxies) {
+		t.quoteAwareHeader = true
+	}
+}
+
+// HeaderTokenizer replaces the splitting of the header into entries,
+// for proxies adding more than addresses, e.g. trailing protocol
+// information. fn is given the raw header and returns the entries, from
+// left to right; each is trimmed and parsed as an IP. Entries that don't
+// parse end the walk, like they always do. fn takes precedence over
+// QuoteAwareHeader. By default, the header is split at commas.
+func HeaderTokenizer(fn func(raw string) []string) Option {
+	return func(t *TrustedProxies) {
+		t.tokenizer = fn
+	}
+}
+
+// LeftmostWhenTrusted makes DeduceClientIP return the leftmost header
+// entry as the client whenever the remote address is trusted, instead of
+// walking the chain. The hops in between are neither checked nor
+// counted.
+//
+// This is only safe if the trusted proxies overwrite the header rather
+// than append to it, so that it never holds anything but the address
+// they saw themselves. If any trusted proxy passes on a header received
+// from the client, the client can choose its address freely.
+func LeftmostWhenTrusted() Option {
+	return func(t *TrustedProxies) {
+		t.leftmostWhenTrusted = true
+	}
+}
+
+// VerifyMatch registers fn to be called whenever ip falls within a
+// trusted entry, matched, that isn't excluded by the deny list. If fn
+// returns false, the match is vetoed and ip is treated as untrusted
+// everywhere, including IsIPTrusted and DeduceClientIP. This allows for
+// checks the list can't express, e.g. rejecting a trusted range seen
+// from an unexpected country or ASN. fn is given copies it may keep. It
+// is called while t is locked, so it must not use t.
+func VerifyMatch(fn func(matched *net.IPNet, ip net.IP) bool) Option {
+	return func(t *TrustedProxies) {
+		t.verifyMatch = fn
+	}
+}
+
+// WarnOnIgnoredPort registers fn to be called with the specification
+// whenever one holds an address with a port, e.g. "10.0.0.1:8080". Such
+// addresses are accepted, ignoring the port, as they are usually pasted
+// by mistake. Note that fn may be called while t is locked, so it must
+// not use t.
+func WarnOnIgnoredPort(fn func(spec string)) Option {
+	return func(t *TrustedProxies) {
+		t.warnOnIgnoredPort = fn
+	}
+}
+
+// WarnOnPrivateClient registers fn to be called whenever DeduceClientIP
+// or DeduceClientIPDetailed deduce a client IP that is a bogon (see
+// IsBogon), e.g. a private address. For services exposed to the
+// internet, this almost always means the list is misconfigured or the
+// header is spoofed. fn gets a copy of the result and is called after t
+// is unlocked, so it may use t.
+func WarnOnPrivateClient(fn func(result DeduceResult)) Option {
+	return func(t *TrustedProxies) {
+		t.warnOnPrivateClient = fn
+	}
+}
+
+// TrackMatches makes lookups count the matches of each trusted entry and
+// note when it last matched, see MatchCount and UnusedEntries. This
+// costs reading the clock and an atomic update of shared counters on
+// every match, which is why it is off by default.
+func TrackMatches() Option {
+	return func(t *TrustedProxies) {
+		t.trackMatches = true
+	}
+}
+
+// ExemptList sets the list of client addresses ShouldExempt checks. It
+// is separate from the trusted proxies: an entry in exempt makes a
+// client exempt, but isn't trusted to forward requests. exempt may still
+// be changed afterwards.
+func ExemptList(exempt *TrustedProxies) Option {
+	return func(t *TrustedProxies) {
+		t.exempt = exempt
+	}
+}
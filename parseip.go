@@ -0,0 +1,187 @@
+package trustedproxies
+
+import (
+	"net"
+)
+
+// v4InV6Prefix is the prefix of IPv4 addresses in 16-byte form
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// The rules of net.ParseIP got stricter over time, and parseIPInto
+// follows those of the toolchain it is built with, so that all ways of
+// parsing a header agree. IPv4 octets with leading zeros, e.g. "01", are
+// rejected since Go 1.17, IPv6 groups of more than four digits, e.g.
+// "00001", since Go 1.22.
+var (
+	ipv4LeadingZeros = net.ParseIP("1.2.3.04") != nil
+	ipv6LongGroups   = net.ParseIP("00001::") != nil
+)
+
+// parseIPInto parses s like net.ParseIP, but writes the address to dst,
+// which must be at least 16 bytes long, instead of allocating. Returns
+// the number of bytes written, which is always 16 if ok, as net.ParseIP
+// returns IPv4 addresses in 16-byte form, too. Zones are rejected, and
+// leading zeros are accepted as far as net.ParseIP accepts them, see
+// ipv4LeadingZeros and ipv6LongGroups.
+func parseIPInto(dst []byte, s string) (n int, ok bool) {
+	if len(dst) < net.IPv6len {
+		return 0, false
+	}
+	// Whichever separator comes first decides the family
+	for idx := 0; idx < len(s); idx++ {
+		switch s[idx] {
+		case '.':
+			if !parseIPv4Into(dst[12:16], s) {
+				return 0, false
+			}
+			copy(dst, v4InV6Prefix[:])
+			return net.IPv6len, true
+		case ':':
+			if !parseIPv6Into(dst[:16], s) {
+				return 0, false
+			}
+			return net.IPv6len, true
+		case '%':
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// parseIPv4Into parses the dotted decimal IPv4 address s into the 4
+// bytes of dst
+func parseIPv4Into(dst []byte, s string) bool {
+	val, pos, digits := 0, 0, 0
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		switch {
+		case c >= '0' && c <= '9':
+			if digits == 1 && val == 0 && !ipv4LeadingZeros {
+				// Leading zero
+				return false
+			}
+			val = val*10 + int(c-'0')
+			digits++
+			if val > 255 {
+				return false
+			}
+		case c == '.':
+			if idx == 0 || idx == len(s)-1 || s[idx-1] == '.' || pos == 3 {
+				return false
+			}
+			dst[pos] = byte(val)
+			pos++
+			val, digits = 0, 0
+		default:
+			return false
+		}
+	}
+	if pos < 3 {
+		return false
+	}
+	dst[3] = byte(val)
+	return true
+}
+
+// parseIPv6Into parses the IPv6 address s, which may end in an embedded
+// IPv4 address, into the 16 bytes of dst
+func parseIPv6Into(dst []byte, s string) bool {
+	for idx := range dst {
+		dst[idx] = 0
+	}
+
+	// ellipsis is the position of "::" in dst, if any
+	ellipsis := -1
+	if len(s) >= 2 && s[0] == ':' && s[1] == ':' {
+		ellipsis = 0
+		s = s[2:]
+		if len(s) == 0 {
+			return true
+		}
+	}
+
+	i := 0
+	for i < 16 {
+		off, acc := 0, uint32(0)
+	digits:
+		for ; off < len(s); off++ {
+			c := s[off]
+			switch {
+			case c >= '0' && c <= '9':
+				acc = acc<<4 + uint32(c-'0')
+			case c >= 'a' && c <= 'f':
+				acc = acc<<4 + uint32(c-'a'+10)
+			case c >= 'A' && c <= 'F':
+				acc = acc<<4 + uint32(c-'A'+10)
+			default:
+				break digits
+			}
+			if acc > 0xffff || (off > 3 && !ipv6LongGroups) {
+				// Out of range or, with leading zeros, more than four
+				// digits
+				return false
+			}
+		}
+		if off == 0 {
+			return false
+		}
+
+		// An embedded IPv4 address takes the place of the last two groups
+		if off < len(s) && s[off] == '.' {
+			if (ellipsis < 0 && i != 12) || i+4 > 16 {
+				return false
+			}
+			if !parseIPv4Into(dst[i:i+4], s) {
+				return false
+			}
+			s = ""
+			i += 4
+			break
+		}
+
+		dst[i] = byte(acc >> 8)
+		dst[i+1] = byte(acc)
+		i += 2
+
+		s = s[off:]
+		if len(s) == 0 {
+			break
+		}
+		if s[0] != ':' || len(s) == 1 {
+			return false
+		}
+		s = s[1:]
+		if s[0] == ':' {
+			if ellipsis >= 0 {
+				// Only one "::" is allowed
+				return false
+			}
+			ellipsis = i
+			s = s[1:]
+			if len(s) == 0 {
+				break
+			}
+		}
+	}
+	if len(s) != 0 {
+		return false
+	}
+
+	if i < 16 {
+		if ellipsis < 0 {
+			return false
+		}
+		// Move the groups after the "::" to the end
+		n := 16 - i
+		for j := i - 1; j >= ellipsis; j-- {
+			dst[j+n] = dst[j]
+		}
+		for j := ellipsis; j < ellipsis+n; j++ {
+			dst[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		// "::" must stand for at least one group
+		return false
+	}
+	return true
+}
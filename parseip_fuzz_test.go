@@ -0,0 +1,24 @@
+//go:build go1.18
+// +build go1.18
+
+package trustedproxies
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func FuzzParseIPInto(f *testing.F) {
+	for _, s := range parseIPSamples {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		buf := bytes.Repeat([]byte{0xaa}, net.IPv6len)
+		n, ok := parseIPInto(buf, s)
+		want := net.ParseIP(s)
+		if ok != (want != nil) || (ok && !bytes.Equal(buf[:n], want)) {
+			t.Errorf("parseIPInto(%q) = %v, %v, want %v", s, net.IP(buf[:n]), ok, want)
+		}
+	})
+}
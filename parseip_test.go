@@ -0,0 +1,74 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// parseIPSamples are valid and invalid addresses parseIPInto must agree
+// with net.ParseIP on. They also seed FuzzParseIPInto.
+var parseIPSamples = []string{
+	"", "1.2.3.4", "0.0.0.0", "255.255.255.255", "256.1.1.1", "1.2.3", "1.2.3.4.5",
+	"01.2.3.4", "1.2.3.04", "0.0.0.00", "1..2.3", ".1.2.3", "1.2.3.", "1.2.3.4 ", " 1.2.3.4",
+	"1.2.3.4:80", "::", "::1", "1::", "2001:db8::1", "2001:DB8::A:b", "2001:db8:0:0:0:0:0:1",
+	"1:2:3:4:5:6:7:8", "1:2:3:4:5:6:7:8:9", "1:2:3:4:5:6:7::", "::2:3:4:5:6:7:8", "1:2:3:4:5:6:7:8::",
+	"::ffff:1.2.3.4", "::1.2.3.4", "1:2:3:4:5:6:1.2.3.4", "1:2:3:4:5:6:7:1.2.3.4", "1:2::1.2.3.4",
+	"::ffff:01.2.3.4", "::ffff:1.2.3", "1::2::3", ":::", ":1::", "1:", "1::2:", "12345::", "0001::",
+	"g::", "fe80::1%eth0", "fe80::1%", "%eth0", "[::1]", "::1]", "1.2.3.4%eth0", "horse", "1", "1.",
+}
+
+func TestParseIPInto(t *testing.T) {
+	for _, s := range parseIPSamples {
+		t.Run(s, func(t *testing.T) {
+			var buf [net.IPv6len]byte
+			n, ok := parseIPInto(buf[:], s)
+			want := net.ParseIP(s)
+			if ok != (want != nil) || (ok && !bytes.Equal(buf[:n], want)) {
+				t.Errorf("parseIPInto() = %v, %v, want %v", net.IP(buf[:n]), ok, want)
+			}
+		})
+	}
+
+	if _, ok := parseIPInto(make([]byte, net.IPv6len-1), "1.2.3.4"); ok {
+		t.Errorf("parseIPInto() accepted a short buffer")
+	}
+
+	var buf [net.IPv6len]byte
+	if allocs := testing.AllocsPerRun(100, func() { parseIPInto(buf[:], "2001:db8::1.2.3.4") }); allocs != 0 {
+		t.Errorf("parseIPInto() allocates %v times", allocs)
+	}
+}
+
+func TestParseIPIntoLeadingZeros(t *testing.T) {
+	defer func(v4, v6 bool) { ipv4LeadingZeros, ipv6LongGroups = v4, v6 }(ipv4LeadingZeros, ipv6LongGroups)
+
+	tests := []struct {
+		name       string
+		v4, v6     bool
+		s          string
+		want       string
+		wantAccept bool
+	}{
+		{"IPv4, strict", false, false, "01.2.3.4", "", false},
+		{"IPv4, lenient", true, false, "01.2.3.4", "1.2.3.4", true},
+		{"IPv4, many zeros", true, false, "0000000001.2.3.004", "1.2.3.4", true},
+		{"IPv4, out of range", true, false, "1.2.3.0256", "", false},
+		{"Embedded IPv4, lenient", true, false, "::ffff:01.2.3.4", "1.2.3.4", true},
+		{"IPv6, strict", false, false, "00001::", "", false},
+		{"IPv6, lenient", false, true, "00001::", "1::", true},
+		{"IPv6, many zeros", false, true, "0000000000000000ffff::", "ffff::", true},
+		{"IPv6, out of range", false, true, "10000::", "", false},
+		{"IPv6, overflow", false, true, "fffffffff::", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipv4LeadingZeros, ipv6LongGroups = tt.v4, tt.v6
+			var buf [net.IPv6len]byte
+			n, ok := parseIPInto(buf[:], tt.s)
+			if ok != tt.wantAccept || (ok && !net.IP(buf[:n]).Equal(net.ParseIP(tt.want))) {
+				t.Errorf("parseIPInto(%q) = %v, %v, want %v, %v", tt.s, net.IP(buf[:n]), ok, tt.want, tt.wantAccept)
+			}
+		})
+	}
+}
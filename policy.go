@@ -0,0 +1,71 @@
+package trustedproxies
+
+import (
+	"net"
+)
+
+// HopInfo describes a hop in the chain of proxies, as passed to a
+// TrustPolicy
+type HopInfo struct {
+	// IP is the address of the hop
+	IP net.IP
+	// Hop is the position of the hop, counting from the peer the
+	// request was received from, which is hop 0
+	Hop int
+	// Port is the local port the request was received on, or 0 if
+	// unknown
+	Port int
+	// InTrustedRange is set if IP is trusted by the configured ranges,
+	// taking the deny list and port restrictions into account. This is
+	// the decision made without a TrustPolicy.
+	InTrustedRange bool
+}
+
+// TrustPolicy decides whether a hop is trusted, i.e. whether the
+// address it reports for the previous hop is believed. Without a policy,
+// a hop is trusted if it is in one of the trusted ranges (see
+// HopInfo.InTrustedRange).
+//
+// Trusted is called while the TrustedProxies is locked, so it must not
+// call methods of the TrustedProxies it is used with.
+type TrustPolicy interface {
+	Trusted(hop HopInfo) bool
+}
+
+// TrustPolicyFunc is an adapter to use an ordinary function as a
+// TrustPolicy
+type TrustPolicyFunc func(hop HopInfo) bool
+
+// Trusted calls f(hop)
+func (f TrustPolicyFunc) Trusted(hop HopInfo) bool {
+	return f(hop)
+}
+
+// trustedHop reports whether ip, at position hop of the chain, is
+// trusted for port according to the policy
+func (t *TrustedProxies) trustedHop(ip net.IP, hop int, port int) bool {
+	return t.decideHop(ip, hop, port, t.matchForPort(ip, nil, port) != nil)
+}
+
+// recheckHop works like trustedHop without recording a hit (see
+// TrackMatches), for hops a walk already decided on
+func (t *TrustedProxies) recheckHop(ip net.IP, hop int, port int) bool {
+	return t.decideHop(ip, hop, port, t.peekAt(ip, nil, port, t.lookupTime()) != nil)
+}
+
+// decideHop applies the policy to ip at position hop, given whether it
+// is in a trusted range for port
+func (t *TrustedProxies) decideHop(ip net.IP, hop int, port int, inTrustedRange bool) bool {
+	info := HopInfo{
+		IP:             ip,
+		Hop:            hop,
+		InTrustedRange: inTrustedRange,
+	}
+	if port != anyPort {
+		info.Port = port
+	}
+	if t.policy == nil {
+		return info.InTrustedRange
+	}
+	return t.policy.Trusted(info)
+}
@@ -0,0 +1,61 @@
+package trustedproxies
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrustedProxies_Policy(t *testing.T) {
+	// Trust exactly two hops, regardless of their addresses
+	twoHops := TrustPolicyFunc(func(hop HopInfo) bool {
+		return hop.Hop < 2
+	})
+	// Trust the configured ranges, but only on port 8443
+	onlyOnPort := TrustPolicyFunc(func(hop HopInfo) bool {
+		return hop.InTrustedRange && hop.Port == 8443
+	})
+
+	tests := []struct {
+		name       string
+		policy     TrustPolicy
+		remoteAddr string
+		header     string
+		port       int
+		want       string
+	}{
+		{"No policy", nil, "20.20.20.20", "30.30.30.30", 0, "20.20.20.20"},
+		{"Policy by position", twoHops, "20.20.20.20", "50.50.50.50, 40.40.40.40, 30.30.30.30", 0, "40.40.40.40"},
+		{"Policy by position, short chain", twoHops, "20.20.20.20", "30.30.30.30", 0, "30.30.30.30"},
+		{"Policy ignores ranges", twoHops, "10.0.0.1", "50.50.50.50, 10.0.0.3, 10.0.0.2", 0, "10.0.0.3"},
+		{"Policy by port, matching", onlyOnPort, "10.0.0.1", "30.30.30.30", 8443, "30.30.30.30"},
+		{"Policy by port, other port", onlyOnPort, "10.0.0.1", "30.30.30.30", 443, "10.0.0.1"},
+		{"Policy by port, no port", onlyOnPort, "10.0.0.1", "30.30.30.30", 0, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(Policy(tt.policy))
+			tr.AddFromString("10.0.0.0/8")
+			var got *net.IP
+			if tt.port == 0 {
+				got = tr.DeduceClientIP(net.ParseIP(tt.remoteAddr), tt.header)
+			} else {
+				got = tr.DeduceClientIPForPort(net.ParseIP(tt.remoteAddr), tt.header, tt.port)
+			}
+			if got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_PolicyOutermostUntrusted(t *testing.T) {
+	tr := New(Policy(TrustPolicyFunc(func(hop HopInfo) bool {
+		return hop.Hop < 2
+	})))
+	if got, untrusted := tr.OutermostUntrusted(net.ParseIP("20.20.20.20"), "40.40.40.40, 30.30.30.30"); got.String() != "40.40.40.40" || !untrusted {
+		t.Errorf("TrustedProxies.OutermostUntrusted() = %v, %v, want %v, %v", got, untrusted, "40.40.40.40", true)
+	}
+	if got, untrusted := tr.OutermostUntrusted(net.ParseIP("20.20.20.20"), "30.30.30.30"); got.String() != "30.30.30.30" || untrusted {
+		t.Errorf("TrustedProxies.OutermostUntrusted() = %v, %v, want %v, %v", got, untrusted, "30.30.30.30", false)
+	}
+}
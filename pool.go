@@ -0,0 +1,103 @@
+package trustedproxies
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// chainBuf holds the slices needed to walk the chain of a request, so
+// DeduceClientIP can reuse them across calls instead of allocating them
+// anew, see chainBufs
+type chainBuf struct {
+	remote net.IP
+	// bytes backs ips, see parseIPInto
+	bytes  []byte
+	ips    []net.IP
+	parsed []*net.IP
+	chain  []*net.IP
+	walked []*net.IP
+}
+
+// chainBufs pools the chainBufs of DeduceClientIPDetailed
+var chainBufs = sync.Pool{
+	New: func() interface{} { return new(chainBuf) },
+}
+
+// maxPooledHops limits the size of the buffers kept in chainBufs, so a
+// single request with a huge header doesn't pin its memory
+const maxPooledHops = 64
+
+func getChainBuf() *chainBuf {
+	return chainBufs.Get().(*chainBuf)
+}
+
+// putChainBuf returns buf to the pool. Its slices, and anything
+// returned by walkInto, must no longer be used.
+func putChainBuf(buf *chainBuf) {
+	if cap(buf.ips) > maxPooledHops || cap(buf.chain) > maxPooledHops+1 || cap(buf.bytes) > maxPooledHops*net.IPv6len {
+		return
+	}
+	// Don't keep the IPs of the request alive
+	buf.remote = nil
+	for idx := range buf.ips {
+		buf.ips[idx] = nil
+	}
+	buf.parsed = clearIPs(buf.parsed)
+	buf.chain = clearIPs(buf.chain)
+	buf.walked = clearIPs(buf.walked)
+	chainBufs.Put(buf)
+}
+
+// clearIPs zeroes ips and returns it truncated
+func clearIPs(ips []*net.IP) []*net.IP {
+	for idx := range ips {
+		ips[idx] = nil
+	}
+	return ips[:0]
+}
+
+// walkInto works like filterOutIPsFromUntrustedSources, using buf for
+// the intermediate slices. The result is only valid until buf is
+// returned to the pool.
+func (t *TrustedProxies) walkInto(buf *chainBuf, remoteAddr net.IP, header string) []*net.IP {
+	buf.remote = remoteAddr
+	buf.chain = t.appendChain(buf.chain[:0], &buf.remote, t.parseHeaderInto(buf, header))
+	buf.walked = t.appendWalkFrom(buf.walked[:0], remoteAddr, buf.chain, anyPort)
+	return buf.walked
+}
+
+// countFolds counts the line breaks and tabs in header, which may
+// separate entries, see appendFoldedIPs
+func countFolds(header string) int {
+	n := 0
+	for idx := 0; idx < len(header); idx++ {
+		if c := header[idx]; c == '\r' || c == '\n' || c == '\t' {
+			n++
+		}
+	}
+	return n
+}
+
+// parseHeaderInto works like parseHeader, parsing into buf unless the
+// QuoteAwareHeader or HeaderTokenizer options are set or the entries are
+// separated by whitespace
+func (t *TrustedProxies) parseHeaderInto(buf *chainBuf, header string) []*net.IP {
+	if t.tokenizer != nil || t.quoteAwareHeader {
+		return t.parseHeader(header)
+	}
+	if ips := spaceSeparatedIPs(header); ips != nil {
+		return ips
+	}
+
+	if need := net.IPv6len * (1 + strings.Count(header, ",") + countFolds(header)); cap(buf.bytes) < need {
+		buf.bytes = make([]byte, 0, need)
+	}
+	buf.bytes = buf.bytes[:0]
+	buf.ips = appendHeaderIPs(buf.ips[:0], &buf.bytes, header)
+	buf.parsed = buf.parsed[:0]
+	for idx := range buf.ips {
+		buf.parsed = append(buf.parsed, &buf.ips[idx])
+	}
+	return buf.parsed
+}
@@ -0,0 +1,80 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTrustedProxies_DeduceClientIPPooled(t *testing.T) {
+	tr := New()
+	tr.AddPrivateRanges()
+
+	long := make([]string, maxPooledHops+10)
+	for idx := range long {
+		long[idx] = fmt.Sprintf("10.0.%d.%d", idx/256, idx%256)
+	}
+	reqs := []ChainInput{
+		{net.ParseIP("10.0.0.1"), "203.0.113.1, 192.168.1.1, 10.0.0.2"},
+		{net.ParseIP("10.0.0.1"), "203.0.113.2"},
+		{net.ParseIP("10.0.0.1"), ""},
+		{net.ParseIP("10.0.0.1"), "203.0.113.3 10.0.0.2"},
+		{net.ParseIP("10.0.0.1"), "horse, 10.0.0.2"},
+		{net.ParseIP("203.0.113.4"), "198.51.100.1"},
+		{net.ParseIP("10.0.0.1"), "198.51.100.2, " + strings.Join(long, ", ")},
+		{nil, "203.0.113.5"},
+	}
+	want := make([]string, len(reqs))
+	for idx, req := range reqs {
+		want[idx] = fmt.Sprint(lastHop(tr.filterOutIPsFromUntrustedSources(req.RemoteAddr, req.Header)))
+	}
+
+	// Results must not share memory with the pooled buffers, which are
+	// reused by the other goroutines
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			kept := make([]*net.IP, len(reqs))
+			for n := 0; n < 200; n++ {
+				for idx := range reqs {
+					req := reqs[(idx+worker)%len(reqs)]
+					kept[(idx+worker)%len(reqs)] = tr.DeduceClientIP(req.RemoteAddr, req.Header)
+				}
+			}
+			for idx, got := range kept {
+				if fmt.Sprint(got) != want[idx] {
+					t.Errorf("TrustedProxies.DeduceClientIP(%v, %q) = %v, want %v", reqs[idx].RemoteAddr, reqs[idx].Header, got, want[idx])
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func BenchmarkDeduceClientIP(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	remoteAddr := net.ParseIP("10.0.0.1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.DeduceClientIP(remoteAddr, "203.0.113.1, 192.168.1.1, 10.0.0.2")
+	}
+}
+
+// BenchmarkDeduceClientIPUnpooled walks the chain without the pooled
+// buffers, for comparison with BenchmarkDeduceClientIP
+func BenchmarkDeduceClientIPUnpooled(b *testing.B) {
+	tr := New()
+	tr.AddPrivateRanges()
+	remoteAddr := net.ParseIP("10.0.0.1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tr.mu.RLock()
+		lastHop(tr.filterOutIPsFromUntrustedSources(remoteAddr, "203.0.113.1, 192.168.1.1, 10.0.0.2"))
+		tr.mu.RUnlock()
+	}
+}
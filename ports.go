@@ -0,0 +1,84 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// anyPort is used for lookups that aren't tied to a local port
+const anyPort = -1
+
+// AddForPorts works like AddFromString, but the entry is only trusted
+// for requests received on one of the given local ports, see
+// DeduceClientIPForPort. Lookups that don't specify a port, such as
+// IsIPTrusted and DeduceClientIP, ignore the entry.
+func (t *TrustedProxies) AddForPorts(s string, ports ...int) error {
+	if len(ports) == 0 {
+		return fmt.Errorf("%w: no ports given for %s", ErrInvalidIPSpecification, s)
+	}
+	set, err := portSet(ports)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	nets, err := t.addFromString(s)
+	if err != nil {
+		return err
+	}
+	for _, ipnet := range nets {
+		t.metaFor(ipnet).ports = set
+	}
+	return nil
+}
+
+// portSet validates ports and turns them into a set. Returns nil for
+// an empty list.
+func portSet(ports []int) (map[int]bool, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	rv := map[int]bool{}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%w: invalid port %d", ErrInvalidIPSpecification, port)
+		}
+		rv[port] = true
+	}
+	return rv, nil
+}
+
+// portsOf returns the sorted ports a trusted entry is restricted to, if any
+func (t *TrustedProxies) portsOf(ipnet *net.IPNet) []int {
+	m, ok := t.meta[ipnet]
+	if !ok || len(m.ports) == 0 {
+		return nil
+	}
+	rv := []int{}
+	for port := range m.ports {
+		rv = append(rv, port)
+	}
+	sort.Ints(rv)
+	return rv
+}
+
+// DeduceClientIPForPort works like DeduceClientIP for a request received
+// on localPort. In addition to the unrestricted entries, entries added
+// with AddForPorts for localPort are trusted.
+func (t *TrustedProxies) DeduceClientIPForPort(remoteAddr net.IP, header string, localPort int) *net.IP {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return lastHop(t.filterForPort(remoteAddr, header, localPort))
+}
+
+// validForPort reports whether ipnet may be used for a lookup for port
+func (t *TrustedProxies) validForPort(ipnet *net.IPNet, port int) bool {
+	m, ok := t.meta[ipnet]
+	if !ok || len(m.ports) == 0 {
+		return true
+	}
+	return m.ports[port]
+}
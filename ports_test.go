@@ -0,0 +1,68 @@
+package trustedproxies
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTrustedProxies_DeduceClientIPForPort(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		localPort  int
+		want       string
+	}{
+		{"Port-restricted proxy on its port", "10.0.0.1", "8.8.8.8", 443, "8.8.8.8"},
+		{"Port-restricted proxy on another port", "10.0.0.1", "8.8.8.8", 80, "10.0.0.1"},
+		{"Port-restricted proxy on its other port", "10.0.0.1", "8.8.8.8", 8443, "8.8.8.8"},
+		{"Unrestricted proxy on any port", "10.0.0.2", "8.8.8.8", 80, "8.8.8.8"},
+		{"Mixed chain on restricted port", "10.0.0.2", "8.8.8.8, 10.0.0.1", 443, "8.8.8.8"},
+		{"Mixed chain on other port", "10.0.0.2", "8.8.8.8, 10.0.0.1", 80, "10.0.0.1"},
+	}
+	tr := New()
+	if err := tr.AddForPorts("10.0.0.1", 443, 8443); err != nil {
+		t.Fatalf("TrustedProxies.AddForPorts() error = %v", err)
+	}
+	tr.AddFromString("10.0.0.2")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.DeduceClientIPForPort(net.ParseIP(tt.remoteAddr), tt.header, tt.localPort); got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPForPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := tr.DeduceClientIP(net.ParseIP("10.0.0.1"), "8.8.8.8"); got.String() != "10.0.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.0.0.1")
+	}
+	ip := net.ParseIP("10.0.0.1")
+	if got := tr.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+}
+
+func TestTrustedProxies_AddForPortsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		ports []int
+	}{
+		{"No ports", "10.0.0.1", []int{}},
+		{"Invalid port", "10.0.0.1", []int{443, 0}},
+		{"Port out of range", "10.0.0.1", []int{65536}},
+		{"Invalid spec", "horse", []int{443}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			if err := tr.AddForPorts(tt.spec, tt.ports...); !errors.Is(err, ErrInvalidIPSpecification) {
+				t.Errorf("TrustedProxies.AddForPorts() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+			}
+			if len(tr.trustedCIDRs) != 0 {
+				t.Errorf("TrustedProxies.AddForPorts() added %v", tr.trustedCIDRs)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package trustedproxies
+
+import (
+	"net"
+)
+
+// privateRanges are the private address ranges added by AddPrivateRanges
+var privateRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// cgnatRanges is the shared address space used for carrier-grade NAT
+// (RFC 6598), added by AddCGNAT
+var cgnatRanges = mustParseCIDRs(
+	"100.64.0.0/10",
+)
+
+// documentationRanges are the ranges reserved for documentation (RFC
+// 5737 and RFC 3849), added by AddDocumentationRanges
+var documentationRanges = mustParseCIDRs(
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"2001:db8::/32",
+)
+
+// cloudflareRanges are Cloudflare's published proxy ranges, see
+// https://www.cloudflare.com/ips/
+var cloudflareRanges = mustParseCIDRs(
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+)
+
+// AddPrivateRanges trusts the RFC 1918 private IPv4 ranges and the IPv6
+// unique local range (fc00::/7). The entries are labeled "private".
+func (t *TrustedProxies) AddPrivateRanges() {
+	t.addPreset(privateRanges, "private")
+}
+
+// AddCGNAT trusts the carrier-grade NAT range, 100.64.0.0/10. It is
+// neither public nor private in the RFC 1918 sense: ISPs use it for
+// their customers, but it may also be used for internal networks. Only
+// trust it if your proxies live there. The entry is labeled "cgnat".
+func (t *TrustedProxies) AddCGNAT() {
+	t.addPreset(cgnatRanges, "cgnat")
+}
+
+// AddDocumentationRanges trusts the ranges reserved for documentation:
+// 192.0.2.0/24, 198.51.100.0/24, 203.0.113.0/24 and 2001:db8::/32. They
+// are never routed, which makes them the addresses of choice for tests
+// and examples: unlike real ranges, they can't end up trusting actual
+// hosts. The entries are labeled "documentation".
+func (t *TrustedProxies) AddDocumentationRanges() {
+	t.addPreset(documentationRanges, "documentation")
+}
+
+// AddCloudflare trusts Cloudflare's published proxy ranges. The entries
+// are labeled "cloudflare".
+func (t *TrustedProxies) AddCloudflare() {
+	t.addPreset(cloudflareRanges, "cloudflare")
+}
+
+// addPreset trusts a copy of each of the given ranges under label
+func (t *TrustedProxies) addPreset(nets []*net.IPNet, label string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	for _, ipnet := range nets {
+		entry := &net.IPNet{IP: ipnet.IP, Mask: ipnet.Mask}
+		t.trustedCIDRs = append(t.trustedCIDRs, entry)
+		m := t.metaFor(entry)
+		m.label = label
+		m.spec = entry.String()
+		m.source = "preset"
+	}
+}
@@ -0,0 +1,69 @@
+package trustedproxies
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrustedProxies_AddDocumentationRanges(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.3.1", false},
+		{"198.51.100.255", true},
+		{"198.51.101.0", false},
+		{"203.0.113.0", true},
+		{"203.0.114.1", false},
+		{"::ffff:203.0.113.7", true},
+		{"2001:db8::1", true},
+		{exampleIPv6Address, true},
+		{"2001:db9::1", false},
+		{"8.8.8.8", false},
+	}
+	tr := New()
+	tr.AddDocumentationRanges()
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if got := tr.IsIPTrusted(&ip) != nil; got != tt.want {
+				t.Errorf("TrustedProxies.IsIPTrusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if label, _ := tr.Label(net.ParseIP("2001:db8::1")); label != "documentation" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "documentation")
+	}
+	if got := tr.DeduceClientIP(net.ParseIP("2001:db8::1"), "8.8.8.8, 198.51.100.1"); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "8.8.8.8")
+	}
+}
+
+func TestTrustedProxies_AddCGNAT(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"100.63.255.255", false},
+		{"100.64.0.0", true},
+		{"100.100.100.100", true},
+		{"100.127.255.255", true},
+		{"100.128.0.0", false},
+		{"::ffff:100.64.0.1", true},
+		{"10.0.0.1", false},
+	}
+	tr := New()
+	tr.AddCGNAT()
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if got := tr.IsIPTrusted(&ip) != nil; got != tt.want {
+				t.Errorf("TrustedProxies.IsIPTrusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if label, _ := tr.Label(net.ParseIP("100.64.0.1")); label != "cgnat" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "cgnat")
+	}
+}
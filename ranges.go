@@ -0,0 +1,422 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidPrefixLength indicates a prefix length that cannot be used
+// for the requested operation
+var ErrInvalidPrefixLength = errors.New("invalid prefix length")
+
+// ErrTooManySubnets indicates an expansion would yield an unreasonable
+// number of subnets
+var ErrTooManySubnets = errors.New("too many subnets")
+
+// maxSubnets is the maximum number of subnets Subnets returns
+const maxSubnets = 1 << 20
+
+// TrustedAddressCount returns the number of addresses covered by the
+// trusted ranges. Overlapping ranges are only counted once. The deny
+// list is not taken into account.
+func (t *TrustedProxies) TrustedAddressCount() *big.Int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	total := new(big.Int)
+	for _, ipnet := range compactNets(t.trustedCIDRs) {
+		total.Add(total, netSize(ipnet))
+	}
+	return total
+}
+
+// OverlapRatio returns the number of addresses trusted by both t and
+// other, divided by the number of addresses trusted by either of them:
+// 1 if they trust the same addresses, 0 if they have none in common.
+// Overlapping ranges are only counted once and, like for
+// TrustedAddressCount, the deny lists are not taken into account. IPv4
+// and IPv6 addresses are counted alike, so IPv6 ranges usually dominate.
+// Two empty lists are considered identical.
+func (t *TrustedProxies) OverlapRatio(other *TrustedProxies) float64 {
+	// Locked one after the other, so that t.OverlapRatio(o) and
+	// o.OverlapRatio(t) can't deadlock
+	t.mu.RLock()
+	a := compactNets(t.trustedCIDRs)
+	t.mu.RUnlock()
+	other.mu.RLock()
+	b := compactNets(other.trustedCIDRs)
+	other.mu.RUnlock()
+
+	// Compacted networks don't overlap, and two networks overlap exactly
+	// if one contains the other, so each shared address is counted once
+	shared := new(big.Int)
+	for _, x := range a {
+		x = canonicalNet(x)
+		for _, y := range b {
+			y = canonicalNet(y)
+			if containsNet(x, y) {
+				shared.Add(shared, netSize(y))
+			} else if containsNet(y, x) {
+				shared.Add(shared, netSize(x))
+			}
+		}
+	}
+
+	combined := new(big.Int).Neg(shared)
+	for _, ipnet := range append(a, b...) {
+		combined.Add(combined, netSize(ipnet))
+	}
+	if combined.Sign() == 0 {
+		return 1
+	}
+	ratio, _ := new(big.Rat).SetFrac(shared, combined).Float64()
+	return ratio
+}
+
+// Intersects reports whether any trusted range overlaps cidr, either
+// partially or fully. cidr may also be a single IP. The deny list is not
+// taken into account.
+func (t *TrustedProxies) Intersects(cidr string) (bool, error) {
+	ipnet, err := netFromIPOrCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return false, err
+	}
+	ipnet = canonicalNet(ipnet)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, entry := range t.trustedCIDRs {
+		entry = canonicalNet(entry)
+		// Two prefixes overlap exactly if one of them contains the other
+		if containsNet(entry, ipnet) || containsNet(ipnet, entry) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// netSize returns the number of addresses in ipnet
+func netSize(ipnet *net.IPNet) *big.Int {
+	ones, bits := ipnet.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// Compact removes every trusted entry that is already covered by another
+// entry, including IPv4-mapped IPv6 ranges (e.g. ::ffff:192.0.2.0/120)
+// that duplicate an IPv4 range. The remaining entries are sorted.
+// Metadata, such as labels, of removed entries is discarded.
+func (t *TrustedProxies) Compact() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	compacted := compactNets(t.trustedCIDRs)
+	kept := make(map[*net.IPNet]bool, len(compacted))
+	for _, ipnet := range compacted {
+		kept[ipnet] = true
+	}
+	for ipnet := range t.meta {
+		if !kept[ipnet] {
+			delete(t.meta, ipnet)
+		}
+	}
+	t.trustedCIDRs = compacted
+}
+
+// compactNets returns a sorted copy of nets with every network that is
+// contained in another network removed. IPv4-mapped IPv6 networks are
+// compared by their IPv4 equivalent. Of two identical networks, the
+// earlier one is kept.
+func compactNets(nets []*net.IPNet) []*net.IPNet {
+	type pair struct {
+		orig, canonical *net.IPNet
+	}
+	sorted := make([]pair, len(nets))
+	for idx, ipnet := range nets {
+		sorted[idx] = pair{ipnet, canonicalNet(ipnet)}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lessNet(sorted[i].canonical, sorted[j].canonical)
+	})
+
+	rv := []*net.IPNet{}
+	var last *net.IPNet
+	for _, p := range sorted {
+		if last != nil && containsNet(last, p.canonical) {
+			continue
+		}
+		rv = append(rv, p.orig)
+		last = p.canonical
+	}
+	return rv
+}
+
+// canonicalize is called after every change to the trusted entries. It
+// invalidates the index and, if the KeepCanonical option is set, sorts
+// the entries and drops duplicates.
+func (t *TrustedProxies) canonicalize() {
+	t.invalidateIndex()
+	if !t.keepCanonical {
+		return
+	}
+	sort.SliceStable(t.trustedCIDRs, func(i, j int) bool {
+		return lessNet(canonicalNet(t.trustedCIDRs[i]), canonicalNet(t.trustedCIDRs[j]))
+	})
+
+	seen := map[string]bool{}
+	kept := t.trustedCIDRs[:0]
+	for _, ipnet := range t.trustedCIDRs {
+		key := fmt.Sprintf("%s\x00%s\x00%s\x00%v\x00%v", canonicalNet(ipnet), t.labelOf(ipnet), t.sourceOf(ipnet), t.portsOf(ipnet), t.expiryOf(ipnet))
+		if seen[key] {
+			delete(t.meta, ipnet)
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, ipnet)
+	}
+	for idx := len(kept); idx < len(t.trustedCIDRs); idx++ {
+		t.trustedCIDRs[idx] = nil
+	}
+	t.trustedCIDRs = kept
+}
+
+// canonicalNet returns the IPv4 form of an IPv4-mapped IPv6 network
+// (::ffff:0:0/96 or narrower). Any other network is returned as is.
+func canonicalNet(ipnet *net.IPNet) *net.IPNet {
+	ones, bits := ipnet.Mask.Size()
+	if bits != 8*net.IPv6len || ones < 96 {
+		return ipnet
+	}
+	ipv4 := ipnet.IP.To4()
+	if ipv4 == nil {
+		return ipnet
+	}
+	return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+}
+
+// sortNets sorts nets by family (IPv4 first), then network address,
+// then prefix length (shortest first)
+func sortNets(nets []*net.IPNet) {
+	sort.Slice(nets, func(i, j int) bool {
+		return lessNet(nets[i], nets[j])
+	})
+}
+
+func lessNet(a, b *net.IPNet) bool {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	if aBits != bBits {
+		return aBits < bBits
+	}
+	if c := bytes.Compare(a.IP, b.IP); c != 0 {
+		return c < 0
+	}
+	return aOnes < bOnes
+}
+
+// TrustedCIDRsBySpecificity returns a copy of the trusted entries, most
+// specific (longest prefix) first. Entries with the same prefix length
+// are sorted IPv4 before IPv6, then by address. IPv4-mapped IPv6 entries are
+// returned in their IPv4 form.
+func (t *TrustedProxies) TrustedCIDRsBySpecificity() []*net.IPNet {
+	t.mu.RLock()
+	rv := make([]*net.IPNet, len(t.trustedCIDRs))
+	for idx, ipnet := range t.trustedCIDRs {
+		c := canonicalNet(ipnet)
+		rv[idx] = &net.IPNet{
+			IP:   append(net.IP(nil), c.IP...),
+			Mask: append(net.IPMask(nil), c.Mask...),
+		}
+	}
+	t.mu.RUnlock()
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		iOnes, iBits := rv[i].Mask.Size()
+		jOnes, jBits := rv[j].Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		if iBits != jBits {
+			return iBits < jBits
+		}
+		return bytes.Compare(rv[i].IP, rv[j].IP) < 0
+	})
+	return rv
+}
+
+// TrustedCIDRsFiltered returns a copy of the trusted entries for which
+// pred returns true, in the order they are matched. IPv4-mapped IPv6
+// entries are passed to pred and returned in their IPv4 form. See
+// IsIPv4Net, IsIPv6Net, IsGlobalNet, IsPrivateNet and IsLinkLocalNet for
+// ready-made predicates.
+func (t *TrustedProxies) TrustedCIDRsFiltered(pred func(*net.IPNet) bool) []*net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rv := []*net.IPNet{}
+	for _, ipnet := range t.trustedCIDRs {
+		if c := copyNet(canonicalNet(ipnet)); pred(c) {
+			rv = append(rv, c)
+		}
+	}
+	return rv
+}
+
+// Bounds returns the first and the last address of cidr. Returns nil
+// for both if cidr is malformed.
+func Bounds(cidr *net.IPNet) (first, last net.IP) {
+	ip := cidr.IP.To16()
+	if len(cidr.Mask) == net.IPv4len {
+		ip = cidr.IP.To4()
+	}
+	if ip == nil || len(ip) != len(cidr.Mask) {
+		return nil, nil
+	}
+
+	first = make(net.IP, len(ip))
+	last = make(net.IP, len(ip))
+	for idx := range ip {
+		first[idx] = ip[idx] & cidr.Mask[idx]
+		last[idx] = ip[idx] | ^cidr.Mask[idx]
+	}
+	return first, last
+}
+
+// Subnets expands the trusted IPv4 ranges into subnets of the given
+// prefix length, e.g. all the /26 subnets of a /24. IPv6 ranges are not
+// expanded. Overlapping ranges yield each subnet only once. An error is
+// returned if prefixLen is shorter than the prefix of a trusted range
+// or if the expansion would result in more than 2^20 subnets.
+func (t *TrustedProxies) Subnets(prefixLen int) ([]*net.IPNet, error) {
+	if prefixLen < 0 || prefixLen > 32 {
+		return nil, fmt.Errorf("%w: /%d", ErrInvalidPrefixLength, prefixLen)
+	}
+
+	t.mu.RLock()
+	nets := []*net.IPNet{}
+	for _, ipnet := range t.trustedCIDRs {
+		nets = append(nets, canonicalNet(ipnet))
+	}
+	t.mu.RUnlock()
+
+	v4Nets := []*net.IPNet{}
+	total := 0
+	for _, ipnet := range compactNets(nets) {
+		ones, bits := ipnet.Mask.Size()
+		if bits != 32 {
+			continue
+		}
+		if ones > prefixLen {
+			return nil, fmt.Errorf("%w: /%d is shorter than %v", ErrInvalidPrefixLength, prefixLen, ipnet)
+		}
+		if prefixLen-ones > 20 || total+(1<<uint(prefixLen-ones)) > maxSubnets {
+			return nil, fmt.Errorf("%w: expanding to /%d", ErrTooManySubnets, prefixLen)
+		}
+		total += 1 << uint(prefixLen-ones)
+		v4Nets = append(v4Nets, ipnet)
+	}
+
+	rv := make([]*net.IPNet, 0, total)
+	mask := net.CIDRMask(prefixLen, 32)
+	step := uint64(1) << uint(32-prefixLen)
+	for _, ipnet := range v4Nets {
+		ones, _ := ipnet.Mask.Size()
+		start := uint64(binary.BigEndian.Uint32(ipnet.IP.To4()))
+		for i := uint64(0); i < uint64(1)<<uint(prefixLen-ones); i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, uint32(start+i*step))
+			rv = append(rv, &net.IPNet{IP: ip, Mask: mask})
+		}
+	}
+	return rv, nil
+}
+
+// Complement returns the smallest list of networks covering exactly the
+// addresses within the given network (or IP) that are not in any trusted
+// range, e.g. for default-deny firewall rules. The deny list is not taken
+// into account.
+func (t *TrustedProxies) Complement(within string) ([]*net.IPNet, error) {
+	ipnet, err := netFromIPOrCIDR(strings.TrimSpace(within))
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := Bounds(canonicalNet(ipnet))
+	length := len(lo)
+
+	t.mu.RLock()
+	compacted := compactNets(t.trustedCIDRs)
+	t.mu.RUnlock()
+
+	one := big.NewInt(1)
+	cur := new(big.Int).SetBytes(lo)
+	end := new(big.Int).SetBytes(hi)
+	rv := []*net.IPNet{}
+	// The compacted networks are sorted and don't overlap, so the gaps
+	// between them are what's not trusted
+	for _, entry := range compacted {
+		first, last := Bounds(canonicalNet(entry))
+		if len(first) != length {
+			continue
+		}
+		firstInt := new(big.Int).SetBytes(first)
+		lastInt := new(big.Int).SetBytes(last)
+		if lastInt.Cmp(cur) < 0 {
+			continue
+		}
+		if firstInt.Cmp(end) > 0 {
+			break
+		}
+		if firstInt.Cmp(cur) > 0 {
+			gapEnd := new(big.Int).Sub(firstInt, one)
+			rv = append(rv, rangeToNets(intToIP(cur, length), intToIP(gapEnd, length))...)
+		}
+		cur = lastInt.Add(lastInt, one)
+		if cur.Cmp(end) > 0 {
+			return rv, nil
+		}
+	}
+	return append(rv, rangeToNets(intToIP(cur, length), hi)...), nil
+}
+
+// rangeToNets returns the smallest list of networks covering exactly the
+// addresses from start to end (inclusive). start and end must be of the
+// same length and start must not be after end.
+func rangeToNets(start, end net.IP) []*net.IPNet {
+	bits := 8 * len(start)
+	cur := new(big.Int).SetBytes(start)
+	last := new(big.Int).SetBytes(end)
+	one := big.NewInt(1)
+
+	rv := []*net.IPNet{}
+	for cur.Cmp(last) <= 0 {
+		// The largest block starting at cur is limited by its alignment...
+		size := bits
+		if cur.Sign() != 0 {
+			size = int(cur.TrailingZeroBits())
+		}
+		// ...and by the end of the range
+		for size > 0 {
+			blockEnd := new(big.Int).Lsh(one, uint(size))
+			blockEnd.Add(blockEnd, cur).Sub(blockEnd, one)
+			if blockEnd.Cmp(last) <= 0 {
+				break
+			}
+			size--
+		}
+
+		rv = append(rv, &net.IPNet{IP: intToIP(cur, len(start)), Mask: net.CIDRMask(bits-size, bits)})
+		cur.Add(cur, new(big.Int).Lsh(one, uint(size)))
+	}
+	return rv
+}
+
+// intToIP converts i to an IP of the given length in bytes
+func intToIP(i *big.Int, length int) net.IP {
+	ip := make(net.IP, length)
+	b := i.Bytes()
+	copy(ip[length-len(b):], b)
+	return ip
+}
@@ -0,0 +1,379 @@
+package trustedproxies
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTrustedProxies_TrustedAddressCount(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		want         string
+	}{
+		{"Empty", []string{}, "0"},
+		{"Single IPv4", []string{"10.10.10.10"}, "1"},
+		{"Single /24", []string{"192.168.1.0/24"}, "256"},
+		{"Disjoint ranges", []string{"192.168.1.0/24", "10.0.0.0/8"}, "16777472"},
+		{"Overlapping ranges", []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.1"}, "16777216"},
+		{"Duplicate ranges", []string{"10.0.0.0/24", "10.0.0.0/24"}, "256"},
+		{"IPv6 /64", []string{"2001:db8::/64"}, "18446744073709551616"},
+		{"IPv6 and IPv4", []string{"2001:db8::/127", "2001:db8::1", "10.0.0.0/31"}, "4"},
+		{"Everything", []string{"0.0.0.0/0", "::/0"}, "340282366920938463463374607436063178752"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			if got := tr.TrustedAddressCount(); got.String() != tt.want {
+				t.Errorf("TrustedProxies.TrustedAddressCount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_Intersects(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		want    bool
+		wantErr error
+	}{
+		{"Overlapping", "203.0.112.0/23", true, nil},
+		{"Contained", "203.0.113.128/25", true, nil},
+		{"Containing", "10.0.0.0/8", true, nil},
+		{"Equal", "203.0.113.0/24", true, nil},
+		{"Disjoint", "198.51.100.0/24", false, nil},
+		{"Adjacent", "203.0.114.0/24", false, nil},
+		{"Single IP", "10.1.2.3", true, nil},
+		{"IPv4-mapped", "::ffff:203.0.113.0/120", true, nil},
+		{"IPv6", "2001:db8:1::/48", true, nil},
+		{"IPv6 disjoint", "2001:db9::/32", false, nil},
+		{"Default route", "0.0.0.0/0", true, nil},
+		{"Invalid", "horse", false, ErrInvalidIPSpecification},
+	}
+	tr := New()
+	tr.AddFromString("203.0.113.0/24")
+	tr.AddFromString("10.1.0.0/16")
+	tr.AddFromString("2001:db8::/32")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tr.Intersects(tt.cidr)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrustedProxies.Intersects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("TrustedProxies.Intersects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_Compact(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		want         []string
+	}{
+		{"Empty", []string{}, []string{}},
+		{"Nothing to compact", []string{"192.168.1.0/24", "10.0.0.0/8"}, []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{"Contained ranges", []string{"10.1.0.0/16", "10.0.0.0/8", "10.1.1.1"}, []string{"10.0.0.0/8"}},
+		{"Duplicates", []string{"10.0.0.0/8", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{"IPv4-mapped duplicate", []string{"192.0.2.0/24", "::ffff:192.0.2.0/120"}, []string{"192.0.2.0/24"}},
+		{"IPv4-mapped contained", []string{"::ffff:192.0.2.0/120", "192.0.2.1"}, []string{"192.0.2.0/24"}},
+		{"IPv4-mapped containing", []string{"192.0.2.0/25", "::ffff:192.0.0.0/112"}, []string{"192.0.0.0/16"}},
+		{"IPv6", []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db9::1"}, []string{"2001:db8::/32", "2001:db9::1/128"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			tr.Compact()
+			got := []string{}
+			for _, ipnet := range tr.trustedCIDRs {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.Compact() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_CompactDropsMetadata(t *testing.T) {
+	tr := New()
+	tr.AddLabeled("10.0.0.0/8", "broad")
+	tr.AddLabeled("10.1.0.0/16", "narrow")
+	tr.Compact()
+	if len(tr.meta) != 1 {
+		t.Errorf("Expected metadata for a single entry, got %v", len(tr.meta))
+	}
+	if label, _ := tr.Label(net.ParseIP("10.1.1.1")); label != "broad" {
+		t.Errorf("TrustedProxies.Label() = %q, want %q", label, "broad")
+	}
+}
+
+func TestTrustedProxies_KeepCanonical(t *testing.T) {
+	tr := New(KeepCanonical())
+	steps := []struct {
+		name string
+		do   func() error
+		want []string
+	}{
+		{"Add", func() error { return tr.AddFromString("192.168.0.0/16") }, []string{"192.168.0.0/16"}},
+		{"Add lower", func() error { return tr.AddFromString("10.0.0.0/8") }, []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{"Add IPv6", func() error { return tr.AddFromString("2001:db8::/32") }, []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Add duplicate", func() error { return tr.AddFromString("10.0.0.0/8") }, []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Add IPv4-mapped duplicate", func() error { return tr.AddFromString("::ffff:192.168.0.0/112") }, []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Add contained", func() error { return tr.AddFromString("10.1.0.0/16") }, []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Remove", func() error { return tr.RemoveFromString("10.0.0.0/8") }, []string{"10.1.0.0/16", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Add labeled duplicate", func() error { return tr.AddLabeled("10.1.0.0/16", "lab") }, []string{"10.1.0.0/16", "10.1.0.0/16", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Add port-restricted", func() error { return tr.AddForPorts("172.16.0.1", 443) }, []string{"10.1.0.0/16", "10.1.0.0/16", "172.16.0.1/32", "192.168.0.0/16", "2001:db8::/32"}},
+		{"Replace", func() error { return tr.ReplaceFromStrings([]string{"2001:db8::/32", "10.0.0.0/8", "10.0.0.0/8"}) }, []string{"10.0.0.0/8", "2001:db8::/32"}},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: error = %v", step.name, err)
+		}
+		if got := trustedStrings(tr); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: trusted entries = %v, want %v", step.name, got, step.want)
+		}
+	}
+	if len(tr.meta) != 2 {
+		t.Errorf("Expected metadata for 2 entries, got %v", len(tr.meta))
+	}
+}
+
+func TestTrustedProxies_TrustedCIDRsBySpecificity(t *testing.T) {
+	tr := New()
+	for _, spec := range []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1", "2001:db8::1", "172.16.0.0/12", "10.1.0.0/16", "::ffff:192.0.2.0/120", "fd00::/8", "192.0.2.0/24"} {
+		tr.AddFromString(spec)
+	}
+	want := []string{
+		"2001:db8::1/128",
+		"192.168.1.1/32",
+		"2001:db8::/32",
+		"192.0.2.0/24",
+		"192.0.2.0/24",
+		"10.1.0.0/16",
+		"172.16.0.0/12",
+		"10.0.0.0/8",
+		"fd00::/8",
+	}
+	got := []string{}
+	for _, ipnet := range tr.TrustedCIDRsBySpecificity() {
+		got = append(got, ipnet.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.TrustedCIDRsBySpecificity() = %v, want %v", got, want)
+	}
+
+	// The returned entries are copies
+	tr.TrustedCIDRsBySpecificity()[0].IP[0] = 0
+	if got := tr.TrustedCIDRsBySpecificity()[0].String(); got != want[0] {
+		t.Errorf("TrustedProxies.TrustedCIDRsBySpecificity()[0] = %v, want %v", got, want[0])
+	}
+}
+
+func TestTrustedProxies_Complement(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		within       string
+		want         []string
+		wantErr      error
+	}{
+		{"Nothing trusted", []string{}, "10.0.0.0/8", []string{"10.0.0.0/8"}, nil},
+		{"Everything trusted", []string{"10.0.0.0/8"}, "10.0.0.0/8", []string{}, nil},
+		{"Supernet trusted", []string{"0.0.0.0/0"}, "10.0.0.0/8", []string{}, nil},
+		{"Lower half trusted", []string{"10.0.0.0/9"}, "10.0.0.0/8", []string{"10.128.0.0/9"}, nil},
+		{"Single IP trusted", []string{"10.0.0.1"}, "10.0.0.0/30", []string{"10.0.0.0/32", "10.0.0.2/31"}, nil},
+		{"Fragmented", []string{"10.0.0.0/26", "10.0.0.128/27", "10.0.0.200"}, "10.0.0.0/24",
+			[]string{"10.0.0.64/26", "10.0.0.160/27", "10.0.0.192/29", "10.0.0.201/32", "10.0.0.202/31", "10.0.0.204/30", "10.0.0.208/28", "10.0.0.224/27"}, nil},
+		{"Overlapping and outside", []string{"10.0.0.0/25", "10.0.0.0/26", "192.168.0.0/16", "2001:db8::/32"}, "10.0.0.0/24", []string{"10.0.0.128/25"}, nil},
+		{"Straddling the edge", []string{"9.255.255.255", "10.0.0.0/31", "10.0.0.3"}, "10.0.0.0/30", []string{"10.0.0.2/32"}, nil},
+		{"End of address space", []string{"255.255.255.254"}, "255.255.255.252/30", []string{"255.255.255.252/31", "255.255.255.255/32"}, nil},
+		{"IPv6", []string{"2001:db8::/33"}, "2001:db8::/32", []string{"2001:db8:8000::/33"}, nil},
+		{"IPv4-mapped", []string{"::ffff:10.0.0.0/105"}, "10.0.0.0/8", []string{"10.128.0.0/9"}, nil},
+		{"Invalid", []string{}, "horse", nil, ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			nets, err := tr.Complement(tt.within)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrustedProxies.Complement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			got := []string{}
+			for _, ipnet := range nets {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.Complement() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidr      *net.IPNet
+		wantFirst string
+		wantLast  string
+	}{
+		{"IPv4 /24", optimisticParseCIDR("192.168.1.0/24"), "192.168.1.0", "192.168.1.255"},
+		{"IPv4 /32", optimisticParseCIDR("192.168.1.1/32"), "192.168.1.1", "192.168.1.1"},
+		{"IPv4 /31", optimisticParseCIDR("192.168.1.6/31"), "192.168.1.6", "192.168.1.7"},
+		{"IPv4 /0", optimisticParseCIDR("0.0.0.0/0"), "0.0.0.0", "255.255.255.255"},
+		{"IPv4 unmasked", &net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)}, "10.0.0.0", "10.255.255.255"},
+		{"IPv6 /64", optimisticParseCIDR("2001:db8::/64"), "2001:db8::", "2001:db8::ffff:ffff:ffff:ffff"},
+		{"IPv6 /128", optimisticParseCIDR(exampleIPv6Address + "/128"), exampleIPv6Address, exampleIPv6Address},
+		{"IPv6 /0", optimisticParseCIDR("::/0"), "::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last := Bounds(tt.cidr)
+			if !first.Equal(net.ParseIP(tt.wantFirst)) || !last.Equal(net.ParseIP(tt.wantLast)) {
+				t.Errorf("Bounds() = %v, %v, want %v, %v", first, last, tt.wantFirst, tt.wantLast)
+			}
+			if len(first) != len(tt.cidr.Mask) || len(last) != len(tt.cidr.Mask) {
+				t.Errorf("Bounds() returned addresses of the wrong family: %d, %d bytes", len(first), len(last))
+			}
+		})
+	}
+
+	if first, last := Bounds(&net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(8, 32)}); first != nil || last != nil {
+		t.Errorf("Bounds() = %v, %v, want nil, nil for mismatched mask", first, last)
+	}
+}
+
+func TestTrustedProxies_Subnets(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		prefixLen    int
+		want         []string
+		wantErr      error
+	}{
+		{"Empty", []string{}, 24, []string{}, nil},
+		{"/24 to /26", []string{"192.168.1.0/24"}, 26, []string{"192.168.1.0/26", "192.168.1.64/26", "192.168.1.128/26", "192.168.1.192/26"}, nil},
+		{"Same length", []string{"192.168.1.0/24"}, 24, []string{"192.168.1.0/24"}, nil},
+		{"Overlapping ranges", []string{"192.168.1.0/25", "192.168.1.0/24"}, 25, []string{"192.168.1.0/25", "192.168.1.128/25"}, nil},
+		{"IPv6 is skipped", []string{"2001:db8::/32", "10.0.0.0/31"}, 32, []string{"10.0.0.0/32", "10.0.0.1/32"}, nil},
+		{"IPv4-mapped", []string{"::ffff:10.0.0.0/127"}, 32, []string{"10.0.0.0/32", "10.0.0.1/32"}, nil},
+		{"Shorter than entry", []string{"192.168.1.0/24"}, 16, nil, ErrInvalidPrefixLength},
+		{"Out of range", []string{"192.168.1.0/24"}, 33, nil, ErrInvalidPrefixLength},
+		{"Negative", []string{"192.168.1.0/24"}, -1, nil, ErrInvalidPrefixLength},
+		{"Too many", []string{"0.0.0.0/0"}, 32, nil, ErrTooManySubnets},
+		{"Too many combined", []string{"10.0.0.0/12", "172.16.0.0/12"}, 32, nil, ErrTooManySubnets},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			subnets, err := tr.Subnets(tt.prefixLen)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrustedProxies.Subnets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			got := []string{}
+			for _, ipnet := range subnets {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.Subnets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_TrustedCIDRsFiltered(t *testing.T) {
+	tr := New()
+	for _, spec := range []string{"10.0.0.0/8", "8.8.8.0/24", "::ffff:192.168.1.0/120", "169.254.0.0/16", "2001:4860::/32", "fd00::/8", "fe80::/64", "0.0.0.0/0", "2001:db8::/32"} {
+		tr.AddFromString(spec)
+	}
+	tests := []struct {
+		name string
+		pred func(*net.IPNet) bool
+		want []string
+	}{
+		{"IPv4", IsIPv4Net, []string{"10.0.0.0/8", "8.8.8.0/24", "192.168.1.0/24", "169.254.0.0/16", "0.0.0.0/0"}},
+		{"IPv6", IsIPv6Net, []string{"2001:4860::/32", "fd00::/8", "fe80::/64", "2001:db8::/32"}},
+		{"Global", IsGlobalNet, []string{"8.8.8.0/24", "2001:4860::/32"}},
+		{"Private", IsPrivateNet, []string{"10.0.0.0/8", "192.168.1.0/24", "fd00::/8"}},
+		{"Link-local", IsLinkLocalNet, []string{"169.254.0.0/16", "fe80::/64"}},
+		{"Global IPv6", func(ipnet *net.IPNet) bool { return IsIPv6Net(ipnet) && IsGlobalNet(ipnet) }, []string{"2001:4860::/32"}},
+		{"Private IPv4", func(ipnet *net.IPNet) bool { return IsIPv4Net(ipnet) && IsPrivateNet(ipnet) }, []string{"10.0.0.0/8", "192.168.1.0/24"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, ipnet := range tr.TrustedCIDRsFiltered(tt.pred) {
+				got = append(got, ipnet.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.TrustedCIDRsFiltered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The result is a copy
+	tr.TrustedCIDRsFiltered(IsIPv4Net)[0].IP[0] = 11
+	if got := tr.TrustedCIDRs()[0].String(); got != "10.0.0.0/8" {
+		t.Errorf("TrustedProxies.TrustedCIDRsFiltered() returned entries of the list, first entry is now %v", got)
+	}
+}
+
+func TestTrustedProxies_OverlapRatio(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want float64
+	}{
+		{"Identical", []string{"10.0.0.0/8", "192.168.0.0/16"}, []string{"192.168.0.0/16", "10.0.0.0/8"}, 1},
+		{"Identical, different notation", []string{"10.0.0.0/8"}, []string{"10.0.0.0/9", "10.128.0.0/9", "::ffff:10.0.0.0/104"}, 1},
+		{"Disjoint", []string{"10.0.0.0/8"}, []string{"192.168.0.0/16"}, 0},
+		{"Disjoint families", []string{"0.0.0.0/0"}, []string{"::/96"}, 0},
+		{"Contained", []string{"10.0.0.0/8"}, []string{"10.0.0.0/9"}, 0.5},
+		{"Partial", []string{"10.0.0.0/9", "10.128.0.0/10"}, []string{"10.0.0.0/8"}, 0.75},
+		{"Partial, both sides", []string{"10.0.0.0/24", "10.0.1.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}, 1.0 / 3},
+		{"Duplicates", []string{"10.0.0.0/24", "10.0.0.0/25"}, []string{"10.0.0.0/24", "10.0.1.0/24"}, 0.5},
+		{"One empty", []string{"10.0.0.0/8"}, []string{}, 0},
+		{"Both empty", []string{}, []string{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := New(), New()
+			for _, spec := range tt.a {
+				a.AddFromString(spec)
+			}
+			for _, spec := range tt.b {
+				b.AddFromString(spec)
+			}
+			if got := a.OverlapRatio(b); got != tt.want {
+				t.Errorf("TrustedProxies.OverlapRatio() = %v, want %v", got, tt.want)
+			}
+			if got := b.OverlapRatio(a); got != tt.want {
+				t.Errorf("TrustedProxies.OverlapRatio() swapped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package trustedproxies
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DeduceResult describes the outcome of a client IP deduction
+type DeduceResult struct {
+	// Time is when the deduction was made
+	Time time.Time
+	// RemoteAddr and Header are the inputs of the deduction
+	RemoteAddr net.IP
+	Header     string
+	// ClientIP is the deduced client IP, or nil if none could be deduced
+	ClientIP net.IP
+	// TrustedHops is the number of trusted proxies walked through before
+	// reaching ClientIP
+	TrustedHops int
+	// FamilyMismatch is set if the remote address and all addresses in
+	// the header are of different families. Only detected with the
+	// DetectFamilyMismatch option.
+	FamilyMismatch bool
+	// Confidence is how far ClientIP can be relied upon, e.g. to weight
+	// it in risk scoring
+	Confidence Confidence
+}
+
+// Confidence rates a deduced client IP, see DeduceResult.Confidence
+type Confidence int
+
+const (
+	// ConfidenceLow is given if no client IP could be deduced, if the walk
+	// stopped short of the edge of the chain (the leftmost header entry),
+	// or if the peer is trusted but sent no header. The walk stops short
+	// at an untrusted hop, including the peer, followed by more entries,
+	// at an unparseable entry and at MaxHops. Either there are proxies
+	// missing from the list, or the entries beyond were made up, so
+	// ClientIP may well be a proxy.
+	ConfidenceLow Confidence = iota
+	// ConfidenceMedium is given if the walk reached the edge, but ClientIP
+	// is itself trusted, so may be a proxy rather than the client, or is
+	// a bogon (see IsBogon), e.g. as reported by a proxy in front of an
+	// internal network
+	ConfidenceMedium
+	// ConfidenceHigh is given if the walk reached the edge through
+	// trusted hops only, or there are none as the peer sent no header,
+	// and ClientIP is an untrusted, globally routable address
+	ConfidenceHigh
+)
+
+// String returns "low", "medium" or "high"
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceLow:
+		return "low"
+	case ConfidenceMedium:
+		return "medium"
+	case ConfidenceHigh:
+		return "high"
+	}
+	return "Confidence(" + strconv.Itoa(int(c)) + ")"
+}
+
+// clone returns a copy of r that shares no memory with it
+func (r DeduceResult) clone() DeduceResult {
+	r.RemoteAddr = copyIP(r.RemoteAddr)
+	r.ClientIP = copyIP(r.ClientIP)
+	return r
+}
+
+// DeduceClientIPDetailed works like DeduceClientIP, but returns details
+// about the deduction
+func (t *TrustedProxies) DeduceClientIPDetailed(remoteAddr net.IP, header string) DeduceResult {
+	result := DeduceResult{
+		Time:       t.clock(),
+		RemoteAddr: remoteAddr,
+		Header:     header,
+	}
+
+	buf := getChainBuf()
+	defer putChainBuf(buf)
+
+	t.mu.RLock()
+	unconfigured := t.unconfigured()
+	trustedIPs := t.walkInto(buf, remoteAddr, header)
+	truncated := t.truncated(buf.chain, trustedIPs)
+	result.Confidence = t.confidence(buf.chain, trustedIPs)
+	if t.detectFamilyMismatch {
+		result.FamilyMismatch = familyMismatch(remoteAddr, t.parseHeader(header))
+	}
+	t.mu.RUnlock()
+
+	if unconfigured && t.warnIfUnconfigured != nil && strings.TrimSpace(header) != "" {
+		t.warnIfUnconfiguredOnce.Do(t.warnIfUnconfigured)
+	}
+
+	if len(trustedIPs) > 0 {
+		result.ClientIP = copyIP(normalizeIP(*trustedIPs[len(trustedIPs)-1]))
+		result.TrustedHops = len(trustedIPs) - 1
+	}
+
+	t.observeHops(result.TrustedHops)
+	t.countLookup(result.TrustedHops > 0, truncated)
+
+	if t.history != nil {
+		t.history.add(result)
+	}
+	if t.warnOnPrivateClient != nil && result.ClientIP != nil && IsBogon(result.ClientIP) {
+		t.warnOnPrivateClient(result.clone())
+	}
+	return result
+}
+
+// confidence rates the client IP of walked, as returned by walkFrom,
+// walking chain, as returned by chainFor. See Confidence.
+func (t *TrustedProxies) confidence(chain, walked []*net.IP) Confidence {
+	if len(walked) == 0 || *walked[len(walked)-1] == nil {
+		return ConfidenceLow
+	}
+	client := walked[len(walked)-1]
+	if client != chain[0] {
+		return ConfidenceLow
+	}
+	if t.recheckHop(*client, len(walked)-1, anyPort) {
+		if len(chain) == 1 {
+			// A trusted peer that didn't say who it forwards for
+			return ConfidenceLow
+		}
+		return ConfidenceMedium
+	}
+	if IsBogon(*client) {
+		return ConfidenceMedium
+	}
+	return ConfidenceHigh
+}
+
+// MaxObservedHops returns the largest DeduceResult.TrustedHops seen by
+// DeduceClientIP and DeduceClientIPDetailed so far. A sudden increase may
+// indicate a spoofing attempt or a new tier of proxies.
+func (t *TrustedProxies) MaxObservedHops() int {
+	return int(atomic.LoadInt32(&t.maxObservedHops))
+}
+
+// observeHops raises the high-water mark returned by MaxObservedHops to
+// hops if needed
+func (t *TrustedProxies) observeHops(hops int) {
+	for {
+		current := atomic.LoadInt32(&t.maxObservedHops)
+		if int32(hops) <= current || atomic.CompareAndSwapInt32(&t.maxObservedHops, current, int32(hops)) {
+			return
+		}
+	}
+}
+
+// familyMismatch reports whether ips holds addresses, but none of
+// the same family as remoteAddr. IPv4-mapped IPv6 addresses count as
+// IPv4.
+func familyMismatch(remoteAddr net.IP, ips []*net.IP) bool {
+	if remoteAddr == nil {
+		return false
+	}
+	remoteIsV4 := remoteAddr.To4() != nil
+	seen := false
+	for _, ip := range ips {
+		if *ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == remoteIsV4 {
+			return false
+		}
+		seen = true
+	}
+	return seen
+}
+
+// IsGloballyRoutable reports whether the deduced client IP is a public
+// address, i.e. neither missing nor a bogon (see IsBogon)
+func (r DeduceResult) IsGloballyRoutable() bool {
+	return r.ClientIP != nil && !IsBogon(r.ClientIP)
+}
@@ -0,0 +1,241 @@
+package trustedproxies
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestTrustedProxies_DeduceClientIPDetailed(t *testing.T) {
+	tests := []struct {
+		name            string
+		trustedCIDRs    []string
+		remoteAddr      net.IP
+		header          string
+		wantClientIP    string
+		wantTrustedHops int
+	}{
+		{"Untrusted remote", []string{}, net.ParseIP("10.10.10.10"), "20.20.20.20", "10.10.10.10", 0},
+		{"Trusted remote", []string{"10.10.10.10"}, net.ParseIP("10.10.10.10"), "20.20.20.20", "20.20.20.20", 1},
+		{"Two trusted hops", []string{"10.10.10.10", "20.20.20.20"}, net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20", "30.30.30.30", 2},
+		{"No remote address", []string{}, nil, "20.20.20.20", "<nil>", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			got := tr.DeduceClientIPDetailed(tt.remoteAddr, tt.header)
+			if got.ClientIP.String() != tt.wantClientIP || got.TrustedHops != tt.wantTrustedHops {
+				t.Errorf("TrustedProxies.DeduceClientIPDetailed() = %v, %v, want %v, %v", got.ClientIP, got.TrustedHops, tt.wantClientIP, tt.wantTrustedHops)
+			}
+			if got.Header != tt.header || !got.RemoteAddr.Equal(tt.remoteAddr) {
+				t.Errorf("TrustedProxies.DeduceClientIPDetailed() inputs = %v, %q", got.RemoteAddr, got.Header)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_FamilyMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"IPv4 peer, IPv4 header", "10.10.10.10", "20.20.20.20, 30.30.30.30", false},
+		{"IPv6 peer, IPv6 header", "2001:db8::1", "2001:db8::2", false},
+		{"IPv6 peer, IPv4 header", "2001:db8::1", "20.20.20.20, 30.30.30.30", true},
+		{"IPv4 peer, IPv6 header", "10.10.10.10", "2001:db8::2", true},
+		{"IPv6 peer, mixed header", "2001:db8::1", "20.20.20.20, 2001:db8::2", false},
+		{"IPv4 peer, IPv4-mapped header", "10.10.10.10", "::ffff:20.20.20.20", false},
+		{"IPv6 peer, IPv4-mapped header", "2001:db8::1", "::ffff:20.20.20.20", true},
+		{"No header", "2001:db8::1", "", false},
+		{"Invalid header", "2001:db8::1", "horse", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(DetectFamilyMismatch())
+			if got := tr.DeduceClientIPDetailed(net.ParseIP(tt.remoteAddr), tt.header); got.FamilyMismatch != tt.want {
+				t.Errorf("DeduceResult.FamilyMismatch = %v, want %v", got.FamilyMismatch, tt.want)
+			}
+			if got := New().DeduceClientIPDetailed(net.ParseIP(tt.remoteAddr), tt.header); got.FamilyMismatch {
+				t.Errorf("DeduceResult.FamilyMismatch set without DetectFamilyMismatch")
+			}
+		})
+	}
+}
+
+func TestDeduceResult_IsGloballyRoutable(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientIP net.IP
+		want     bool
+	}{
+		{"Public IPv4", net.ParseIP("8.8.8.8"), true},
+		{"Public IPv6", net.ParseIP("2606:4700::1"), true},
+		{"Private IPv4", net.ParseIP("192.168.1.1"), false},
+		{"Private IPv6", net.ParseIP("fd00::1"), false},
+		{"CGNAT", net.ParseIP("100.64.1.1"), false},
+		{"Loopback", net.ParseIP("127.0.0.1"), false},
+		{"Documentation IPv6", net.ParseIP("2001:db8::1"), false},
+		{"Reserved", net.ParseIP("240.0.0.1"), false},
+		{"IPv4-mapped private", net.ParseIP("::ffff:10.0.0.1"), false},
+		{"No client IP", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := DeduceResult{ClientIP: tt.clientIP}
+			if got := r.IsGloballyRoutable(); got != tt.want {
+				t.Errorf("DeduceResult.IsGloballyRoutable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	if got := tr.DeduceClientIPDetailed(net.ParseIP("10.1.1.1"), "8.8.4.4").IsGloballyRoutable(); !got {
+		t.Errorf("DeduceResult.IsGloballyRoutable() = %v, want %v", got, true)
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPDetailedConfidence(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr net.IP
+		header     string
+		want       Confidence
+	}{
+		{"Trusted up to the edge", nil, net.ParseIP("10.0.0.1"), "8.8.8.8, 10.0.0.2", ConfidenceHigh},
+		{"Direct connection", nil, net.ParseIP("8.8.8.8"), "", ConfidenceHigh},
+		{"LeftmostWhenTrusted", []Option{LeftmostWhenTrusted()}, net.ParseIP("10.0.0.1"), "8.8.8.8, 9.9.9.9", ConfidenceHigh},
+		{"Early break", nil, net.ParseIP("10.0.0.1"), "8.8.8.8, 9.9.9.9", ConfidenceLow},
+		{"Untrusted peer with header", nil, net.ParseIP("9.9.9.9"), "8.8.8.8", ConfidenceLow},
+		{"Unparseable entry", nil, net.ParseIP("10.0.0.1"), "8.8.8.8, horse", ConfidenceLow},
+		{"Truncated by MaxHops", []Option{MaxHops(1)}, net.ParseIP("10.0.0.1"), "8.8.8.8, 10.0.0.2", ConfidenceLow},
+		{"Trusted peer without header", nil, net.ParseIP("10.0.0.1"), "", ConfidenceLow},
+		{"No remote address", nil, nil, "8.8.8.8", ConfidenceLow},
+		{"Trusted leftmost entry", nil, net.ParseIP("10.0.0.1"), "10.0.0.3, 10.0.0.2", ConfidenceMedium},
+		{"Bogon at the edge", nil, net.ParseIP("10.0.0.1"), "192.168.1.1", ConfidenceMedium},
+		{"Direct connection from a bogon", nil, net.ParseIP("192.168.1.1"), "", ConfidenceMedium},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(tt.opts...)
+			tr.AddFromString("10.0.0.0/8")
+			if got := tr.DeduceClientIPDetailed(tt.remoteAddr, tt.header).Confidence; got != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPDetailed() confidence = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPDetailedConfidenceMatchCount(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name   string
+		header string
+		want   uint64
+	}{
+		{"Trusted peer without header", "", 1},
+		{"Trusted up to the edge", "8.8.8.8, 10.0.0.2", 2},
+		{"Trusted leftmost entry", "10.0.0.3, 10.0.0.2", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(TrackMatches())
+			tr.AddFromString("10.0.0.0/8")
+			tr.DeduceClientIPDetailed(net.ParseIP("10.0.0.1"), tt.header)
+			if got := tr.MatchCount(ipnet); got != tt.want {
+				t.Errorf("TrustedProxies.MatchCount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfidence_String(t *testing.T) {
+	for c, want := range map[Confidence]string{ConfidenceLow: "low", ConfidenceMedium: "medium", ConfidenceHigh: "high", 7: "Confidence(7)"} {
+		if got := c.String(); got != want {
+			t.Errorf("Confidence.String() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTrustedProxies_DeduceClientIPDetailedPeerInHeader(t *testing.T) {
+	tests := []struct {
+		name            string
+		remoteAddr      string
+		header          string
+		wantClientIP    string
+		wantTrustedHops int
+	}{
+		{"Normal chain", "10.0.0.1", "20.20.20.20, 10.0.0.2", "20.20.20.20", 2},
+		{"Peer appended itself", "10.0.0.1", "20.20.20.20, 10.0.0.2, 10.0.0.1", "20.20.20.20", 2},
+		{"Peer appended itself, IPv4-mapped", "10.0.0.1", "20.20.20.20, ::ffff:10.0.0.1", "20.20.20.20", 1},
+		{"Only the peer", "10.0.0.1", "10.0.0.1", "10.0.0.1", 0},
+		{"Peer elsewhere in the header", "10.0.0.1", "10.0.0.1, 20.20.20.20", "20.20.20.20", 1},
+		{"Untrusted peer appended itself", "30.30.30.30", "20.20.20.20, 30.30.30.30", "30.30.30.30", 0},
+	}
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tr.DeduceClientIPDetailed(net.ParseIP(tt.remoteAddr), tt.header)
+			if got.ClientIP.String() != tt.wantClientIP || got.TrustedHops != tt.wantTrustedHops {
+				t.Errorf("TrustedProxies.DeduceClientIPDetailed() = %v, %v, want %v, %v", got.ClientIP, got.TrustedHops, tt.wantClientIP, tt.wantTrustedHops)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_MaxObservedHops(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+	if got := tr.MaxObservedHops(); got != 0 {
+		t.Errorf("TrustedProxies.MaxObservedHops() = %v, want %v", got, 0)
+	}
+
+	headers := []struct {
+		header string
+		want   int
+	}{
+		{"20.20.20.20", 1},
+		{"20.20.20.20, 10.0.0.2", 2},
+		{"20.20.20.20, 10.0.0.3, 10.0.0.2", 3},
+		// Shorter chains don't lower the high-water mark
+		{"20.20.20.20", 3},
+		{"", 3},
+		{"20.20.20.20, 10.0.0.5, 10.0.0.4, 10.0.0.3, 10.0.0.2", 5},
+	}
+	for _, h := range headers {
+		tr.DeduceClientIP(net.ParseIP("10.0.0.1"), h.header)
+		if got := tr.MaxObservedHops(); got != h.want {
+			t.Errorf("TrustedProxies.MaxObservedHops() after %q = %v, want %v", h.header, got, h.want)
+		}
+	}
+}
+
+func TestTrustedProxies_MaxObservedHopsConcurrent(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+
+	var wg sync.WaitGroup
+	for n := 1; n <= 20; n++ {
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			header := "20.20.20.20"
+			for i := 1; i < n; i++ {
+				header += ", 10.1.0.1"
+			}
+			tr.DeduceClientIP(net.ParseIP("10.0.0.1"), header)
+		}()
+	}
+	wg.Wait()
+	if got := tr.MaxObservedHops(); got != 20 {
+		t.Errorf("TrustedProxies.MaxObservedHops() = %v, want %v", got, 20)
+	}
+}
@@ -0,0 +1,135 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters of the client IPs deduced by DeduceClientIP and
+// DeduceClientIPDetailed, see TrustedProxies.Stats
+type Stats struct {
+	// Lookups is the number of deductions made
+	Lookups uint64
+	// Trusted is the number of lookups the peer was trusted for, i.e.
+	// the header was considered, and Untrusted the number of the others
+	Trusted, Untrusted uint64
+	// Truncations is the number of lookups cut short by MaxHops
+	Truncations uint64
+	// MaxHops is the value of MaxObservedHops
+	MaxHops int
+}
+
+// Stats returns the counters of the lookups made so far. As they are
+// read one by one, lookups made meanwhile may only be partly reflected.
+func (t *TrustedProxies) Stats() Stats {
+	// Lookups is raised first, so read it last to keep Trusted <= Lookups
+	trusted := atomic.LoadUint64(&t.trustedLookups)
+	truncations := atomic.LoadUint64(&t.truncations)
+	lookups := atomic.LoadUint64(&t.lookups)
+	return Stats{
+		Lookups:     lookups,
+		Trusted:     trusted,
+		Untrusted:   lookups - trusted,
+		Truncations: truncations,
+		MaxHops:     t.MaxObservedHops(),
+	}
+}
+
+// WriteMetrics writes the counters returned by Stats to w in the
+// Prometheus text exposition format, e.g. from the handler of a metrics
+// endpoint. Errors writing to w are ignored.
+func (t *TrustedProxies) WriteMetrics(w io.Writer) {
+	stats := t.Stats()
+	metrics := []struct {
+		name, kind, help string
+		value            uint64
+	}{
+		{"trustedproxies_lookups_total", "counter", "Client IPs deduced.", stats.Lookups},
+		{"trustedproxies_trusted_lookups_total", "counter", "Lookups the peer was trusted for.", stats.Trusted},
+		{"trustedproxies_untrusted_lookups_total", "counter", "Lookups the peer wasn't trusted for.", stats.Untrusted},
+		{"trustedproxies_truncations_total", "counter", "Lookups cut short by MaxHops.", stats.Truncations},
+		{"trustedproxies_max_observed_hops", "gauge", "Most trusted hops seen in a lookup.", uint64(stats.MaxHops)},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// countLookup counts a lookup for Stats
+func (t *TrustedProxies) countLookup(trusted, truncated bool) {
+	atomic.AddUint64(&t.lookups, 1)
+	if trusted {
+		atomic.AddUint64(&t.trustedLookups, 1)
+	}
+	if truncated {
+		atomic.AddUint64(&t.truncations, 1)
+	}
+}
+
+// truncated reports whether MaxHops cut short walking chain, as returned
+// by chainFor, i.e. whether walked, as returned by walkFrom, ends with a
+// trusted hop followed by another IP
+func (t *TrustedProxies) truncated(chain, walked []*net.IP) bool {
+	n := len(walked)
+	if t.maxHops <= 0 || t.leftmostWhenTrusted || n <= t.maxHops || n >= len(chain) || *chain[len(chain)-n-1] == nil {
+		return false
+	}
+	return t.recheckHop(*walked[n-1], n-1, anyPort)
+}
+
+// recordHit notes that ipnet just matched a lookup, if the TrackMatches
+// option is set. It only needs the read lock.
+func (t *TrustedProxies) recordHit(ipnet *net.IPNet) {
+	if !t.trackMatches {
+		return
+	}
+	if m, ok := t.meta[ipnet]; ok {
+		atomic.AddUint64(&m.hits, 1)
+		atomic.StoreInt64(&m.lastHit, t.clock().UnixNano())
+	}
+}
+
+// UnusedEntries returns a copy of the trusted entries that haven't
+// matched any lookup since the given time, in the order they are
+// matched, e.g. to find stale entries. Every lookup counts, including
+// those made by DeduceClientIP, SelfTest and similar. Entries added
+// after since that never matched are included, too. Matches are only
+// tracked with the TrackMatches option; without it, all entries are
+// returned.
+func (t *TrustedProxies) UnusedEntries(since time.Time) []*net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rv := []*net.IPNet{}
+	for _, ipnet := range t.trustedCIDRs {
+		var lastHit int64
+		if m, ok := t.meta[ipnet]; ok {
+			lastHit = atomic.LoadInt64(&m.lastHit)
+		}
+		if lastHit == 0 || time.Unix(0, lastHit).Before(since) {
+			rv = append(rv, copyNet(ipnet))
+		}
+	}
+	return rv
+}
+
+// MatchCount returns how many lookups matched the trusted entries for
+// ipnet so far. Lookups rejected by a deny list, DistrustTemporarily or
+// VerifyMatch don't count. A lookup walking a chain counts each hop it
+// decides on once. Matches are only counted with the TrackMatches
+// option; without it, MatchCount returns 0.
+func (t *TrustedProxies) MatchCount(ipnet *net.IPNet) uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var rv uint64
+	for _, entry := range t.trustedCIDRs {
+		if sameNet(entry, ipnet) {
+			if m, ok := t.meta[entry]; ok {
+				rv += atomic.LoadUint64(&m.hits)
+			}
+		}
+	}
+	return rv
+}
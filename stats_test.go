@@ -0,0 +1,200 @@
+package trustedproxies
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies_UnusedEntries(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	tr := New(TrackMatches(), Clock(func() time.Time { return now }))
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("192.168.0.0/16")
+	tr.AddFromString("172.16.0.0/12")
+	tr.AddFromString("2001:db8::/32")
+
+	want := []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12", "2001:db8::/32"}
+	if got := stringsOf(tr.UnusedEntries(start)); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.UnusedEntries() = %v, want %v", got, want)
+	}
+
+	ip := net.ParseIP("10.1.1.1")
+	tr.IsIPTrusted(&ip)
+	now = now.Add(time.Hour)
+	tr.DeduceClientIP(net.ParseIP("192.168.1.1"), "8.8.8.8")
+
+	tests := []struct {
+		name  string
+		since time.Time
+		want  []string
+	}{
+		{"Since the start", start, []string{"172.16.0.0/12", "2001:db8::/32"}},
+		{"Since the first lookup", start.Add(time.Minute), []string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8::/32"}},
+		{"Since the end", now.Add(time.Minute), want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringsOf(tr.UnusedEntries(tt.since)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrustedProxies.UnusedEntries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	_, private, _ := net.ParseCIDR("172.16.0.0/12")
+	if got := tr.MatchCount(ten); got != 1 {
+		t.Errorf("TrustedProxies.MatchCount() = %v, want %v", got, 1)
+	}
+	if got := tr.MatchCount(private); got != 0 {
+		t.Errorf("TrustedProxies.MatchCount() = %v, want %v", got, 0)
+	}
+
+	// Denied lookups don't count
+	tr.DenyFromString("172.16.6.6")
+	ip = net.ParseIP("172.16.6.6")
+	tr.IsIPTrusted(&ip)
+	if got := stringsOf(tr.UnusedEntries(start)); !reflect.DeepEqual(got, []string{"172.16.0.0/12", "2001:db8::/32"}) {
+		t.Errorf("TrustedProxies.UnusedEntries() = %v after a denied lookup", got)
+	}
+	if got := tr.MatchCount(private); got != 0 {
+		t.Errorf("TrustedProxies.MatchCount() = %v after a denied lookup", got)
+	}
+
+	// Entries kept by ApplyDelta keep their statistics
+	if err := tr.ApplyDelta([]string{"10.0.0.0/8", "172.16.0.0/12"}); err != nil {
+		t.Fatalf("TrustedProxies.ApplyDelta() error = %v", err)
+	}
+	if got := tr.MatchCount(ten); got != 1 {
+		t.Errorf("TrustedProxies.MatchCount() = %v after ApplyDelta, want %v", got, 1)
+	}
+	if got := stringsOf(tr.UnusedEntries(start)); !reflect.DeepEqual(got, []string{"172.16.0.0/12"}) {
+		t.Errorf("TrustedProxies.UnusedEntries() = %v after ApplyDelta", got)
+	}
+}
+
+func TestTrustedProxies_UntrackedMatches(t *testing.T) {
+	clockReads := 0
+	tr := New(Clock(func() time.Time {
+		clockReads++
+		return time.Now()
+	}))
+	tr.AddFromString("10.0.0.0/8")
+	if !tr.IsIPv4Trusted([4]byte{10, 0, 0, 1}) {
+		t.Fatalf("TrustedProxies.IsIPv4Trusted() = false, want true")
+	}
+	if clockReads != 0 {
+		t.Errorf("TrustedProxies.IsIPv4Trusted() read the clock %d times, want 0", clockReads)
+	}
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	if got := tr.MatchCount(ten); got != 0 {
+		t.Errorf("TrustedProxies.MatchCount() = %v without TrackMatches, want 0", got)
+	}
+	if got := stringsOf(tr.UnusedEntries(time.Time{})); !reflect.DeepEqual(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("TrustedProxies.UnusedEntries() = %v without TrackMatches, want %v", got, []string{"10.0.0.0/8"})
+	}
+}
+
+func TestTrustedProxies_UnusedEntriesConcurrently(t *testing.T) {
+	tr := New(TrackMatches())
+	tr.AddFromString("10.0.0.0/8")
+	tr.AddFromString("192.168.0.0/16")
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 10; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				tr.DeduceClientIP(net.ParseIP("10.0.0.1"), "8.8.8.8")
+				tr.UnusedEntries(time.Time{})
+			}
+		}()
+	}
+	wg.Wait()
+	if got := stringsOf(tr.UnusedEntries(time.Now().Add(-time.Hour))); !reflect.DeepEqual(got, []string{"192.168.0.0/16"}) {
+		t.Errorf("TrustedProxies.UnusedEntries() = %v, want %v", got, []string{"192.168.0.0/16"})
+	}
+}
+
+func TestTrustedProxies_MatchCountOncePerHop(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	remote := net.ParseIP("10.0.0.1")
+	tests := []struct {
+		name    string
+		maxHops int
+		header  string
+		lookup  func(tr *TrustedProxies, header string)
+		want    uint64
+	}{
+		{"DeduceClientIP", 0, "8.8.8.8, 10.0.0.2", func(tr *TrustedProxies, header string) { tr.DeduceClientIP(remote, header) }, 2},
+		{"DeduceClientIP truncated", 1, "8.8.8.8, 10.0.0.2", func(tr *TrustedProxies, header string) { tr.DeduceClientIP(remote, header) }, 1},
+		{"OutermostUntrusted", 0, "10.0.0.3, 10.0.0.2", func(tr *TrustedProxies, header string) { tr.OutermostUntrusted(remote, header) }, 3},
+		{"SpoofRisk", 0, "10.0.0.3, 10.0.0.2", func(tr *TrustedProxies, header string) { tr.SpoofRisk(remote, header) }, 3},
+		{"MatchedRanges", 0, "8.8.8.8, 10.0.0.2", func(tr *TrustedProxies, header string) { tr.MatchedRanges(remote, header) }, 2},
+		{"ChainMatchesTopology", 0, "8.8.8.8, 10.0.0.2", func(tr *TrustedProxies, header string) {
+			tr.ChainMatchesTopology(remote, header, []*net.IPNet{ipnet})
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(TrackMatches(), MaxHops(tt.maxHops))
+			tr.AddFromString("10.0.0.0/8")
+			tt.lookup(tr, tt.header)
+			if got := tr.MatchCount(ipnet); got != tt.want {
+				t.Errorf("TrustedProxies.MatchCount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// statsFixture makes four lookups: three with a trusted peer, one of
+// them cut short by MaxHops, and one with an untrusted peer
+func statsFixture() *TrustedProxies {
+	tr := New(MaxHops(2))
+	tr.AddFromString("10.10.10.10")
+	tr.AddFromString("20.20.20.20")
+	tr.AddFromString("30.30.30.30")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "40.40.40.40, 20.20.20.20")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "40.40.40.40, 30.30.30.30, 20.20.20.20")
+	tr.DeduceClientIP(net.ParseIP("10.10.10.10"), "30.30.30.30, 20.20.20.20")
+	tr.DeduceClientIP(net.ParseIP("50.50.50.50"), "1.1.1.1")
+	return tr
+}
+
+func TestTrustedProxies_Stats(t *testing.T) {
+	if got := New().Stats(); !reflect.DeepEqual(got, Stats{}) {
+		t.Errorf("TrustedProxies.Stats() = %+v, want %+v", got, Stats{})
+	}
+	want := Stats{Lookups: 4, Trusted: 3, Untrusted: 1, Truncations: 1, MaxHops: 2}
+	if got := statsFixture().Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTrustedProxies_WriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	statsFixture().WriteMetrics(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		"# TYPE trustedproxies_lookups_total counter\ntrustedproxies_lookups_total 4\n",
+		"\ntrustedproxies_trusted_lookups_total 3\n",
+		"\ntrustedproxies_untrusted_lookups_total 1\n",
+		"\ntrustedproxies_truncations_total 1\n",
+		"# TYPE trustedproxies_max_observed_hops gauge\ntrustedproxies_max_observed_hops 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("TrustedProxies.WriteMetrics() = %q, want it to contain %q", got, want)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# HELP trustedproxies_") && !strings.HasPrefix(line, "# TYPE trustedproxies_") && !strings.HasPrefix(line, "trustedproxies_") {
+			t.Errorf("TrustedProxies.WriteMetrics() wrote unexpected line %q", line)
+		}
+	}
+}
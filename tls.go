@@ -0,0 +1,53 @@
+package trustedproxies
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// SPKIFingerprint returns the hex encoded SHA-256 hash of cert's
+// SubjectPublicKeyInfo
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint lowercases fp and strips colons
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fp), ":", "", -1))
+}
+
+// IsTLSPeerTrusted reports whether the leaf certificate presented by the
+// peer of state has a fingerprint added with TrustedCertFingerprints
+func (t *TrustedProxies) IsTLSPeerTrusted(state *tls.ConnectionState) bool {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	fp := SPKIFingerprint(state.PeerCertificates[0])
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.trustedCertFingerprints[fp]
+	return ok
+}
+
+// DeduceClientIPFromTLS works like DeduceClientIP for a connection with
+// the given TLS state, e.g. from a gRPC interceptor:
+//
+//	p, _ := peer.FromContext(ctx)
+//	tlsInfo, _ := p.AuthInfo.(credentials.TLSInfo)
+//	clientIP := tp.DeduceClientIPFromTLS(remoteAddr, header, &tlsInfo.State)
+//
+// If the peer's certificate is trusted (see IsTLSPeerTrusted), the peer
+// is trusted regardless of remoteAddr, and the header is walked as usual.
+func (t *TrustedProxies) DeduceClientIPFromTLS(remoteAddr net.IP, header string, state *tls.ConnectionState) *net.IP {
+	trustPeer := t.IsTLSPeerTrusted(state)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return lastHop(t.walkChain(t.chainFor(remoteAddr, header), anyPort, trustPeer))
+}
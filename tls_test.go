@@ -0,0 +1,83 @@
+package trustedproxies
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() error = %v", err)
+	}
+	return cert
+}
+
+func TestTrustedProxies_DeduceClientIPFromTLS(t *testing.T) {
+	trustedCert := testCertificate(t)
+	otherCert := testCertificate(t)
+
+	// Upper case and colons are accepted
+	fp := strings.ToUpper(SPKIFingerprint(trustedCert))
+	fp = fp[:2] + ":" + fp[2:]
+
+	tests := []struct {
+		name       string
+		state      *tls.ConnectionState
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"Trusted cert", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{trustedCert}}, "20.20.20.20", "30.30.30.30", "30.30.30.30"},
+		{"Trusted cert, trusted hop in header", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{trustedCert}}, "20.20.20.20", "30.30.30.30, 10.0.0.1", "30.30.30.30"},
+		{"Trusted cert, no header", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{trustedCert}}, "20.20.20.20", "", "20.20.20.20"},
+		{"Other cert", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherCert}}, "20.20.20.20", "30.30.30.30", "20.20.20.20"},
+		{"No cert", &tls.ConnectionState{}, "20.20.20.20", "30.30.30.30", "20.20.20.20"},
+		{"No TLS", nil, "20.20.20.20", "30.30.30.30", "20.20.20.20"},
+		{"No TLS, trusted address", nil, "10.0.0.1", "30.30.30.30", "30.30.30.30"},
+	}
+	tr := New(TrustedCertFingerprints(fp))
+	tr.AddFromString("10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.DeduceClientIPFromTLS(net.ParseIP(tt.remoteAddr), tt.header, tt.state); got.String() != tt.want {
+				t.Errorf("TrustedProxies.DeduceClientIPFromTLS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_IsTLSPeerTrusted(t *testing.T) {
+	cert := testCertificate(t)
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	if got := New().IsTLSPeerTrusted(state); got {
+		t.Errorf("TrustedProxies.IsTLSPeerTrusted() = %v, want %v", got, false)
+	}
+	if got := New(TrustedCertFingerprints(SPKIFingerprint(cert))).IsTLSPeerTrusted(state); !got {
+		t.Errorf("TrustedProxies.IsTLSPeerTrusted() = %v, want %v", got, true)
+	}
+}
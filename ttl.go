@@ -0,0 +1,118 @@
+package trustedproxies
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// AddWithTTL works like AddFromString, but the entry is only trusted
+// for ttl from now on. Exclusions in s are permanent. Expired entries
+// stay in the list, so that IsIPTrustedAt can still answer for past
+// times, until they are removed like any other entry.
+func (t *TrustedProxies) AddWithTTL(s string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: invalid TTL %v for %s", ErrInvalidIPSpecification, ttl, s)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.canonicalize()
+	nets, err := t.addFromString(s)
+	if err != nil {
+		return err
+	}
+	added := t.clock()
+	for _, ipnet := range nets {
+		m := t.metaFor(ipnet)
+		m.added = added
+		m.expires = added.Add(ttl)
+	}
+	t.hasTTL = true
+	return nil
+}
+
+// IsIPTrustedAt works like IsIPTrusted, but reports whether ip was (or
+// will be) trusted at the given time: entries added with AddWithTTL only
+// match from when they were added until they expire. Other entries
+// always match, no matter when they were added. Likewise, ip is
+// untrusted while distrusted by DistrustTemporarily.
+func (t *TrustedProxies) IsIPTrustedAt(ip net.IP, at time.Time) *net.IPNet {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return copyNet(t.effectiveTrust(ip, at))
+}
+
+// window is a period of time, from (inclusive) until (exclusive)
+type window struct {
+	from, until time.Time
+}
+
+// DistrustTemporarily puts ip on a temporary deny list for d from now
+// on, e.g. to take a misbehaving proxy out of the chain during an
+// incident without changing the configuration. It is kept across
+// ReplaceFromStrings and similar, and is lifted automatically once d has
+// passed, as told by the Clock. Calling it again for the same ip starts
+// a new window; d <= 0 lifts the distrust right away.
+func (t *TrustedProxies) DistrustTemporarily(ip net.IP, d time.Duration) {
+	key := string(ip.To16())
+	if key == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock()
+	for k, w := range t.distrusted {
+		if !now.Before(w.until) {
+			delete(t.distrusted, k)
+		}
+	}
+	if d <= 0 {
+		delete(t.distrusted, key)
+		return
+	}
+	if t.distrusted == nil {
+		t.distrusted = map[string]window{}
+	}
+	t.distrusted[key] = window{from: now, until: now.Add(d)}
+	t.hasTTL = true
+}
+
+// distrustedAt reports whether ip is temporarily distrusted at the given
+// time, see DistrustTemporarily
+func (t *TrustedProxies) distrustedAt(ip net.IP, at time.Time) bool {
+	if len(t.distrusted) == 0 {
+		return false
+	}
+	w, ok := t.distrusted[string(ip.To16())]
+	return ok && !at.Before(w.from) && at.Before(w.until)
+}
+
+// validAt reports whether ipnet is trusted at the given time
+func (t *TrustedProxies) validAt(ipnet *net.IPNet, at time.Time) bool {
+	if !t.hasTTL {
+		return true
+	}
+	m, ok := t.meta[ipnet]
+	if !ok || m.expires.IsZero() {
+		return true
+	}
+	return !at.Before(m.added) && at.Before(m.expires)
+}
+
+// expiryOf returns when ipnet expires, or the zero time if it doesn't
+func (t *TrustedProxies) expiryOf(ipnet *net.IPNet) time.Time {
+	if m, ok := t.meta[ipnet]; ok {
+		return m.expires
+	}
+	return time.Time{}
+}
+
+// clock returns the current time
+func (t *TrustedProxies) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,203 @@
+package trustedproxies
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies_IsIPTrustedAt(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := New(Clock(func() time.Time { return start }))
+	if err := tr.AddWithTTL("10.0.0.0/8", time.Hour); err != nil {
+		t.Fatalf("TrustedProxies.AddWithTTL() error = %v", err)
+	}
+	tr.AddFromString("192.168.0.0/16")
+
+	tests := []struct {
+		name string
+		ip   string
+		at   time.Time
+		want bool
+	}{
+		{"Before it was added", "10.1.1.1", start.Add(-time.Second), false},
+		{"When it was added", "10.1.1.1", start, true},
+		{"While valid", "10.1.1.1", start.Add(59 * time.Minute), true},
+		{"When it expires", "10.1.1.1", start.Add(time.Hour), false},
+		{"After it expired", "10.1.1.1", start.Add(2 * time.Hour), false},
+		{"Permanent entry", "192.168.1.1", start.Add(-time.Hour), true},
+		{"Permanent entry later", "192.168.1.1", start.Add(24 * time.Hour), true},
+		{"Untrusted", "8.8.8.8", start, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.IsIPTrustedAt(net.ParseIP(tt.ip), tt.at); (got != nil) != tt.want {
+				t.Errorf("TrustedProxies.IsIPTrustedAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_AddWithTTLExpires(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := New(Clock(func() time.Time { return now }))
+	if err := tr.AddWithTTL("10.0.0.1", time.Minute); err != nil {
+		t.Fatalf("TrustedProxies.AddWithTTL() error = %v", err)
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	if got := tr.IsIPTrusted(&ip); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want a match", got)
+	}
+	if got := tr.DeduceClientIP(ip, "8.8.8.8"); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "8.8.8.8")
+	}
+
+	now = now.Add(time.Minute)
+	if got := tr.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+	if got := tr.DeduceClientIP(ip, "8.8.8.8"); got.String() != "10.0.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.0.0.1")
+	}
+}
+
+func TestTrustedProxies_AddWithTTLErrors(t *testing.T) {
+	tr := New()
+	if err := tr.AddWithTTL("10.0.0.1", 0); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.AddWithTTL() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+	if err := tr.AddWithTTL("horse", time.Minute); !errors.Is(err, ErrInvalidIPSpecification) {
+		t.Errorf("TrustedProxies.AddWithTTL() error = %v, wantErr %v", err, ErrInvalidIPSpecification)
+	}
+}
+
+func TestTrustedProxies_DistrustTemporarily(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := New(Clock(func() time.Time { return now }))
+	tr.AddFromString("10.0.0.0/8")
+
+	ip := net.ParseIP("10.0.0.1")
+	other := net.ParseIP("10.0.0.2")
+	tr.DistrustTemporarily(ip, 10*time.Minute)
+	if got := tr.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+	if got := tr.IsIPTrusted(&other); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want a match", got)
+	}
+	if got := tr.DeduceClientIP(ip, "8.8.8.8"); got.String() != "10.0.0.1" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.0.0.1")
+	}
+
+	// It survives reloading the configuration
+	if err := tr.ReplaceFromStrings([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("TrustedProxies.ReplaceFromStrings() error = %v", err)
+	}
+	now = now.Add(9 * time.Minute)
+	if got := tr.IsIPTrusted(&ip); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+	}
+
+	now = now.Add(time.Minute)
+	if got := tr.IsIPTrusted(&ip); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v after the window, want a match", got)
+	}
+	if got := tr.DeduceClientIP(ip, "8.8.8.8"); got.String() != "8.8.8.8" {
+		t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "8.8.8.8")
+	}
+	if got := tr.IsIPTrustedAt(ip, now.Add(-5*time.Minute)); got != nil {
+		t.Errorf("TrustedProxies.IsIPTrustedAt() = %v during the window, want nil", got)
+	}
+
+	// Lifting it early, for the IPv4-mapped form
+	tr.DistrustTemporarily(ip, time.Hour)
+	tr.DistrustTemporarily(net.ParseIP("::ffff:10.0.0.1"), 0)
+	if got := tr.IsIPTrusted(&ip); got == nil {
+		t.Errorf("TrustedProxies.IsIPTrusted() = %v after lifting, want a match", got)
+	}
+}
+
+func TestTrustedProxies_EffectiveTrustEntryPoints(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := New(Clock(func() time.Time { return now }))
+	tr.AddFromString("10.0.0.0/8 !10.6.6.0/24")
+	if err := tr.AddWithTTL("192.168.0.0/16", time.Minute); err != nil {
+		t.Fatalf("TrustedProxies.AddWithTTL() error = %v", err)
+	}
+	tr.DistrustTemporarily(net.ParseIP("10.7.7.7"), time.Hour)
+	now = now.Add(time.Minute)
+
+	const client = "203.0.113.1"
+	entryPoints := []struct {
+		name    string
+		trusted func(ip net.IP) bool
+	}{
+		{"IsIPTrusted", func(ip net.IP) bool { return tr.IsIPTrusted(&ip) != nil }},
+		{"IsIPv4Trusted", func(ip net.IP) bool {
+			var b [4]byte
+			copy(b[:], ip.To4())
+			return tr.IsIPv4Trusted(b)
+		}},
+		{"IsIPv6Trusted", func(ip net.IP) bool {
+			var b [16]byte
+			copy(b[:], ip.To16())
+			return tr.IsIPv6Trusted(b)
+		}},
+		{"IsBytesTrusted", func(ip net.IP) bool {
+			ok, _ := tr.IsBytesTrusted(ip.To4())
+			return ok
+		}},
+		{"IsTrustedNetAddr", func(ip net.IP) bool { return tr.IsTrustedNetAddr(&net.TCPAddr{IP: ip}) }},
+		{"IsIPTrustedExcluding", func(ip net.IP) bool { return tr.IsIPTrustedExcluding(ip, nil) != nil }},
+		{"IsIPTrustedAt", func(ip net.IP) bool { return tr.IsIPTrustedAt(ip, now) != nil }},
+		{"MatchLabeled", func(ip net.IP) bool {
+			_, _, ok := tr.MatchLabeled(ip)
+			return ok
+		}},
+		{"MatchIndex", func(ip net.IP) bool { return tr.MatchIndex(ip) >= 0 }},
+		{"MatchedSpec", func(ip net.IP) bool {
+			_, ok := tr.MatchedSpec(ip)
+			return ok
+		}},
+		{"EntryTrusting", func(ip net.IP) bool {
+			_, ok := tr.EntryTrusting(ip)
+			return ok
+		}},
+		{"DeduceClientIP", func(ip net.IP) bool { return tr.DeduceClientIP(ip, client).String() == client }},
+		{"DeduceClientIPDetailed", func(ip net.IP) bool { return tr.DeduceClientIPDetailed(ip, client).TrustedHops > 0 }},
+		{"DeduceClientIPForPort", func(ip net.IP) bool { return tr.DeduceClientIPForPort(ip, client, 443).String() == client }},
+		{"DeduceBatch", func(ip net.IP) bool {
+			return tr.DeduceBatch([]ChainInput{{RemoteAddr: ip, Header: client}})[0].String() == client
+		}},
+		{"DeduceFromChain", func(ip net.IP) bool {
+			return tr.DeduceFromChain([]net.IP{net.ParseIP(client), ip}).String() == client
+		}},
+		{"ChainIter", func(ip net.IP) bool {
+			return len(collect(tr.ChainIter(ip, client))) == 2
+		}},
+		{"MatchedRanges", func(ip net.IP) bool { return len(tr.MatchedRanges(ip, client)) > 0 }},
+		{"AllHopsTrusted", func(ip net.IP) bool { return tr.AllHopsTrusted(ip, "") }},
+	}
+	ips := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"Trusted", "10.0.0.1", true},
+		{"Denied", "10.6.6.6", false},
+		{"Expired", "192.168.1.1", false},
+		{"Distrusted", "10.7.7.7", false},
+		{"Untrusted", "198.51.100.1", false},
+	}
+	for _, ep := range entryPoints {
+		t.Run(ep.name, func(t *testing.T) {
+			for _, tt := range ips {
+				if got := ep.trusted(net.ParseIP(tt.ip)); got != tt.want {
+					t.Errorf("%s: TrustedProxies.%s() trusts %v = %v, want %v", tt.name, ep.name, tt.ip, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package trustedproxies
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// ErrGoldenMismatch indicates a request of a golden log yields a client
+// IP other than the recorded one, see ReplayAgainstGolden
+var ErrGoldenMismatch = errors.New("golden mismatch")
+
+// ErrSelfTestFailed indicates the configuration doesn't yield the
+// expected client IP for a synthetic request, see SelfTest
+var ErrSelfTestFailed = errors.New("self-test failed")
+
+// selfTestClients are the candidates for the client of the synthetic
+// requests of SelfTest
+var selfTestClients = []string{
+	"192.0.2.1", "198.51.100.1", "203.0.113.1", "8.8.8.8", "1.1.1.1",
+	"2001:db8::1", "2001:4860:4860::8888", "2606:4700:4700::1111",
+}
+
+// familyNames names the families as returned by familyOf
+var familyNames = [2]string{"IPv4", "IPv6"}
+
+// selfTestMaxProxies limits the number of proxies per synthetic request
+const selfTestMaxProxies = 8
+
+// Validate checks the configuration for likely mistakes. Currently, it
+// reports trusted entries that are also on the deny list exactly, which
+// are never trusted as the deny list always wins. It returns nil if no
+// problems were found, otherwise an error listing all of them.
+func (t *TrustedProxies) Validate() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	denied := t.deniedNets()
+	errs := errorList{}
+	for _, ipnet := range t.trustedCIDRs {
+		c := canonicalNet(ipnet)
+		for _, d := range denied {
+			if sameNet(c, d) {
+				errs = append(errs, fmt.Errorf("%w: %s", ErrConflictingEntries, c))
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SelfTest checks that the configuration can actually tell clients from
+// proxies, e.g. for a readiness probe. For each address family with
+// trusted entries, it sends a synthetic request from an untrusted client
+// through a chain of trusted proxies, one address from each entry, and
+// checks that the client is deduced. This fails if, for example, an
+// entry like 0.0.0.0/0 trusts every client. Returns nil if all
+// requests yield their client.
+func (t *TrustedProxies) SelfTest() error {
+	t.mu.RLock()
+	maxHops, skipBogons := t.maxHops, t.skipBogonsInHeader
+	chains := [2][]net.IP{}
+	seen := map[string]bool{}
+	for _, ipnet := range t.trustedCIDRs {
+		first, _ := Bounds(canonicalNet(ipnet))
+		if first == nil || seen[string(first)] || t.effectiveTrust(first, t.lookupTime()) == nil {
+			continue
+		}
+		seen[string(first)] = true
+		family := familyOf(first)
+		if len(chains[family]) < selfTestMaxProxies {
+			chains[family] = append(chains[family], first)
+		}
+	}
+	clients := [2]net.IP{}
+	for _, s := range selfTestClients {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		family := familyOf(ip)
+		if clients[family] == nil && t.effectiveTrust(ip, t.lookupTime()) == nil && !(skipBogons && IsBogon(ip)) {
+			clients[family] = ip
+		}
+	}
+	t.mu.RUnlock()
+
+	errs := errorList{}
+	for family, proxies := range chains {
+		if len(proxies) == 0 {
+			continue
+		}
+		client := clients[family]
+		if client == nil {
+			errs = append(errs, fmt.Errorf("%w: no untrusted %s address found to act as the client", ErrSelfTestFailed, familyNames[family]))
+			continue
+		}
+		if maxHops > 0 && len(proxies) > maxHops {
+			proxies = proxies[:maxHops]
+		}
+
+		// The header lists the client followed by every proxy but the
+		// last, which is the peer
+		header := client.String()
+		for _, proxy := range proxies[:len(proxies)-1] {
+			header += ", " + proxy.String()
+		}
+		peer := proxies[len(proxies)-1]
+		if got, _ := t.OutermostUntrusted(peer, header); got == nil || !got.Equal(client) {
+			errs = append(errs, fmt.Errorf("%w: request from %s with header %q yields %v, want %s", ErrSelfTestFailed, peer, header, got, client))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ReplayAgainstGolden replays the requests of a golden log and checks
+// that each yields the recorded client IP, e.g. to lock down the
+// behaviour of a configuration in CI. Each line of r has the form
+//
+//	remoteAddr|header|expectedClient
+//
+// where expectedClient is empty if no client IP should be deduced, e.g.
+// for an invalid remoteAddr. Empty lines and lines starting with "#" are
+// ignored. Returns nil if every request matches, otherwise an error
+// listing every mismatch (see ErrGoldenMismatch) and malformed line.
+func (t *TrustedProxies) ReplayAgainstGolden(r io.Reader) error {
+	errs := errorList{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) != 3 {
+			errs = append(errs, fmt.Errorf("line %d: expected remoteAddr|header|expectedClient, got %q", lineNo, line))
+			continue
+		}
+
+		var want net.IP
+		if s := strings.TrimSpace(fields[2]); s != "" {
+			if want = net.ParseIP(s); want == nil {
+				errs = append(errs, fmt.Errorf("line %d: %w: %s", lineNo, ErrInvalidIPSpecification, s))
+				continue
+			}
+		}
+		remoteAddr := net.ParseIP(strings.TrimSpace(fields[0]))
+		got, _ := t.OutermostUntrusted(remoteAddr, fields[1])
+		if (got == nil) != (want == nil) || (got != nil && !got.Equal(want)) {
+			errs = append(errs, fmt.Errorf("line %d: %w: got %v, want %v", lineNo, ErrGoldenMismatch, got, want))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
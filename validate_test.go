@@ -0,0 +1,139 @@
+package trustedproxies
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxies_Validate(t *testing.T) {
+	tests := []struct {
+		name         string
+		trustedCIDRs []string
+		deniedCIDRs  []string
+		wantErr      error
+	}{
+		{"Empty", []string{}, []string{}, nil},
+		{"No conflict", []string{"10.0.0.0/8"}, []string{"10.6.6.0/24"}, nil},
+		{"Same CIDR", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, ErrConflictingEntries},
+		{"Same IP", []string{"10.0.0.1"}, []string{"10.0.0.1/32"}, ErrConflictingEntries},
+		{"Same IPv6 CIDR", []string{"2001:db8::/32"}, []string{"2001:db8::/32"}, ErrConflictingEntries},
+		{"IPv4-mapped", []string{"::ffff:10.0.0.0/104"}, []string{"10.0.0.0/8"}, ErrConflictingEntries},
+		{"Exclusion of the whole range", []string{"10.0.0.0/8 !10.0.0.0/8"}, []string{}, ErrConflictingEntries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New()
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			for _, t := range tt.deniedCIDRs {
+				tr.DenyFromString(t)
+			}
+			if err := tr.Validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("TrustedProxies.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_DenyWinsOverAllowOfSameCIDR(t *testing.T) {
+	for _, order := range []string{"allow first", "deny first"} {
+		t.Run(order, func(t *testing.T) {
+			tr := New()
+			if order == "allow first" {
+				tr.AddFromString("10.0.0.0/8")
+				tr.DenyFromString("10.0.0.0/8")
+			} else {
+				tr.DenyFromString("10.0.0.0/8")
+				tr.AddFromString("10.0.0.0/8")
+			}
+			ip := net.ParseIP("10.1.2.3")
+			if got := tr.IsIPTrusted(&ip); got != nil {
+				t.Errorf("TrustedProxies.IsIPTrusted() = %v, want nil", got)
+			}
+			if got := tr.DeduceClientIP(ip, "8.8.8.8"); got.String() != "10.1.2.3" {
+				t.Errorf("TrustedProxies.DeduceClientIP() = %v, want %v", got, "10.1.2.3")
+			}
+		})
+	}
+}
+
+func TestTrustedProxies_SelfTest(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		trustedCIDRs []string
+		wantErr      error
+	}{
+		{"Empty", nil, []string{}, nil},
+		{"Healthy", nil, []string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8:1::/48"}, nil},
+		{"Healthy with max hops", []Option{MaxHops(1)}, []string{"10.0.0.0/8", "172.16.0.0/12"}, nil},
+		{"Healthy skipping bogons", []Option{SkipBogonsInHeader()}, []string{"10.0.0.0/8", "172.16.0.0/12"}, nil},
+		{"Documentation ranges trusted", nil, []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}, nil},
+		{"Trusts everything", nil, []string{"0.0.0.0/0"}, ErrSelfTestFailed},
+		{"Trusts every IPv6 address", nil, []string{"10.0.0.0/8", "::/0"}, ErrSelfTestFailed},
+		{"Trusts every candidate", nil, []string{"0.0.0.0/1", "128.0.0.0/1"}, ErrSelfTestFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(tt.opts...)
+			for _, t := range tt.trustedCIDRs {
+				tr.AddFromString(t)
+			}
+			if err := tr.SelfTest(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("TrustedProxies.SelfTest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A policy distrusting every proxy breaks deduction, too
+	tr := New(Policy(TrustPolicyFunc(func(HopInfo) bool { return false })))
+	tr.AddFromString("10.0.0.0/8")
+	if err := tr.SelfTest(); !errors.Is(err, ErrSelfTestFailed) {
+		t.Errorf("TrustedProxies.SelfTest() error = %v, wantErr %v", err, ErrSelfTestFailed)
+	}
+}
+
+func TestTrustedProxies_ReplayAgainstGolden(t *testing.T) {
+	tr := New()
+	tr.AddFromString("10.0.0.0/8")
+
+	golden := `
+# remoteAddr|header|expectedClient
+10.0.0.1|30.30.30.30, 10.0.0.2|30.30.30.30
+10.0.0.1||10.0.0.1
+40.40.40.40|30.30.30.30|40.40.40.40
+horse|30.30.30.30|
+`
+	if err := tr.ReplayAgainstGolden(strings.NewReader(golden)); err != nil {
+		t.Errorf("TrustedProxies.ReplayAgainstGolden() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		golden  string
+		wantErr error
+	}{
+		{"Mismatch", "10.0.0.1|30.30.30.30|10.0.0.1\n", ErrGoldenMismatch},
+		{"Unexpected client", "horse|30.30.30.30|30.30.30.30\n", ErrGoldenMismatch},
+		{"Missing client", "10.0.0.1|30.30.30.30|\n", ErrGoldenMismatch},
+		{"Invalid expectation", "10.0.0.1|30.30.30.30|horse\n", ErrInvalidIPSpecification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tr.ReplayAgainstGolden(strings.NewReader("10.0.0.1|30.30.30.30|30.30.30.30\n" + tt.golden))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("TrustedProxies.ReplayAgainstGolden() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), "line 2: ") {
+				t.Errorf("TrustedProxies.ReplayAgainstGolden() error = %v, want it to start with the line number", err)
+			}
+		})
+	}
+
+	if err := tr.ReplayAgainstGolden(strings.NewReader("10.0.0.1,30.30.30.30\n")); err == nil {
+		t.Errorf("TrustedProxies.ReplayAgainstGolden() error = nil for a malformed line")
+	}
+}